@@ -25,7 +25,13 @@ func main() {
 
 	ctx := context.Background()
 
-	if err = app.Run(ctx, os.Getenv, sLogger); err != nil {
+	// "rotate-kek" wraps the device keys with the current key-encryption key instead of serving the API
+	run := app.Run
+	if len(os.Args) > 1 && os.Args[1] == "rotate-kek" {
+		run = app.RotateKEK
+	}
+
+	if err = run(ctx, os.Getenv, sLogger); err != nil {
 		sLogger.Fatal(err)
 	}
 }
@@ -3,37 +3,48 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/gren236/fiskaly-go-challenge/internal/domain"
 	"net/http"
+	"strconv"
 )
 
 func (s *Server) CreateDevice(response http.ResponseWriter, request *http.Request) {
-	// Parse request
 	var req CreateDeviceRequest
-	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
-		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+	if !s.decodeRequest(response, request, &req) {
+		return
+	}
+
+	device, err := s.deviceService.CreateDevice(
+		request.Context(), req.Label, domain.Algorithm(req.Algorithm), KeyParamsFromApi(req.KeyParams),
+	)
+	if err != nil {
+		WriteDomainError(response, request, err)
 
 		return
 	}
 
-	// Validate request
-	err := s.validate.Struct(req)
-	if err != nil { // Probably the error handling here could be a bit more sophisticated, but for the sake of test challenge it's enough IMO
-		var errors []string
-		for _, err := range err.(validator.ValidationErrors) {
-			errors = append(errors, fmt.Sprintf("%s: %s", err.Field(), err.Tag()))
-		}
+	WriteAPIResponse(response, http.StatusCreated, DeviceToApi(device))
+}
 
-		WriteErrorResponse(response, http.StatusBadRequest, errors)
+// ImportDevice creates a device with a key pair from another system. Its next signature continues the signature chain
+// with the given counter and last signature.
+func (s *Server) ImportDevice(response http.ResponseWriter, request *http.Request) {
+	var req ImportDeviceRequest
+	if !s.decodeRequest(response, request, &req) {
+		return
+	}
+
+	imp, err := DeviceImportFromApi(req)
+	if err != nil {
+		WriteDomainError(response, request, err)
 
 		return
 	}
 
-	device, err := s.deviceService.CreateDevice(request.Context(), req.Label, domain.Algorithm(req.Algorithm))
+	device, err := s.deviceService.ImportDevice(request.Context(), imp)
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteDomainError(response, request, err)
 
 		return
 	}
@@ -41,33 +52,80 @@ func (s *Server) CreateDevice(response http.ResponseWriter, request *http.Reques
 	WriteAPIResponse(response, http.StatusCreated, DeviceToApi(device))
 }
 
+// GetDevices lists the devices page by page, ordered by creation time. They can be filtered by label prefix and
+// algorithm.
 func (s *Server) GetDevices(response http.ResponseWriter, request *http.Request) {
-	devices, err := s.deviceService.GetDevices(request.Context())
+	qp := newQueryParser(request)
+	query := domain.DeviceQuery{
+		LabelPrefix: qp.string("label_prefix"),
+		Algorithm:   qp.algorithm("algorithm", s.config.Algorithms),
+		After:       qp.deviceCursor("after"),
+		Limit:       qp.limit(),
+	}
+	if qp.writeError(response, request) {
+		return
+	}
+
+	page, err := s.deviceService.QueryDevices(request.Context(), query)
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteDomainError(response, request, err)
 
 		return
 	}
 
-	var res []DeviceResponse
-	for _, device := range devices {
+	res := make([]DeviceResponse, 0, len(page.Devices))
+	for _, device := range page.Devices {
 		res = append(res, DeviceToApi(device))
 	}
 
-	WriteAPIResponse(response, http.StatusOK, res)
+	WritePageResponse(response, http.StatusOK, res, encodeDeviceCursor(page.Next))
 }
 
 func (s *Server) GetDevice(response http.ResponseWriter, request *http.Request) {
-	id := request.PathValue("id")
-	if id == "" {
-		WriteErrorResponse(response, http.StatusBadRequest, []string{"missing id parameter"})
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	device, err := s.deviceService.GetDevice(request.Context(), id)
+	if err != nil {
+		WriteDomainError(response, request, err)
 
 		return
 	}
 
-	device, err := s.deviceService.GetDevice(request.Context(), uuid.MustParse(id))
+	WriteAPIResponse(response, http.StatusOK, DeviceToApi(device))
+}
+
+// UpdateDevice changes the device status. It is used to deactivate and reactivate devices.
+func (s *Server) UpdateDevice(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	var req UpdateDeviceRequest
+	if !s.decodeRequest(response, request, &req) {
+		return
+	}
+
+	s.changeStatus(response, request, id, domain.Status(req.Status))
+}
+
+// DecommissionDevice retires the device for good, it can not sign anymore and can not be reactivated.
+func (s *Server) DecommissionDevice(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	s.changeStatus(response, request, id, domain.StatusDecommissioned)
+}
+
+func (s *Server) changeStatus(response http.ResponseWriter, request *http.Request, id uuid.UUID, status domain.Status) {
+	device, err := s.deviceService.ChangeStatus(request.Context(), id, status)
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteDomainError(response, request, err)
 
 		return
 	}
@@ -75,64 +133,296 @@ func (s *Server) GetDevice(response http.ResponseWriter, request *http.Request)
 	WriteAPIResponse(response, http.StatusOK, DeviceToApi(device))
 }
 
-func (s *Server) SignTransaction(response http.ResponseWriter, request *http.Request) {
-	id := request.PathValue("id")
-	if id == "" {
-		WriteErrorResponse(response, http.StatusBadRequest, []string{"missing id parameter"})
+// RotateKey replaces the device key pair with a new one. Signatures created with the old key can still be verified.
+func (s *Server) RotateKey(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
 
+	var req RotateKeyRequest
+	if !s.decodeRequest(response, request, &req) {
 		return
 	}
 
-	// Parse request
-	var req SignTransactionRequest
-	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
-		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+	device, err := s.deviceService.RotateKey(
+		request.Context(), id, domain.Algorithm(req.Algorithm), KeyParamsFromApi(req.KeyParams),
+	)
+	if err != nil {
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	WriteAPIResponse(response, http.StatusOK, DeviceToApi(device))
+}
+
+const (
+	contentTypePEM = "application/x-pem-file"
+	contentTypeJWK = "application/jwk+json"
+)
 
+// GetPublicKey exports the device public key either as a PEM file or as a JWK, depending on the Accept header. The
+// current key is exported unless a retired one is selected with key_version.
+func (s *Server) GetPublicKey(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
 		return
 	}
 
-	// Validate request
-	err := s.validate.Struct(req)
+	qp := newQueryParser(request)
+	version := qp.uint64("key_version")
+	if qp.writeError(response, request) {
+		return
+	}
+
+	contentType := negotiateContentType(request.Header.Get("Accept"), contentTypePEM, contentTypeJWK)
+	if contentType == "" {
+		WriteError(response, request, http.StatusNotAcceptable, ErrorCodeNotAcceptable,
+			fmt.Sprintf("supported content types: %s, %s", contentTypePEM, contentTypeJWK),
+		)
+
+		return
+	}
+
+	device, err := s.deviceService.GetDevice(request.Context(), id)
 	if err != nil {
-		var errors []string
-		for _, err := range err.(validator.ValidationErrors) {
-			errors = append(errors, fmt.Sprintf("%s: %s", err.Field(), err.Tag()))
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	key := device.CurrentKey()
+	if version != nil {
+		key, err = device.Key(int(*version))
+		if err != nil {
+			WriteDomainError(response, request, err)
+
+			return
+		}
+	}
+
+	var body []byte
+	switch contentType {
+	case contentTypeJWK:
+		jwk, err := s.keyEncoder.EncodeJWK(key.KeyPair, key.Params)
+		if err != nil {
+			WriteDomainError(response, request, err)
+
+			return
+		}
+
+		body, err = json.MarshalIndent(JWKToApi(device.ID, key, jwk), "", "  ")
+		if err != nil {
+			WriteInternalError(response)
+
+			return
+		}
+	default:
+		body, err = s.keyEncoder.EncodePEM(key.KeyPair)
+		if err != nil {
+			WriteDomainError(response, request, err)
+
+			return
 		}
+	}
+
+	response.Header().Set("Content-Type", contentType)
+	response.Header().Set("Vary", "Accept")
+	response.WriteHeader(http.StatusOK)
+	response.Write(body) // nolint:errcheck
+}
+
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// SignTransaction signs the data with the device key. If the request has an Idempotency-Key header, a retry with the
+// same key and data returns the signature created the first time instead of signing again.
+func (s *Server) SignTransaction(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
 
-		WriteErrorResponse(response, http.StatusBadRequest, errors)
+	idempotencyKey := request.Header.Get(headerIdempotencyKey)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		WriteError(response, request, http.StatusBadRequest, ErrorCodeIdempotencyKey,
+			fmt.Sprintf("%s header must be at most %d characters long", headerIdempotencyKey, maxIdempotencyKeyLength),
+		)
+
+		return
+	}
 
+	var req SignTransactionRequest
+	if !s.decodeRequest(response, request, &req) {
 		return
 	}
 
-	signature, err := s.signatureService.SignTransaction(request.Context(), uuid.MustParse(id), req.Data)
+	signature, replayed, err := s.signatureService.SignTransactionIdempotent(request.Context(), id, req.Data, idempotencyKey)
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteDomainError(response, request, err)
 
 		return
 	}
 
+	if replayed {
+		response.Header().Set(headerIdempotentReplayed, "true")
+	}
+
 	WriteAPIResponse(response, http.StatusCreated, SignatureToApi(signature))
 }
 
+// maxBatchItemSize is the average size of a batch item the request body is allowed to grow to, so the body of a batch
+// of Config.MaxBatchSize items is bounded before it is decoded.
+const maxBatchItemSize = 64 * 1024
+
+// SignTransactions signs a batch of data with consecutive counters. In all_or_nothing mode nothing is signed if one
+// item fails, in best_effort mode the other items are signed anyway and the result of every item is returned.
+func (s *Server) SignTransactions(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	// The body is bounded before it is decoded, the number of items can only be checked afterwards
+	request.Body = http.MaxBytesReader(response, request.Body, int64(s.config.MaxBatchSize)*maxBatchItemSize)
+
+	var req SignTransactionsRequest
+	if !s.decodeRequest(response, request, &req) {
+		return
+	}
+
+	if len(req.Data) > s.config.MaxBatchSize {
+		WriteError(response, request, http.StatusRequestEntityTooLarge, ErrorCodeBatchTooLarge,
+			fmt.Sprintf("batch must have at most %d items, got %d", s.config.MaxBatchSize, len(req.Data)),
+		)
+
+		return
+	}
+
+	mode := domain.BatchAllOrNothing
+	if req.Mode != "" {
+		mode = domain.BatchMode(req.Mode)
+	}
+
+	results, err := s.signatureService.SignTransactions(request.Context(), id, req.Data, mode)
+	if err != nil {
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	status := http.StatusCreated
+	res := make([]BatchResultResponse, 0, len(results))
+	for i, result := range results {
+		if result.Err != nil {
+			status = http.StatusMultiStatus
+		}
+
+		res = append(res, BatchResultToApi(request, i, result))
+	}
+
+	WriteAPIResponse(response, status, res)
+}
+
+// GetSignatures lists the device signatures page by page, ordered by counter. They can be filtered by counter and
+// creation time ranges.
 func (s *Server) GetSignatures(response http.ResponseWriter, request *http.Request) {
-	id := request.PathValue("id")
-	if id == "" {
-		WriteErrorResponse(response, http.StatusBadRequest, []string{"missing id parameter"})
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
 
+	qp := newQueryParser(request)
+	query := domain.SignatureQuery{
+		CounterFrom: qp.uint64("counter_from"),
+		CounterTo:   qp.uint64("counter_to"),
+		CreatedFrom: qp.time("created_from"),
+		CreatedTo:   qp.time("created_to"),
+		After:       qp.signatureCursor("after"),
+		Limit:       qp.limit(),
+	}
+	if qp.writeError(response, request) {
 		return
 	}
 
-	signatures, err := s.signatureService.GetSignatures(request.Context(), uuid.MustParse(id))
+	page, err := s.signatureService.QuerySignatures(request.Context(), id, query)
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteDomainError(response, request, err)
 
 		return
 	}
 
-	var res []SignatureResponse
-	for _, signature := range signatures {
+	res := make([]SignatureResponse, 0, len(page.Signatures))
+	for _, signature := range page.Signatures {
 		res = append(res, SignatureToApi(signature))
 	}
 
-	WriteAPIResponse(response, http.StatusOK, res)
+	WritePageResponse(response, http.StatusOK, res, encodeSignatureCursor(page.Next))
+}
+
+// GetSignature returns the device signature created with the counter value from the path.
+func (s *Server) GetSignature(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	counter, err := strconv.ParseUint(request.PathValue("counter"), 10, 64)
+	if err != nil {
+		WriteError(response, request, http.StatusBadRequest, ErrorCodeInvalidCounter,
+			"counter parameter must be a non-negative number",
+		)
+
+		return
+	}
+
+	signature, err := s.signatureService.GetSignature(request.Context(), id, counter)
+	if err != nil {
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	WriteAPIResponse(response, http.StatusOK, SignatureToApi(signature))
+}
+
+func (s *Server) VerifySignature(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	var req VerifySignatureRequest
+	if !s.decodeRequest(response, request, &req) {
+		return
+	}
+
+	valid, err := s.signatureService.VerifySignature(request.Context(), id, req.Signature, req.SignedData)
+	if err != nil {
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	WriteAPIResponse(response, http.StatusOK, VerificationResponse{Valid: valid})
+}
+
+func (s *Server) AuditChain(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	audit, err := s.signatureService.AuditChain(request.Context(), id)
+	if err != nil {
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	WriteAPIResponse(response, http.StatusOK, ChainAuditToApi(audit))
 }
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignTransactions_TooLarge(t *testing.T) {
+	deviceID := uuid.New()
+	// Without a signature service the batch would panic if it was signed
+	s := NewServer(nil, Config{MaxBatchSize: 2}, validator.New(validator.WithRequiredStructEnabled()), nil, nil, nil)
+
+	tests := []struct {
+		name string
+		body string
+		code string
+	}{
+		{
+			name: "too many items",
+			body: `{"data": ["a", "b", "c"]}`,
+			code: ErrorCodeBatchTooLarge,
+		},
+		{
+			// The body is rejected while it is read, before the items are counted
+			name: "body too long",
+			body: `{"data": ["` + strings.Repeat("a", 2*maxBatchItemSize) + `"]}`,
+			code: ErrorCodeRequestTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost,
+				"/api/v0/devices/"+deviceID.String()+"/signatures:batch", strings.NewReader(tt.body))
+			request.SetPathValue("id", deviceID.String())
+
+			recorder := httptest.NewRecorder()
+			s.SignTransactions(recorder, request)
+			require.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+			var res ErrorResponse
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+			assert.Equal(t, tt.code, res.Code)
+		})
+	}
+}
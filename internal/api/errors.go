@@ -0,0 +1,314 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Error codes are returned in the error responses next to the messages. Unlike the messages they are stable, so
+// clients can rely on them.
+const (
+	ErrorCodeInvalidRequest    = "invalid_request"
+	ErrorCodeValidationFailed  = "validation_failed"
+	ErrorCodeInvalidID         = "invalid_id"
+	ErrorCodeInvalidCounter    = "invalid_counter"
+	ErrorCodeNotAcceptable     = "not_acceptable"
+	ErrorCodeUnsupportedMedia  = "unsupported_media_type"
+	ErrorCodeDeviceNotFound    = "device_not_found"
+	ErrorCodeSignatureNotFound = "signature_not_found"
+	ErrorCodeKeyNotFound       = "key_not_found"
+	ErrorCodeInvalidAlgorithm  = "invalid_algorithm"
+	ErrorCodeInvalidKeyParams  = "invalid_key_params"
+	ErrorCodeInvalidImport     = "invalid_import"
+	ErrorCodeDeviceInactive    = "device_inactive"
+	ErrorCodeConflict          = "conflict"
+	ErrorCodeIdempotencyKey    = "invalid_idempotency_key"
+	ErrorCodeIdempotencyReused = "idempotency_key_reused"
+	ErrorCodeBatchTooLarge     = "batch_too_large"
+	ErrorCodeRequestTooLarge   = "request_too_large"
+	ErrorCodeInternal          = "internal_error"
+)
+
+// apiError is an error response before it is written in the format of the requested API version: v0 clients get
+// ErrorResponse, newer ones get Problem.
+type apiError struct {
+	status   int
+	code     string
+	messages []string
+
+	// detail and invalidParams are used by Problem only. If detail is empty, the messages are joined instead.
+	detail        string
+	invalidParams []InvalidParam
+}
+
+// WriteError writes the error response in the format of the API version the request was made to.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code string, messages ...string) {
+	writeError(w, r, apiError{status: status, code: code, messages: messages})
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e apiError) {
+	if apiVersion(r.Context()) == apiV0 {
+		WriteErrorResponse(w, e.status, e.code, e.messages)
+
+		return
+	}
+
+	detail := e.detail
+	if detail == "" {
+		detail = strings.Join(e.messages, "; ")
+	}
+
+	problem := NewProblem(e.status, e.code, detail)
+	problem.Instance = r.URL.Path
+	problem.InvalidParams = e.invalidParams
+
+	WriteProblem(w, problem)
+}
+
+// internalErrorMessage is sent instead of the message of internal errors.
+const internalErrorMessage = "internal server error"
+
+// WriteDomainError maps an error returned by the services to an HTTP status and error code and writes it as an HTTP
+// error response. Errors which are not known to the API are internal errors.
+func WriteDomainError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := domainErrorStatus(err)
+
+	WriteError(w, r, status, code, domainErrorMessage(r, code, err))
+}
+
+// domainErrorMessage returns the message of the error for the response. Internal errors may tell about the storage or
+// the keys, so they are logged and the client only gets internalErrorMessage.
+func domainErrorMessage(r *http.Request, code string, err error) string {
+	if code != ErrorCodeInternal {
+		return err.Error()
+	}
+
+	requestLogger(r.Context()).Errorw("internal error", "method", r.Method, "path", r.URL.EscapedPath(), "error", err)
+
+	return internalErrorMessage
+}
+
+// domainErrorStatus maps an error returned by the services to an HTTP status and error code.
+func domainErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, domain.ErrDeviceNotFound):
+		return http.StatusNotFound, ErrorCodeDeviceNotFound
+	case errors.Is(err, domain.ErrSignatureNotFound):
+		return http.StatusNotFound, ErrorCodeSignatureNotFound
+	case errors.Is(err, domain.ErrKeyNotFound):
+		return http.StatusNotFound, ErrorCodeKeyNotFound
+	case errors.Is(err, domain.ErrInvalidAlgorithm):
+		return http.StatusBadRequest, ErrorCodeInvalidAlgorithm
+	case errors.Is(err, domain.ErrInvalidKeyParams):
+		return http.StatusBadRequest, ErrorCodeInvalidKeyParams
+	case errors.Is(err, domain.ErrInvalidImport):
+		return http.StatusBadRequest, ErrorCodeInvalidImport
+	case errors.Is(err, domain.ErrDeviceInactive):
+		return http.StatusConflict, ErrorCodeDeviceInactive
+	case errors.As(err, new(*domain.IdempotencyKeyReusedError)):
+		return http.StatusConflict, ErrorCodeIdempotencyReused
+	case errors.Is(err, domain.ErrConflict):
+		return http.StatusConflict, ErrorCodeConflict
+	default:
+		return http.StatusInternalServerError, ErrorCodeInternal
+	}
+}
+
+// parseDeviceID returns the device ID from the request path. If it is missing or malformed, an error response is
+// written and false is returned.
+func parseDeviceID(response http.ResponseWriter, request *http.Request) (uuid.UUID, bool) {
+	raw := request.PathValue("id")
+	if raw == "" {
+		WriteError(response, request, http.StatusBadRequest, ErrorCodeInvalidID, "missing id parameter")
+
+		return uuid.Nil, false
+	}
+
+	id, err := uuid.Parse(raw)
+	if err != nil {
+		WriteError(response, request, http.StatusBadRequest, ErrorCodeInvalidID,
+			fmt.Sprintf("malformed id parameter: %s", err),
+		)
+
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// decodeRequest decodes the JSON request body into req and validates it. If the body is malformed, invalid or longer
+// than an http.MaxBytesReader allows, an error response is written and false is returned.
+func (s *Server) decodeRequest(response http.ResponseWriter, request *http.Request, req interface{}) bool {
+	if err := json.NewDecoder(request.Body).Decode(req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			WriteError(response, request, http.StatusRequestEntityTooLarge, ErrorCodeRequestTooLarge,
+				fmt.Sprintf("request body must be at most %d bytes", maxBytesErr.Limit),
+			)
+
+			return false
+		}
+
+		WriteError(response, request, http.StatusBadRequest, ErrorCodeInvalidRequest, decodeErrorMessage(err))
+
+		return false
+	}
+
+	err := s.validate.Struct(req)
+	if err == nil {
+		return true
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		WriteError(response, request, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+
+		return false
+	}
+
+	e := apiError{
+		status:        http.StatusBadRequest,
+		code:          ErrorCodeValidationFailed,
+		messages:      make([]string, 0, len(validationErrs)),
+		detail:        "one or more request fields are invalid",
+		invalidParams: s.invalidParams(req, validationErrs),
+	}
+	for _, err := range validationErrs {
+		e.messages = append(e.messages, fmt.Sprintf("%s: %s", err.Field(), err.Tag()))
+	}
+
+	writeError(response, request, e)
+
+	return false
+}
+
+// invalidParams describes the validation errors of req by the request fields as they are named in the JSON body.
+func (s *Server) invalidParams(req interface{}, validationErrs validator.ValidationErrors) []InvalidParam {
+	params := make([]InvalidParam, 0, len(validationErrs))
+	for _, err := range validationErrs {
+		// The namespace starts with the name of the request type
+		_, field, _ := strings.Cut(err.StructNamespace(), ".")
+
+		params = append(params, InvalidParam{
+			Name:   jsonFieldName(req, field),
+			Reason: s.validationReason(err),
+		})
+	}
+
+	return params
+}
+
+// validationErrorMessage joins the validation errors of req into a single message, naming the fields like the JSON
+// body does. It is used where there is no room for InvalidParam, like in the results of a stream.
+func (s *Server) validationErrorMessage(req interface{}, err error) string {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return err.Error()
+	}
+
+	params := s.invalidParams(req, validationErrs)
+
+	messages := make([]string, 0, len(params))
+	for _, param := range params {
+		messages = append(messages, fmt.Sprintf("%s: %s", param.Name, param.Reason))
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// decodeErrorMessage describes an error of decoding a JSON request body. Type errors name the JSON field instead of
+// the Go type the body was decoded into.
+func decodeErrorMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return err.Error()
+	}
+
+	if typeErr.Field == "" {
+		return fmt.Sprintf("request body must be %s", jsonTypeName(typeErr.Type))
+	}
+
+	return fmt.Sprintf("%s: must be %s", typeErr.Field, jsonTypeName(typeErr.Type))
+}
+
+// jsonTypeName returns the name of the JSON type a value of the Go type is decoded from.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// jsonFieldName returns the name of the request struct field as it appears in the JSON body. Nested fields are given
+// by their path, like "KeyParams.Hash". The index of a slice element, like in "Data[2]", is kept.
+func jsonFieldName(req interface{}, field string) string {
+	t := reflect.TypeOf(req)
+
+	parts := strings.Split(field, ".")
+	for i, part := range parts {
+		name, index, _ := strings.Cut(part, "[")
+		if index != "" {
+			index = "[" + index
+		}
+
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+
+		if t.Kind() != reflect.Struct {
+			break
+		}
+
+		f, ok := t.FieldByName(name)
+		if !ok {
+			break
+		}
+
+		if jsonName, _, _ := strings.Cut(f.Tag.Get("json"), ","); jsonName != "" && jsonName != "-" {
+			parts[i] = jsonName + index
+		}
+
+		t = f.Type
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// validationReason describes the failed validation rule in a human-readable way.
+func (s *Server) validationReason(err validator.FieldError) string {
+	switch err.Tag() {
+	case "required":
+		return "is required"
+	case "algorithm":
+		return fmt.Sprintf("must be one of: %s", joinAlgorithms(s.config.Algorithms))
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", strings.Join(strings.Fields(err.Param()), ", "))
+	default:
+		if err.Param() != "" {
+			return fmt.Sprintf("must satisfy %s=%s", err.Tag(), err.Param())
+		}
+
+		return fmt.Sprintf("must satisfy %s", err.Tag())
+	}
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWriteDomainError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{
+			name:   "device not found",
+			err:    fmt.Errorf("failed to sign transaction: %w", domain.ErrDeviceNotFound),
+			status: http.StatusNotFound,
+			code:   ErrorCodeDeviceNotFound,
+		},
+		{
+			name:   "invalid algorithm",
+			err:    fmt.Errorf("%w: DSA", domain.ErrInvalidAlgorithm),
+			status: http.StatusBadRequest,
+			code:   ErrorCodeInvalidAlgorithm,
+		},
+		{
+			name:   "invalid key parameters",
+			err:    fmt.Errorf("%w: curve P-256 is not allowed", domain.ErrInvalidKeyParams),
+			status: http.StatusBadRequest,
+			code:   ErrorCodeInvalidKeyParams,
+		},
+		{
+			name:   "invalid import",
+			err:    fmt.Errorf("%w: the last signature is required", domain.ErrInvalidImport),
+			status: http.StatusBadRequest,
+			code:   ErrorCodeInvalidImport,
+		},
+		{
+			name:   "device inactive",
+			err:    &domain.DeviceInactiveError{ID: uuid.New(), Status: domain.StatusDeactivated},
+			status: http.StatusConflict,
+			code:   ErrorCodeDeviceInactive,
+		},
+		{
+			name:   "status transition",
+			err:    &domain.StatusTransitionError{From: domain.StatusDecommissioned, To: domain.StatusActive},
+			status: http.StatusConflict,
+			code:   ErrorCodeConflict,
+		},
+		{
+			name:   "idempotency key reused",
+			err:    fmt.Errorf("failed to sign transaction: %w", &domain.IdempotencyKeyReusedError{Key: "key"}),
+			status: http.StatusConflict,
+			code:   ErrorCodeIdempotencyReused,
+		},
+		{
+			name:   "unknown error",
+			err:    errors.New("database is locked"),
+			status: http.StatusInternalServerError,
+			code:   ErrorCodeInternal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/v0/devices", nil)
+			recorder := httptest.NewRecorder()
+
+			WriteDomainError(recorder, request, tt.err)
+
+			var res ErrorResponse
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+			assert.Equal(t, tt.status, recorder.Code)
+			assert.Equal(t, tt.code, res.Code)
+
+			message := tt.err.Error()
+			if tt.code == ErrorCodeInternal {
+				message = internalErrorMessage
+			}
+			assert.Equal(t, []string{message}, res.Errors)
+		})
+	}
+}
+
+func TestParseDeviceID(t *testing.T) {
+	id := uuid.New()
+
+	tests := []struct {
+		name string
+		id   string
+		ok   bool
+	}{
+		{name: "valid", id: id.String(), ok: true},
+		{name: "malformed", id: "not-a-uuid", ok: false},
+		{name: "missing", id: "", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.SetPathValue("id", tt.id)
+			recorder := httptest.NewRecorder()
+
+			got, ok := parseDeviceID(recorder, request)
+
+			assert.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, id, got)
+				return
+			}
+
+			var res ErrorResponse
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, ErrorCodeInvalidID, res.Code)
+		})
+	}
+}
+
+func TestWriteDomainError_Problem(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/devices/42", nil)
+	request = request.WithContext(context.WithValue(request.Context(), apiVersionKey{}, apiV1))
+	recorder := httptest.NewRecorder()
+
+	err := fmt.Errorf("failed to get device: %w", domain.ErrDeviceNotFound)
+	WriteDomainError(recorder, request, err)
+
+	var res Problem
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, contentTypeProblem, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, Problem{
+		Type:     "/problems/device_not_found",
+		Title:    "Device not found",
+		Status:   http.StatusNotFound,
+		Detail:   err.Error(),
+		Instance: "/api/v1/devices/42",
+		Code:     ErrorCodeDeviceNotFound,
+	}, res)
+}
+
+func TestWriteDomainError_Internal(t *testing.T) {
+	core, logs := observer.New(zap.ErrorLevel)
+	err := errors.New("could not query devices: database is locked")
+
+	for _, version := range []string{apiV0, apiV1} {
+		t.Run(version, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/"+version+"/devices", nil)
+			ctx := context.WithValue(request.Context(), apiVersionKey{}, version)
+			request = request.WithContext(context.WithValue(ctx, loggerKey{}, zap.New(core).Sugar()))
+			recorder := httptest.NewRecorder()
+
+			WriteDomainError(recorder, request, err)
+
+			// The client only learns that something went wrong, the error is logged
+			assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), internalErrorMessage)
+			assert.NotContains(t, recorder.Body.String(), "database is locked")
+		})
+	}
+
+	require.Equal(t, 2, logs.Len())
+	assert.Equal(t, err.Error(), logs.All()[0].ContextMap()["error"])
+
+	result := BatchResultToApi(httptest.NewRequest(http.MethodPost, "/", nil), 0, domain.BatchResult{Err: err})
+	assert.Equal(t, &BatchErrorResponse{Code: ErrorCodeInternal, Message: internalErrorMessage}, result.Error)
+}
+
+func TestDecodeRequest_ValidationErrors(t *testing.T) {
+	s := NewServer(nil, Config{Algorithms: []domain.Algorithm{domain.AlgorithmRSA, domain.AlgorithmECC}},
+		validator.New(validator.WithRequiredStructEnabled()), nil, nil, nil,
+	)
+
+	tests := []struct {
+		version string
+		check   func(t *testing.T, body []byte)
+	}{
+		{
+			version: apiV0,
+			check: func(t *testing.T, body []byte) {
+				var res ErrorResponse
+				require.NoError(t, json.Unmarshal(body, &res))
+				assert.Equal(t, ErrorResponse{Code: ErrorCodeValidationFailed, Errors: []string{"Algorithm: algorithm"}}, res)
+			},
+		},
+		{
+			version: apiV1,
+			check: func(t *testing.T, body []byte) {
+				var res Problem
+				require.NoError(t, json.Unmarshal(body, &res))
+				assert.Equal(t, ErrorCodeValidationFailed, res.Code)
+				assert.Equal(t, []InvalidParam{{Name: "algorithm", Reason: "must be one of: RSA, ECC"}}, res.InvalidParams)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			body := strings.NewReader(`{"algorithm": "DSA"}`)
+			request := httptest.NewRequest(http.MethodPost, "/api/"+tt.version+"/devices", body)
+			request = request.WithContext(context.WithValue(request.Context(), apiVersionKey{}, tt.version))
+			recorder := httptest.NewRecorder()
+
+			var req CreateDeviceRequest
+			ok := s.decodeRequest(recorder, request, &req)
+
+			assert.False(t, ok)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			tt.check(t, recorder.Body.Bytes())
+		})
+	}
+}
+
+func TestDecodeErrorMessage(t *testing.T) {
+	tests := []struct {
+		body    string
+		req     interface{}
+		message string
+	}{
+		{body: `{"data": 1}`, req: &SignTransactionRequest{}, message: "data: must be a string"},
+		{body: `{"data": "first"}`, req: &[]SignTransactionRequest{}, message: "request body must be an array"},
+		{body: `{"data": `, req: &SignTransactionRequest{}, message: "unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			err := json.Unmarshal([]byte(tt.body), tt.req)
+			require.Error(t, err)
+
+			// The Go types the body is decoded into are not exposed
+			assert.Equal(t, tt.message, decodeErrorMessage(err))
+		})
+	}
+}
+
+func TestJSONFieldName(t *testing.T) {
+	assert.Equal(t, "algorithm", jsonFieldName(&CreateDeviceRequest{}, "Algorithm"))
+	assert.Equal(t, "data[2]", jsonFieldName(&SignTransactionsRequest{}, "Data[2]"))
+	assert.Equal(t, "Unknown", jsonFieldName(&CreateDeviceRequest{}, "Unknown"))
+	assert.Equal(t, "key_params.rsa_bits", jsonFieldName(&CreateDeviceRequest{}, "KeyParams.RSABits"))
+}
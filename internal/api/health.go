@@ -11,7 +11,7 @@ type HealthResponse struct {
 func (s *Server) Health(response http.ResponseWriter, request *http.Request) {
 	health := HealthResponse{
 		Status:  "pass",
-		Version: "v0",
+		Version: apiVersion(request.Context()),
 	}
 
 	WriteAPIResponse(response, http.StatusOK, health)
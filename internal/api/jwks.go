@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type JWKSetResponse struct {
+	Keys []JWKResponse `json:"keys"`
+}
+
+// GetJWKS publishes the public keys of all devices as a JWK Set, so verifiers can fetch and cache them in one call.
+// The retired keys of the devices are published as well, so signatures created before a key rotation can still be
+// verified. Every key is identified by the device ID and the key version, like the signatures. The response carries
+// an ETag, and a request with a matching If-None-Match header gets 304 Not Modified.
+func (s *Server) GetJWKS(response http.ResponseWriter, request *http.Request) {
+	devices, err := s.deviceService.GetDevices(request.Context())
+	if err != nil {
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	set := JWKSetResponse{Keys: make([]JWKResponse, 0, len(devices))}
+	for _, device := range devices {
+		for _, key := range device.Keys() {
+			jwk, err := s.keyEncoder.EncodeJWK(key.KeyPair, key.Params)
+			if err != nil {
+				WriteDomainError(response, request, err)
+
+				return
+			}
+
+			set.Keys = append(set.Keys, JWKToApi(device.ID, key, jwk))
+		}
+	}
+
+	// Keys must always come in the same order, otherwise the ETag would change between requests
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+
+	body, err := json.Marshal(set)
+	if err != nil {
+		WriteInternalError(response)
+
+		return
+	}
+
+	hash := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+
+	response.Header().Set("ETag", etag)
+	response.Header().Set("Cache-Control", "public, no-cache")
+
+	if etagMatches(request.Header.Get("If-None-Match"), etag) {
+		response.WriteHeader(http.StatusNotModified)
+
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/jwk-set+json")
+	response.WriteHeader(http.StatusOK)
+	response.Write(body) // nolint:errcheck
+}
+
+// etagMatches reports whether the If-None-Match header value matches the given ETag. Weak comparison is used as
+// RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
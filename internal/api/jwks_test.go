@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newRotatedDevice returns a device whose first key was retired by a rotation.
+func newRotatedDevice(t *testing.T) domain.Device {
+	generator := crypto.NewGenerator()
+	params := domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA256}
+
+	retired, err := generator.GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+
+	current, err := generator.GenerateKeyPair(domain.AlgorithmED25519, domain.KeyParams{})
+	require.NoError(t, err)
+
+	return domain.Device{
+		ID:           uuid.New(),
+		KeyPair:      current,
+		Algorithm:    domain.AlgorithmED25519,
+		KeyVersion:   2,
+		KeyValidFrom: 3,
+		RetiredKeys: []domain.RetiredKey{{
+			DeviceKey: domain.DeviceKey{
+				Version: 1, KeyPair: retired, Algorithm: domain.AlgorithmECC, Params: params, ValidFrom: 0,
+			},
+			ValidUntil: 3,
+		}},
+	}
+}
+
+func TestGetJWKS_RetiredKeys(t *testing.T) {
+	device := newRotatedDevice(t)
+	deviceSvc := new(MockDeviceService)
+	s := &Server{deviceService: deviceSvc, keyEncoder: crypto.NewPublicKeyEncoder()}
+
+	deviceSvc.On("GetDevices", mock.Anything).Return([]domain.Device{device}, nil)
+
+	recorder := httptest.NewRecorder()
+	s.GetJWKS(recorder, httptest.NewRequest(http.MethodGet, "/api/v0/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var set JWKSetResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &set))
+	require.Len(t, set.Keys, 2)
+
+	// Every version of the key has a kid of its own, matching the kid of its signatures
+	keys := map[string]string{}
+	for _, key := range set.Keys {
+		keys[key.KeyID] = key.KeyType
+	}
+	assert.Equal(t, map[string]string{
+		device.ID.String() + "#1": "EC",
+		device.ID.String() + "#2": "OKP",
+	}, keys)
+	assert.Equal(t, device.ID.String()+"#1", SignatureToApi(domain.SignedData{DeviceID: device.ID, KeyVersion: 1}).KeyID)
+}
+
+func TestGetPublicKey_KeyVersion(t *testing.T) {
+	device := newRotatedDevice(t)
+	deviceSvc := new(MockDeviceService)
+	s := &Server{deviceService: deviceSvc, keyEncoder: crypto.NewPublicKeyEncoder()}
+
+	deviceSvc.On("GetDevice", mock.Anything, device.ID).Return(device, nil)
+
+	tests := []struct {
+		query  string
+		status int
+		kid    string
+	}{
+		{query: "", status: http.StatusOK, kid: device.ID.String() + "#2"},
+		{query: "?key_version=1", status: http.StatusOK, kid: device.ID.String() + "#1"},
+		{query: "?key_version=3", status: http.StatusNotFound},
+		{query: "?key_version=x", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/v0/devices/"+device.ID.String()+"/public-key"+tt.query, nil)
+			request = request.WithContext(context.Background())
+			request.SetPathValue("id", device.ID.String())
+			request.Header.Set("Accept", contentTypeJWK)
+
+			recorder := httptest.NewRecorder()
+			s.GetPublicKey(recorder, request)
+			require.Equal(t, tt.status, recorder.Code)
+
+			if tt.status == http.StatusOK {
+				var jwk JWKResponse
+				require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &jwk))
+				assert.Equal(t, tt.kid, jwk.KeyID)
+			}
+		})
+	}
+}
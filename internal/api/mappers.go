@@ -1,23 +1,159 @@
 package api
 
-import "github.com/gren236/fiskaly-go-challenge/internal/domain"
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"net/http"
+	"strings"
+	"time"
+)
 
 type CreateDeviceRequest struct {
-	Label     *string `json:"label" validate:"omitempty"`
-	Algorithm string  `json:"algorithm" validate:"required,oneof=RSA ECC"`
+	Label     *string           `json:"label" validate:"omitempty"`
+	Algorithm string            `json:"algorithm" validate:"required,algorithm"`
+	KeyParams *KeyParamsRequest `json:"key_params"`
+}
+
+// KeyParamsRequest holds the optional key parameters. The ones which are not set get the defaults of the algorithm.
+type KeyParamsRequest struct {
+	RSABits    int    `json:"rsa_bits" validate:"omitempty,oneof=2048 3072 4096"`
+	Padding    string `json:"padding" validate:"omitempty,oneof=PKCS1v15 PSS"`
+	SaltLength int    `json:"salt_length" validate:"omitempty,gt=0"`
+	Curve      string `json:"curve" validate:"omitempty,oneof=P-256 P-384 P-521"`
+	Hash       string `json:"hash" validate:"omitempty,oneof=SHA-256 SHA-384 SHA-512"`
+}
+
+func KeyParamsFromApi(req *KeyParamsRequest) domain.KeyParams {
+	if req == nil {
+		return domain.KeyParams{}
+	}
+
+	return domain.KeyParams{
+		RSABits:    req.RSABits,
+		Padding:    domain.Padding(req.Padding),
+		SaltLength: req.SaltLength,
+		Curve:      domain.Curve(req.Curve),
+		Hash:       domain.Hash(req.Hash),
+	}
+}
+
+type UpdateDeviceRequest struct {
+	Status string `json:"status" validate:"required,oneof=ACTIVE DEACTIVATED"`
+}
+
+type RotateKeyRequest struct {
+	Algorithm string            `json:"algorithm" validate:"required,algorithm"`
+	KeyParams *KeyParamsRequest `json:"key_params"`
+}
+
+// ImportDeviceRequest moves a device from another system. The private key is either PEM encoded or a base64 encoded
+// DER PKCS #8 key, the signature counter and the last signature are the state of its signature chain.
+type ImportDeviceRequest struct {
+	Label            *string           `json:"label" validate:"omitempty"`
+	Algorithm        string            `json:"algorithm" validate:"required,algorithm"`
+	KeyParams        *KeyParamsRequest `json:"key_params"`
+	PrivateKey       string            `json:"private_key" validate:"required"`
+	SignatureCounter uint64            `json:"signature_counter"`
+	LastSignature    string            `json:"last_signature" validate:"omitempty,base64"`
+}
+
+func DeviceImportFromApi(req ImportDeviceRequest) (domain.DeviceImport, error) {
+	privateKey := []byte(req.PrivateKey)
+	if !strings.HasPrefix(strings.TrimSpace(req.PrivateKey), "-----BEGIN") {
+		der, err := base64.StdEncoding.DecodeString(req.PrivateKey)
+		if err != nil {
+			return domain.DeviceImport{}, fmt.Errorf(
+				"%w: the private key is neither PEM nor base64 encoded", domain.ErrInvalidImport,
+			)
+		}
+
+		privateKey = der
+	}
+
+	return domain.DeviceImport{
+		Label:            req.Label,
+		Algorithm:        domain.Algorithm(req.Algorithm),
+		KeyParams:        KeyParamsFromApi(req.KeyParams),
+		PrivateKey:       privateKey,
+		SignatureCounter: req.SignatureCounter,
+		LastSignature:    req.LastSignature,
+	}, nil
 }
 
 type DeviceResponse struct {
-	ID        string  `json:"id"`
-	Label     *string `json:"label"`
-	Algorithm string  `json:"algorithm"`
+	ID              string            `json:"id"`
+	Label           *string           `json:"label"`
+	Algorithm       string            `json:"algorithm"`
+	KeyParams       KeyParamsResponse `json:"key_params"`
+	KeyVersion      int               `json:"key_version"`
+	Status          string            `json:"status"`
+	CreatedAt       time.Time         `json:"created_at"`
+	StatusChangedAt time.Time         `json:"status_changed_at"`
 }
 
 func DeviceToApi(device domain.Device) DeviceResponse {
 	return DeviceResponse{
-		ID:        device.ID.String(),
-		Label:     device.Label,
-		Algorithm: device.Algorithm.String(),
+		ID:              device.ID.String(),
+		Label:           device.Label,
+		Algorithm:       device.Algorithm.String(),
+		KeyParams:       KeyParamsToApi(device.KeyParams),
+		KeyVersion:      device.KeyVersion,
+		Status:          device.Status.String(),
+		CreatedAt:       device.CreatedAt,
+		StatusChangedAt: device.StatusChangedAt,
+	}
+}
+
+// KeyParamsResponse holds the parameters which apply to the algorithm of the key.
+type KeyParamsResponse struct {
+	RSABits    int    `json:"rsa_bits,omitempty"`
+	Padding    string `json:"padding,omitempty"`
+	SaltLength int    `json:"salt_length,omitempty"`
+	Curve      string `json:"curve,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+}
+
+func KeyParamsToApi(params domain.KeyParams) KeyParamsResponse {
+	return KeyParamsResponse{
+		RSABits:    params.RSABits,
+		Padding:    params.Padding.String(),
+		SaltLength: params.SaltLength,
+		Curve:      params.Curve.String(),
+		Hash:       params.Hash.String(),
+	}
+}
+
+type JWKResponse struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg,omitempty"` // JWA has no name for some combinations of curve and hash
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	Modulus   string `json:"n,omitempty"`
+	Exponent  string `json:"e,omitempty"`
+}
+
+// KeyID identifies a version of a device key. It is the kid of the JWK of the key and is returned with the signatures
+// created with it.
+func KeyID(deviceID uuid.UUID, version int) string {
+	return fmt.Sprintf("%s#%d", deviceID, version)
+}
+
+func JWKToApi(deviceID uuid.UUID, key domain.DeviceKey, jwk domain.JWK) JWKResponse {
+	return JWKResponse{
+		KeyType:   jwk.KeyType,
+		KeyID:     KeyID(deviceID, key.Version),
+		Use:       "sig",
+		Algorithm: jwk.Algorithm,
+		Curve:     jwk.Curve,
+		X:         jwk.X,
+		Y:         jwk.Y,
+		Modulus:   jwk.Modulus,
+		Exponent:  jwk.Exponent,
 	}
 }
 
@@ -26,13 +162,82 @@ type SignTransactionRequest struct {
 }
 
 type SignatureResponse struct {
-	Signature  string `json:"signature"`
-	SignedData string `json:"signed_data"`
+	DeviceID   string    `json:"device_id"`
+	Counter    uint64    `json:"counter"`
+	Signature  string    `json:"signature"`
+	SignedData string    `json:"signed_data"`
+	Algorithm  string    `json:"algorithm"`
+	KeyID      string    `json:"kid"`
+	SignedAt   time.Time `json:"signed_at"`
 }
 
 func SignatureToApi(signature domain.SignedData) SignatureResponse {
 	return SignatureResponse{
+		DeviceID:   signature.DeviceID.String(),
+		Counter:    signature.Counter,
 		Signature:  signature.Signature,
 		SignedData: signature.OriginalData,
+		Algorithm:  signature.Algorithm.String(),
+		KeyID:      KeyID(signature.DeviceID, signature.KeyVersion),
+		SignedAt:   signature.SignedAt,
+	}
+}
+
+// SignTransactionsRequest is a batch of data to sign, in the order the signature counters are assigned.
+type SignTransactionsRequest struct {
+	Data []string `json:"data" validate:"required,min=1,dive,required"`
+	Mode string   `json:"mode" validate:"omitempty,oneof=all_or_nothing best_effort"` // all_or_nothing by default
+}
+
+// BatchResultResponse is the outcome of signing the item of the batch at Index. Either Signature or Error is set.
+type BatchResultResponse struct {
+	Index     int                 `json:"index"`
+	Signature *SignatureResponse  `json:"signature,omitempty"`
+	Error     *BatchErrorResponse `json:"error,omitempty"`
+}
+
+type BatchErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func BatchResultToApi(request *http.Request, index int, result domain.BatchResult) BatchResultResponse {
+	res := BatchResultResponse{Index: index}
+
+	if result.Err != nil {
+		_, code := domainErrorStatus(result.Err)
+		res.Error = &BatchErrorResponse{Code: code, Message: domainErrorMessage(request, code, result.Err)}
+
+		return res
+	}
+
+	signature := SignatureToApi(*result.Signature)
+	res.Signature = &signature
+
+	return res
+}
+
+type VerifySignatureRequest struct {
+	Signature  string `json:"signature" validate:"required"`
+	SignedData string `json:"signed_data" validate:"required"`
+}
+
+type VerificationResponse struct {
+	Valid bool `json:"valid"`
+}
+
+type AuditResponse struct {
+	Valid       bool   `json:"valid"`
+	Checked     int    `json:"checked"`
+	BrokenIndex *int   `json:"broken_index,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+func ChainAuditToApi(audit domain.ChainAudit) AuditResponse {
+	return AuditResponse{
+		Valid:       audit.Valid,
+		Checked:     audit.Checked,
+		BrokenIndex: audit.BrokenIndex,
+		Reason:      audit.Reason,
 	}
 }
@@ -1,11 +1,23 @@
 package api
 
 import (
+	"context"
 	"go.uber.org/zap"
 	"net/http"
 	"time"
 )
 
+type loggerKey struct{}
+
+// requestLogger returns the logger LoggingMiddleware stored in the request context, a no-op logger if there is none.
+func requestLogger(ctx context.Context) *zap.SugaredLogger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.SugaredLogger); ok {
+		return logger
+	}
+
+	return zap.NewNop().Sugar()
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	status      int
@@ -20,6 +32,11 @@ func (rw *responseWriter) Status() int {
 	return rw.status
 }
 
+// Unwrap lets http.ResponseController reach the wrapped writer, to flush it or to enable full duplex for streaming.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *responseWriter) WriteHeader(code int) {
 	if rw.wroteHeader {
 		return
@@ -47,7 +64,7 @@ func LoggingMiddleware(logger *zap.SugaredLogger) func(http.Handler) http.Handle
 			wrapped := wrapResponseWriter(w)
 
 			start := time.Now()
-			next.ServeHTTP(wrapped, r)
+			next.ServeHTTP(wrapped, r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)))
 
 			logger.Infow("request handled",
 				"status", wrapped.status,
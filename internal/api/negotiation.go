@@ -0,0 +1,70 @@
+package api
+
+import (
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type mediaRange struct {
+	mediaType string
+	quality   float64
+}
+
+// negotiateContentType picks the offered media type which matches the Accept header best. If the header is empty,
+// the first offer is used. An empty string is returned if none of the offers is acceptable.
+func negotiateContentType(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		if quality > 0 {
+			ranges = append(ranges, mediaRange{mediaType: mediaType, quality: quality})
+		}
+	}
+
+	// Prefer ranges with higher quality, more specific ones first among equals
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].quality != ranges[j].quality {
+			return ranges[i].quality > ranges[j].quality
+		}
+
+		return strings.Count(ranges[i].mediaType, "*") < strings.Count(ranges[j].mediaType, "*")
+	})
+
+	for _, r := range ranges {
+		for _, offer := range offers {
+			if mediaTypeMatches(r.mediaType, offer) {
+				return offer
+			}
+		}
+	}
+
+	return ""
+}
+
+func mediaTypeMatches(mediaRange, offer string) bool {
+	if mediaRange == "*/*" || mediaRange == offer {
+		return true
+	}
+
+	prefix, ok := strings.CutSuffix(mediaRange, "/*")
+
+	return ok && strings.HasPrefix(offer, prefix+"/")
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// queryParser reads the listing query parameters. It collects the invalid ones, so all of them are reported in one
+// error response.
+type queryParser struct {
+	values        url.Values
+	version       string
+	invalidParams []InvalidParam
+}
+
+func newQueryParser(request *http.Request) *queryParser {
+	return &queryParser{values: request.URL.Query(), version: apiVersion(request.Context())}
+}
+
+func (qp *queryParser) invalid(name, reason string) {
+	qp.invalidParams = append(qp.invalidParams, InvalidParam{Name: name, Reason: reason})
+}
+
+// writeError writes the error response if there were invalid parameters and reports whether it did.
+func (qp *queryParser) writeError(response http.ResponseWriter, request *http.Request) bool {
+	if len(qp.invalidParams) == 0 {
+		return false
+	}
+
+	e := apiError{
+		status:        http.StatusBadRequest,
+		code:          ErrorCodeValidationFailed,
+		detail:        "one or more query parameters are invalid",
+		invalidParams: qp.invalidParams,
+	}
+	for _, param := range qp.invalidParams {
+		e.messages = append(e.messages, fmt.Sprintf("%s: %s", param.Name, param.Reason))
+	}
+
+	writeError(response, request, e)
+
+	return true
+}
+
+func (qp *queryParser) string(name string) string {
+	return qp.values.Get(name)
+}
+
+// limit returns the page size, defaultPageLimit if it is not set. v0 listings returned everything before they were
+// paginated, so they still do unless the client asks for a limit.
+func (qp *queryParser) limit() int {
+	raw := qp.values.Get("limit")
+	if raw == "" && qp.version == apiV0 {
+		return 0
+	}
+	if raw == "" {
+		return defaultPageLimit
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		qp.invalid("limit", fmt.Sprintf("must be a number between 1 and %d", maxPageLimit))
+
+		return 0
+	}
+
+	return limit
+}
+
+// algorithm returns the algorithm if it is one of the supported ones.
+func (qp *queryParser) algorithm(name string, supported []domain.Algorithm) domain.Algorithm {
+	raw := qp.values.Get(name)
+	if raw == "" {
+		return ""
+	}
+
+	algorithm := domain.Algorithm(raw)
+	if !slices.Contains(supported, algorithm) {
+		qp.invalid(name, fmt.Sprintf("must be one of: %s", joinAlgorithms(supported)))
+
+		return ""
+	}
+
+	return algorithm
+}
+
+func (qp *queryParser) uint64(name string) *uint64 {
+	raw := qp.values.Get(name)
+	if raw == "" {
+		return nil
+	}
+
+	value, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		qp.invalid(name, "must be a non-negative number")
+
+		return nil
+	}
+
+	return &value
+}
+
+func (qp *queryParser) time(name string) time.Time {
+	raw := qp.values.Get(name)
+	if raw == "" {
+		return time.Time{}
+	}
+
+	value, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		qp.invalid(name, "must be an RFC 3339 timestamp")
+
+		return time.Time{}
+	}
+
+	return value
+}
+
+// deviceCursor decodes the cursor returned by encodeDeviceCursor.
+func (qp *queryParser) deviceCursor(name string) *domain.DeviceCursor {
+	raw := qp.values.Get(name)
+	if raw == "" {
+		return nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		qp.invalid(name, "is not a valid cursor")
+
+		return nil
+	}
+
+	nanos, id, ok := strings.Cut(string(decoded), ".")
+	if !ok {
+		qp.invalid(name, "is not a valid cursor")
+
+		return nil
+	}
+
+	createdAt, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		qp.invalid(name, "is not a valid cursor")
+
+		return nil
+	}
+
+	deviceID, err := uuid.Parse(id)
+	if err != nil {
+		qp.invalid(name, "is not a valid cursor")
+
+		return nil
+	}
+
+	return &domain.DeviceCursor{CreatedAt: time.Unix(0, createdAt).UTC(), ID: deviceID}
+}
+
+// signatureCursor decodes the cursor returned by encodeSignatureCursor.
+func (qp *queryParser) signatureCursor(name string) *uint64 {
+	raw := qp.values.Get(name)
+	if raw == "" {
+		return nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		qp.invalid(name, "is not a valid cursor")
+
+		return nil
+	}
+
+	counter, err := strconv.ParseUint(string(decoded), 10, 64)
+	if err != nil {
+		qp.invalid(name, "is not a valid cursor")
+
+		return nil
+	}
+
+	return &counter
+}
+
+// encodeDeviceCursor returns the opaque cursor clients pass as the after parameter to get the next page.
+func encodeDeviceCursor(cursor *domain.DeviceCursor) *string {
+	if cursor == nil {
+		return nil
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d.%s", cursor.CreatedAt.UnixNano(), cursor.ID)),
+	)
+
+	return &encoded
+}
+
+// encodeSignatureCursor returns the opaque cursor clients pass as the after parameter to get the next page.
+func encodeSignatureCursor(counter *uint64) *string {
+	if counter == nil {
+		return nil
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(*counter, 10)))
+
+	return &encoded
+}
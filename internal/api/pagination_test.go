@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryParser_Limit(t *testing.T) {
+	tests := []struct {
+		version string
+		query   string
+		limit   int
+		invalid bool
+	}{
+		{version: apiV0, query: "", limit: 0},
+		{version: apiV0, query: "?limit=10", limit: 10},
+		{version: apiV0, query: "?limit=1001", invalid: true},
+		{version: apiV1, query: "", limit: defaultPageLimit},
+		{version: apiV1, query: "?limit=10", limit: 10},
+		{version: apiV1, query: "?limit=0", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version+tt.query, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/"+tt.version+"/devices"+tt.query, nil)
+			request = request.WithContext(context.WithValue(request.Context(), apiVersionKey{}, tt.version))
+
+			qp := newQueryParser(request)
+			limit := qp.limit()
+
+			assert.Equal(t, tt.invalid, len(qp.invalidParams) > 0)
+			if !tt.invalid {
+				assert.Equal(t, tt.limit, limit)
+			}
+		})
+	}
+}
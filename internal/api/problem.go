@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const contentTypeProblem = "application/problem+json"
+
+// problemTypeBase is the base of the problem type URIs. Type URIs are relative to the API host and identify the
+// problem type by the error code.
+const problemTypeBase = "/problems/"
+
+// Problem is the RFC 7807 problem details error response, used by the API starting with v1.
+type Problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty"`
+	Code          string         `json:"code"`
+	InvalidParams []InvalidParam `json:"invalid_params,omitempty"`
+}
+
+// InvalidParam describes a request field which failed validation.
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+var problemTitles = map[string]string{
+	ErrorCodeInvalidRequest:    "Malformed request body",
+	ErrorCodeValidationFailed:  "Request validation failed",
+	ErrorCodeInvalidID:         "Malformed device ID",
+	ErrorCodeInvalidCounter:    "Malformed signature counter",
+	ErrorCodeNotAcceptable:     "Requested content type is not supported",
+	ErrorCodeUnsupportedMedia:  "Request content type is not supported",
+	ErrorCodeDeviceNotFound:    "Device not found",
+	ErrorCodeSignatureNotFound: "Signature not found",
+	ErrorCodeKeyNotFound:       "Device key not found",
+	ErrorCodeInvalidAlgorithm:  "Unsupported algorithm",
+	ErrorCodeInvalidKeyParams:  "Key parameters are not supported or not allowed",
+	ErrorCodeInvalidImport:     "Device can not be imported",
+	ErrorCodeDeviceInactive:    "Device is not active",
+	ErrorCodeConflict:          "Request conflicts with the device state",
+	ErrorCodeIdempotencyKey:    "Malformed idempotency key",
+	ErrorCodeIdempotencyReused: "Idempotency key was used with different data",
+	ErrorCodeBatchTooLarge:     "Batch has too many transactions",
+	ErrorCodeInternal:          "Internal server error",
+}
+
+// NewProblem creates a problem of the type identified by the error code.
+func NewProblem(status int, code string, detail string) Problem {
+	title, ok := problemTitles[code]
+	if !ok {
+		title = http.StatusText(status)
+	}
+
+	return Problem{
+		Type:   problemTypeBase + code,
+		Title:  title,
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// WriteProblem writes the problem as an application/problem+json HTTP error response.
+func WriteProblem(w http.ResponseWriter, problem Problem) {
+	bytes, err := json.MarshalIndent(problem, "", "  ")
+	if err != nil {
+		WriteInternalError(w)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeProblem)
+	w.WriteHeader(problem.Status)
+	w.Write(bytes) // nolint:errcheck
+}
+
+const (
+	apiV0 = "v0"
+	apiV1 = "v1"
+)
+
+type apiVersionKey struct{}
+
+// withAPIVersion stores the API version the handler is registered for in the request context. The version decides
+// the format of the error responses.
+func withAPIVersion(version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	})
+}
+
+// apiVersion returns the API version of the request, v0 if it is unknown.
+func apiVersion(ctx context.Context) string {
+	if version, ok := ctx.Value(apiVersionKey{}).(string); ok {
+		return version
+	}
+
+	return apiV0
+}
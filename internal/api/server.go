@@ -9,17 +9,33 @@ import (
 	"github.com/gren236/fiskaly-go-challenge/internal/domain"
 	"go.uber.org/zap"
 	"net/http"
+	"slices"
+	"strings"
 )
 
 type DeviceService interface {
-	CreateDevice(ctx context.Context, label *string, algorithm domain.Algorithm) (domain.Device, error)
+	CreateDevice(ctx context.Context, label *string, algorithm domain.Algorithm, params domain.KeyParams) (domain.Device, error)
 	GetDevices(ctx context.Context) ([]domain.Device, error)
+	QueryDevices(ctx context.Context, query domain.DeviceQuery) (domain.DevicePage, error)
 	GetDevice(ctx context.Context, id uuid.UUID) (domain.Device, error)
+	ChangeStatus(ctx context.Context, id uuid.UUID, status domain.Status) (domain.Device, error)
+	RotateKey(ctx context.Context, id uuid.UUID, algorithm domain.Algorithm, params domain.KeyParams) (domain.Device, error)
+	ImportDevice(ctx context.Context, imp domain.DeviceImport) (domain.Device, error)
 }
 
 type SignatureService interface {
 	SignTransaction(ctx context.Context, deviceID uuid.UUID, data string) (domain.SignedData, error)
-	GetSignatures(ctx context.Context, deviceID uuid.UUID) ([]domain.SignedData, error)
+	SignTransactionIdempotent(ctx context.Context, deviceID uuid.UUID, data, idempotencyKey string) (domain.SignedData, bool, error)
+	SignTransactions(ctx context.Context, deviceID uuid.UUID, data []string, mode domain.BatchMode) ([]domain.BatchResult, error)
+	QuerySignatures(ctx context.Context, deviceID uuid.UUID, query domain.SignatureQuery) (domain.SignaturePage, error)
+	GetSignature(ctx context.Context, deviceID uuid.UUID, counter uint64) (domain.SignedData, error)
+	VerifySignature(ctx context.Context, deviceID uuid.UUID, signature, signedData string) (bool, error)
+	AuditChain(ctx context.Context, deviceID uuid.UUID) (domain.ChainAudit, error)
+}
+
+type PublicKeyEncoder interface {
+	EncodePEM(kp domain.KeyPair) ([]byte, error)
+	EncodeJWK(kp domain.KeyPair, params domain.KeyParams) (domain.JWK, error)
 }
 
 // Response is the generic API response container.
@@ -27,14 +43,25 @@ type Response struct {
 	Data interface{} `json:"data"`
 }
 
+// PageResponse is the API response container for paginated listings.
+type PageResponse struct {
+	Data interface{} `json:"data"`
+	Next *string     `json:"next"` // cursor of the next page, null on the last page
+}
+
 // ErrorResponse is the generic error API response container.
 type ErrorResponse struct {
+	Code   string   `json:"code"`
 	Errors []string `json:"errors"`
 }
 
 type Config struct {
 	Host string
 	Port int
+
+	MaxBatchSize int // maximum number of transactions signed in one batch
+
+	Algorithms []domain.Algorithm // algorithms devices can be created with
 }
 
 // Server manages HTTP requests and dispatches them to the appropriate services.
@@ -45,6 +72,7 @@ type Server struct {
 
 	deviceService    DeviceService
 	signatureService SignatureService
+	keyEncoder       PublicKeyEncoder
 }
 
 // NewServer is a factory to instantiate a new Server.
@@ -54,28 +82,43 @@ func NewServer(
 	validate *validator.Validate,
 	deviceSvc DeviceService,
 	signatureSvc SignatureService,
+	keyEncoder PublicKeyEncoder,
 ) *Server {
-	return &Server{
+	s := &Server{
 		logger:           logger,
 		config:           config,
 		validate:         validate,
 		deviceService:    deviceSvc,
 		signatureService: signatureSvc,
+		keyEncoder:       keyEncoder,
+	}
+
+	// The supported algorithms are only known at runtime, so they can not be listed in a oneof tag
+	validate.RegisterValidation("algorithm", func(fl validator.FieldLevel) bool { // nolint:errcheck
+		return slices.Contains(config.Algorithms, domain.Algorithm(fl.Field().String()))
+	})
+
+	return s
+}
+
+// joinAlgorithms lists the algorithms for error messages.
+func joinAlgorithms(algorithms []domain.Algorithm) string {
+	names := make([]string, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		names = append(names, algorithm.String())
 	}
+
+	return strings.Join(names, ", ")
 }
 
 // GetHttpServer returns a new HTTP server instance with all routes registered.
 func (s *Server) GetHttpServer() *http.Server {
 	mux := http.NewServeMux()
 
-	mux.Handle("GET /api/v0/health", http.HandlerFunc(s.Health))
-
-	mux.Handle("POST /api/v0/devices", http.HandlerFunc(s.CreateDevice))
-	mux.Handle("GET /api/v0/devices", http.HandlerFunc(s.GetDevices))
-	mux.Handle("GET /api/v0/devices/{id}", http.HandlerFunc(s.GetDevice))
-
-	mux.Handle("POST /api/v0/devices/{id}/signatures", http.HandlerFunc(s.SignTransaction))
-	mux.Handle("GET /api/v0/devices/{id}/signatures", http.HandlerFunc(s.GetSignatures))
+	// v0 keeps the original error format, v1 returns RFC 7807 problem details. Otherwise the versions are the same.
+	for _, version := range []string{apiV0, apiV1} {
+		s.registerRoutes(mux, version)
+	}
 
 	// Add middleware
 	logMiddleware := LoggingMiddleware(s.logger)
@@ -89,18 +132,47 @@ func (s *Server) GetHttpServer() *http.Server {
 	}
 }
 
+// registerRoutes registers all API routes under the /api/{version} prefix.
+func (s *Server) registerRoutes(mux *http.ServeMux, version string) {
+	handle := func(method, path string, handler http.HandlerFunc) {
+		mux.Handle(fmt.Sprintf("%s /api/%s%s", method, version, path), withAPIVersion(version, handler))
+	}
+
+	handle("GET", "/health", s.Health)
+	handle("GET", "/.well-known/jwks.json", s.GetJWKS)
+
+	handle("POST", "/devices", s.CreateDevice)
+	handle("GET", "/devices", s.GetDevices)
+	handle("POST", "/devices:import", s.ImportDevice)
+	handle("GET", "/devices/{id}", s.GetDevice)
+	handle("PATCH", "/devices/{id}", s.UpdateDevice)
+	handle("POST", "/devices/{id}/decommission", s.DecommissionDevice)
+	handle("POST", "/devices/{id}/rotate-key", s.RotateKey)
+	handle("GET", "/devices/{id}/public-key", s.GetPublicKey)
+
+	handle("POST", "/devices/{id}/signatures", s.SignTransaction)
+	handle("POST", "/devices/{id}/signatures:batch", s.SignTransactions)
+	handle("POST", "/devices/{id}/signatures:stream", s.SignTransactionStream)
+	handle("GET", "/devices/{id}/signatures", s.GetSignatures)
+	handle("GET", "/devices/{id}/signatures/{counter}", s.GetSignature)
+	handle("POST", "/devices/{id}/signatures/verify", s.VerifySignature)
+	handle("GET", "/devices/{id}/audit", s.AuditChain)
+}
+
 // WriteInternalError writes a default internal error message as an HTTP response.
 func WriteInternalError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write([]byte(http.StatusText(http.StatusInternalServerError))) // nolint:errcheck
 }
 
-// WriteErrorResponse takes an HTTP status code and a slice of errors
-// and writes those as an HTTP error response in a structured format.
-func WriteErrorResponse(w http.ResponseWriter, code int, errors []string) {
-	w.WriteHeader(code)
+// WriteErrorResponse takes an HTTP status code, an error code and a slice of errors
+// and writes those as an HTTP error response in a structured format. It is the error format of the v0 API,
+// newer versions use WriteProblem.
+func WriteErrorResponse(w http.ResponseWriter, status int, code string, errors []string) {
+	w.WriteHeader(status)
 
 	errorResponse := ErrorResponse{
+		Code:   code,
 		Errors: errors,
 	}
 
@@ -128,3 +200,21 @@ func WriteAPIResponse(w http.ResponseWriter, code int, data interface{}) {
 
 	w.Write(bytes) // nolint:errcheck
 }
+
+// WritePageResponse takes an HTTP status code, a page of data and the cursor of the next page
+// and writes those as an HTTP response in a structured format.
+func WritePageResponse(w http.ResponseWriter, code int, data interface{}, next *string) {
+	w.WriteHeader(code)
+
+	response := PageResponse{
+		Data: data,
+		Next: next,
+	}
+
+	bytes, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		WriteInternalError(w)
+	}
+
+	w.Write(bytes) // nolint:errcheck
+}
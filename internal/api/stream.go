@@ -0,0 +1,124 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"mime"
+	"net/http"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+
+	maxStreamLineSize = 1 << 20
+)
+
+// SignTransactionStream signs a stream of NDJSON lines, each one a SignTransactionRequest, as they arrive and streams
+// a BatchResultResponse line back for every one of them. Every line is signed in its own transaction, so the device
+// is not locked for the whole stream. Reading stops when the client disconnects.
+func (s *Server) SignTransactionStream(response http.ResponseWriter, request *http.Request) {
+	id, ok := parseDeviceID(response, request)
+	if !ok {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != contentTypeNDJSON {
+		WriteError(response, request, http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMedia,
+			fmt.Sprintf("request body must be %s", contentTypeNDJSON),
+		)
+
+		return
+	}
+
+	// Fail before streaming if the device does not exist, afterwards errors can only be reported per line
+	_, err = s.deviceService.GetDevice(request.Context(), id)
+	if err != nil {
+		WriteDomainError(response, request, err)
+
+		return
+	}
+
+	// A client which sends "Expect: 100-continue" waits for the server to read the body first. Once the response is
+	// written, the body could not be read anymore, so it is peeked before. Errors are left for the scanner.
+	body := bufio.NewReader(request.Body)
+	body.Peek(1) // nolint:errcheck
+
+	// Results are written while the request body is still read. Writers which do not support it, like the HTTP/2
+	// one, do it anyway.
+	controller := http.NewResponseController(response)
+	controller.EnableFullDuplex() // nolint:errcheck
+
+	response.Header().Set("Content-Type", contentTypeNDJSON)
+	response.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(response)
+	write := func(result BatchResultResponse) bool {
+		if err := encoder.Encode(result); err != nil {
+			return false
+		}
+
+		return controller.Flush() == nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+
+	index := 0
+	for scanner.Scan() {
+		if request.Context().Err() != nil {
+			return
+		}
+
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if !write(s.signStreamLine(request, id, index, line)) {
+			return
+		}
+
+		index++
+	}
+
+	// The body can not be read anymore if the client is gone, there is no one to report it to
+	if err := scanner.Err(); err != nil && request.Context().Err() == nil {
+		message := err.Error()
+		if errors.Is(err, bufio.ErrTooLong) {
+			message = fmt.Sprintf("line is longer than %d bytes", maxStreamLineSize)
+		}
+
+		write(BatchResultResponse{
+			Index: index,
+			Error: &BatchErrorResponse{Code: ErrorCodeInvalidRequest, Message: message},
+		})
+	}
+}
+
+// signStreamLine decodes, validates and signs a single line of the stream.
+func (s *Server) signStreamLine(request *http.Request, id uuid.UUID, index int, line []byte) BatchResultResponse {
+	var req SignTransactionRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		return BatchResultResponse{
+			Index: index,
+			Error: &BatchErrorResponse{Code: ErrorCodeInvalidRequest, Message: decodeErrorMessage(err)},
+		}
+	}
+
+	if err := s.validate.Struct(req); err != nil {
+		return BatchResultResponse{
+			Index: index,
+			Error: &BatchErrorResponse{Code: ErrorCodeValidationFailed, Message: s.validationErrorMessage(&req, err)},
+		}
+	}
+
+	signature, err := s.signatureService.SignTransaction(request.Context(), id, req.Data)
+
+	return BatchResultToApi(request, index, domain.BatchResult{Signature: &signature, Err: err})
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// MockDeviceService implements only the methods used by the tests, the others panic.
+type MockDeviceService struct {
+	DeviceService
+	mock.Mock
+}
+
+func (m *MockDeviceService) GetDevice(ctx context.Context, id uuid.UUID) (domain.Device, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(domain.Device), args.Error(1)
+}
+
+func (m *MockDeviceService) GetDevices(ctx context.Context) ([]domain.Device, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]domain.Device), args.Error(1)
+}
+
+// MockSignatureService implements only the methods used by the tests, the others panic.
+type MockSignatureService struct {
+	SignatureService
+	mock.Mock
+}
+
+func (m *MockSignatureService) SignTransaction(ctx context.Context, deviceID uuid.UUID, data string) (domain.SignedData, error) {
+	args := m.Called(ctx, deviceID, data)
+	return args.Get(0).(domain.SignedData), args.Error(1)
+}
+
+func newStreamRequest(ctx context.Context, deviceID uuid.UUID, body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/api/v0/devices/"+deviceID.String()+"/signatures:stream",
+		strings.NewReader(body))
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", contentTypeNDJSON)
+	request.SetPathValue("id", deviceID.String())
+
+	return request
+}
+
+func readStreamResults(t *testing.T, body string) []BatchResultResponse {
+	var results []BatchResultResponse
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		var result BatchResultResponse
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func TestSignTransactionStream(t *testing.T) {
+	deviceID := uuid.New()
+	deviceSvc := new(MockDeviceService)
+	signatureSvc := new(MockSignatureService)
+	s := &Server{
+		validate:         validator.New(validator.WithRequiredStructEnabled()),
+		deviceService:    deviceSvc,
+		signatureService: signatureSvc,
+	}
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(domain.Device{ID: deviceID}, nil)
+	signatureSvc.On("SignTransaction", mock.Anything, deviceID, "first").
+		Return(domain.SignedData{DeviceID: deviceID, Counter: 0, Signature: "sig-0"}, nil)
+	signatureSvc.On("SignTransaction", mock.Anything, deviceID, "second").
+		Return(domain.SignedData{}, &domain.DeviceInactiveError{ID: deviceID, Status: domain.StatusDeactivated})
+
+	body := `{"data": "first"}` + "\n\n" + `{"data": ` + "\n" + `{"data": ""}` + "\n" + `{"data": "second"}` + "\n"
+	recorder := httptest.NewRecorder()
+	s.SignTransactionStream(recorder, newStreamRequest(context.Background(), deviceID, body))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, contentTypeNDJSON, recorder.Header().Get("Content-Type"))
+
+	results := readStreamResults(t, recorder.Body.String())
+	require.Len(t, results, 4)
+	assert.Equal(t, "sig-0", results[0].Signature.Signature)
+	assert.Equal(t, ErrorCodeInvalidRequest, results[1].Error.Code)
+	assert.Equal(t, ErrorCodeValidationFailed, results[2].Error.Code)
+	assert.Equal(t, "data: is required", results[2].Error.Message)
+	assert.Equal(t, ErrorCodeDeviceInactive, results[3].Error.Code)
+	assert.Equal(t, 3, results[3].Index)
+}
+
+func TestSignTransactionStream_Disconnect(t *testing.T) {
+	deviceID := uuid.New()
+	deviceSvc := new(MockDeviceService)
+	signatureSvc := new(MockSignatureService)
+	s := &Server{
+		validate:         validator.New(validator.WithRequiredStructEnabled()),
+		deviceService:    deviceSvc,
+		signatureService: signatureSvc,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(domain.Device{ID: deviceID}, nil)
+	signatureSvc.On("SignTransaction", mock.Anything, deviceID, "first").
+		Run(func(mock.Arguments) { cancel() }).
+		Return(domain.SignedData{DeviceID: deviceID}, nil)
+
+	body := `{"data": "first"}` + "\n" + `{"data": "second"}` + "\n"
+	recorder := httptest.NewRecorder()
+	s.SignTransactionStream(recorder, newStreamRequest(ctx, deviceID, body))
+
+	signatureSvc.AssertNumberOfCalls(t, "SignTransaction", 1)
+	assert.Len(t, readStreamResults(t, recorder.Body.String()), 1)
+}
+
+func TestSignTransactionStream_UnsupportedMediaType(t *testing.T) {
+	deviceID := uuid.New()
+	s := &Server{}
+
+	request := newStreamRequest(context.Background(), deviceID, `{"data": "first"}`)
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	s.SignTransactionStream(recorder, request)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+}
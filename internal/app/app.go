@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
 	"github.com/gren236/fiskaly-go-challenge/internal/api"
 	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
 	"github.com/gren236/fiskaly-go-challenge/internal/domain"
@@ -14,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
 )
@@ -35,19 +37,39 @@ func Run(ctx context.Context, envGetter func(string) string, logger *zap.Sugared
 	logger.Infow("parsed config", "config", conf)
 
 	// Set up crypto services
-	keyGenerator := crypto.NewGenerator()
-	signerCreator := crypto.NewSignerCreator()
-	kpMarshaler := crypto.NewMarshaler()
+	keys, closeKeys, err := newKeyBackend(conf, logger)
+	if err != nil {
+		return err
+	}
+	defer closeKeys()
 
 	// Set up persistence
-	inMemory := persistence.NewInMemory(kpMarshaler)
+	store, closeStore, err := newPersister(ctx, conf, keys.marshaler, keys.signerCreator)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
 
 	// Set up services
-	deviceService := domain.NewDeviceService(logger, inMemory, keyGenerator)
-	signatureService := domain.NewSignatureService(logger, deviceService, signerCreator, inMemory)
+	deviceService := domain.NewDeviceService(logger, store, keys.generator, conf.KeyPolicy())
+	signatureService := domain.NewSignatureService(
+		logger, deviceService, keys.signerCreator, keys.verifierCreator, store, conf.IdempotencyRetention,
+	)
 
 	// Set up the server. I've extended the server setup so we could gracefully shutdown it with context cancellation.
-	server := api.NewServer(logger, api.Config{Host: conf.ApiHost, Port: conf.ApiPort}, validate, deviceService, signatureService)
+	server := api.NewServer(
+		logger,
+		api.Config{
+			Host:         conf.ApiHost,
+			Port:         conf.ApiPort,
+			MaxBatchSize: conf.MaxBatchSize,
+			Algorithms:   keys.algorithms,
+		},
+		validate,
+		deviceService,
+		signatureService,
+		keys.encoder,
+	)
 
 	logger.Info("built all dependencies")
 
@@ -87,6 +109,110 @@ func Run(ctx context.Context, envGetter func(string) string, logger *zap.Sugared
 	return nil
 }
 
+// persister is implemented by every storage driver.
+type persister interface {
+	domain.DevicePersister
+	domain.SignaturePersister
+
+	RewriteDeviceKeys(
+		ctx context.Context, id uuid.UUID, rewrite func(deviceID uuid.UUID, version int, privateKey []byte) ([]byte, error),
+	) (int, error)
+}
+
+// newPersister creates the persistence layer chosen in the config. The forgetters are told when the keys of a device
+// change. The returned function releases its resources.
+func newPersister(
+	ctx context.Context, conf Config, kpMarshaler persistence.KeyPairMarshaler, forgetters ...persistence.KeyForgetter,
+) (persister, func(), error) {
+	switch conf.StorageDriver {
+	case StorageDriverSQLite:
+		sqlite, err := persistence.NewSQLite(ctx, conf.SQLitePath, kpMarshaler, conf.KeyCacheSize, forgetters...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to set up sqlite storage: %w", err)
+		}
+
+		return sqlite, func() { sqlite.Close() }, nil // nolint:errcheck
+	case StorageDriverInMemory:
+		return persistence.NewInMemory(kpMarshaler, conf.KeyCacheSize, forgetters...), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported storage driver: %s", conf.StorageDriver)
+	}
+}
+
+// keyBackend holds the services which work with the device keys.
+type keyBackend struct {
+	generator       domain.KeyPairGenerator
+	signerCreator   *crypto.CachingSignerCreator
+	verifierCreator domain.VerifierCreator
+	marshaler       persistence.KeyPairMarshaler
+	encoder         api.PublicKeyEncoder
+	algorithms      []domain.Algorithm
+}
+
+// newKeyBackend creates the services for the key backend chosen in the config. The returned function releases its
+// resources.
+func newKeyBackend(conf Config, logger *zap.SugaredLogger) (keyBackend, func(), error) {
+	switch conf.KeyBackend {
+	case KeyBackendSoftware:
+		kpMarshaler, err := newKeyPairMarshaler(conf, logger)
+		if err != nil {
+			return keyBackend{}, nil, err
+		}
+
+		return keyBackend{
+			generator:       crypto.NewGenerator(),
+			signerCreator:   crypto.NewCachingSignerCreator(crypto.NewSignerCreator(), conf.KeyCacheSize),
+			verifierCreator: crypto.NewVerifierCreator(),
+			marshaler:       kpMarshaler,
+			encoder:         crypto.NewPublicKeyEncoder(),
+			algorithms:      crypto.Algorithms(),
+		}, func() {}, nil
+	case KeyBackendPKCS11:
+		return newPKCS11Backend(conf, logger)
+	default:
+		return keyBackend{}, nil, fmt.Errorf("unsupported key backend: %s", conf.KeyBackend)
+	}
+}
+
+// newKeyPairMarshaler creates the marshaler the device keys are stored with. The private keys are encrypted if a
+// key-encryption key is configured.
+func newKeyPairMarshaler(conf Config, logger *zap.SugaredLogger) (persistence.KeyPairMarshaler, error) {
+	keks, err := loadKEKs(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keks) == 0 {
+		logger.Warn("no key-encryption key is configured, device private keys are stored unencrypted")
+
+		return crypto.NewMarshaler(), nil
+	}
+
+	envelope, err := crypto.NewEnvelopeMarshaler(crypto.NewMarshaler(), keks)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infow("device private keys are encrypted", "kek", envelope.CurrentKEK())
+
+	return envelope, nil
+}
+
+// loadKEKs returns the configured key-encryption keys, the current one first.
+func loadKEKs(conf Config) ([]crypto.KEK, error) {
+	encoded := conf.KEK
+	if conf.KEKFile != "" {
+		content, err := os.ReadFile(conf.KEKFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key-encryption key file: %w", err)
+		}
+
+		encoded = strings.Fields(string(content))
+	}
+
+	return crypto.ParseKEKs(encoded)
+}
+
 func ParseConfig(conf any, getenv func(string) string, validate *validator.Validate) error {
 	err := config.NewEnv(getenv).Set(conf)
 	if err != nil {
@@ -1,13 +1,88 @@
 package app
 
+import (
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"time"
+)
+
+const (
+	StorageDriverInMemory = "inmemory"
+	StorageDriverSQLite   = "sqlite"
+
+	KeyBackendSoftware = "software"
+	KeyBackendPKCS11   = "pkcs11"
+)
+
 type Config struct {
 	ApiHost string `env:"API_HOST" validate:"required,ip4_addr"`
 	ApiPort int    `env:"API_PORT" validate:"gte=0,lte=65535"`
+
+	// MaxBatchSize is the maximum number of transactions signed in one batch request
+	MaxBatchSize int `env:"MAX_BATCH_SIZE" validate:"gt=0"`
+
+	StorageDriver string `env:"STORAGE_DRIVER" validate:"required,oneof=inmemory sqlite"`
+	SQLitePath    string `env:"SQLITE_PATH" validate:"required_if=StorageDriver sqlite"`
+
+	// Key parameters devices can use, on top of the ones the algorithms support
+	KeyMinRSABits int      `env:"KEY_MIN_RSA_BITS" validate:"gte=0"`
+	KeyCurves     []string `env:"KEY_CURVES" validate:"dive,oneof=P-256 P-384 P-521"`
+	KeyHashes     []string `env:"KEY_HASHES" validate:"dive,oneof=SHA-256 SHA-384 SHA-512"`
+
+	// KeyCacheSize is the number of decoded key pairs and signers kept in memory, 0 turns the caches off
+	KeyCacheSize int `env:"KEY_CACHE_SIZE" validate:"gte=0"`
+
+	// KeyBackend is where the device private keys are kept: in the storage with the software backend, or in an HSM
+	// with the pkcs11 backend, which needs the service to be built with the pkcs11 tag
+	KeyBackend string `env:"KEY_BACKEND" validate:"required,oneof=software pkcs11"`
+
+	// Key-encryption keys the device private keys are encrypted with, base64 encoded, either given directly or in a
+	// file with one key per line. The first key encrypts new keys, the others are kept to read the keys encrypted
+	// before a rotation. With the pkcs11 backend they decrypt the keys of the devices created with the software
+	// backend. The keys are not logged.
+	KEK     []string `env:"KEK" json:"-" validate:"dive,base64"`
+	KEKFile string   `env:"KEK_FILE" validate:"excluded_with=KEK"`
+
+	// PKCS #11 library and token the device keys are kept in with the pkcs11 backend, and the number of sessions
+	// opened with it, which limits how many signatures are created at once. The PIN is not logged.
+	PKCS11Module   string `env:"PKCS11_MODULE" validate:"required_if=KeyBackend pkcs11"`
+	PKCS11Token    string `env:"PKCS11_TOKEN" validate:"required_if=KeyBackend pkcs11"`
+	PKCS11PIN      string `env:"PKCS11_PIN" json:"-"`
+	PKCS11Sessions int    `env:"PKCS11_SESSIONS" validate:"gt=0"`
+
+	// IdempotencyRetention is how long the idempotency keys sent when signing are remembered
+	IdempotencyRetention time.Duration `env:"IDEMPOTENCY_RETENTION" validate:"gt=0"`
 }
 
 func NewConfig() Config {
 	return Config{
-		ApiHost: "0.0.0.0",
-		ApiPort: 8080,
+		ApiHost:       "0.0.0.0",
+		ApiPort:       8080,
+		MaxBatchSize:  1000,
+		StorageDriver: StorageDriverInMemory,
+		SQLitePath:    "signatures.db",
+
+		KeyMinRSABits: 2048,
+		KeyCurves:     []string{"P-256", "P-384", "P-521"},
+		KeyHashes:     []string{"SHA-256", "SHA-384", "SHA-512"},
+		KeyCacheSize:  1024,
+
+		KeyBackend:     KeyBackendSoftware,
+		PKCS11Sessions: 8,
+
+		IdempotencyRetention: 24 * time.Hour,
+	}
+}
+
+// KeyPolicy returns the limits for the key parameters of the devices.
+func (c Config) KeyPolicy() domain.KeyPolicy {
+	policy := domain.KeyPolicy{MinRSABits: c.KeyMinRSABits}
+
+	for _, curve := range c.KeyCurves {
+		policy.Curves = append(policy.Curves, domain.Curve(curve))
 	}
+	for _, hash := range c.KeyHashes {
+		policy.Hashes = append(policy.Hashes, domain.Hash(hash))
+	}
+
+	return policy
 }
@@ -0,0 +1,42 @@
+//go:build pkcs11
+
+package app
+
+import (
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto/hsm"
+	"go.uber.org/zap"
+)
+
+// newPKCS11Backend creates the services which keep the device keys in the configured PKCS #11 token. The keys of the
+// devices created with the software backend are read with the marshaler they were stored with.
+func newPKCS11Backend(conf Config, logger *zap.SugaredLogger) (keyBackend, func(), error) {
+	kpMarshaler, err := newKeyPairMarshaler(conf, logger)
+	if err != nil {
+		return keyBackend{}, nil, err
+	}
+
+	token, err := hsm.OpenToken(hsm.Config{
+		Module:     conf.PKCS11Module,
+		TokenLabel: conf.PKCS11Token,
+		PIN:        conf.PKCS11PIN,
+		Sessions:   conf.PKCS11Sessions,
+	})
+	if err != nil {
+		return keyBackend{}, nil, fmt.Errorf("failed to open PKCS #11 token: %w", err)
+	}
+
+	logger.Infow("device keys are kept in the HSM", "token", conf.PKCS11Token)
+
+	backend := hsm.NewBackend(token, kpMarshaler)
+
+	return keyBackend{
+		generator:       backend,
+		signerCreator:   crypto.NewCachingSignerCreator(backend, conf.KeyCacheSize),
+		verifierCreator: backend,
+		marshaler:       backend,
+		encoder:         backend,
+		algorithms:      backend.Algorithms(),
+	}, token.Close, nil
+}
@@ -0,0 +1,13 @@
+//go:build !pkcs11
+
+package app
+
+import (
+	"errors"
+	"go.uber.org/zap"
+)
+
+// newPKCS11Backend fails, the service is built without the PKCS #11 backend, which needs cgo.
+func newPKCS11Backend(Config, *zap.SugaredLogger) (keyBackend, func(), error) {
+	return keyBackend{}, nil, errors.New("the service is built without PKCS #11 support, build it with the pkcs11 tag")
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"go.uber.org/zap"
+)
+
+// rotationPageSize is the number of devices read at once while rotating the key-encryption key.
+const rotationPageSize = 100
+
+// RotateKEK wraps the private keys of all devices with the current key-encryption key, the first configured one. The
+// keys they were wrapped with before have to be configured as well, and can be removed once it is done. Keys which
+// are not encrypted yet are encrypted, keys kept in an HSM are left as they are. Every device is changed in a
+// transaction of its own, so the service can keep running, and an interrupted rotation can be run again.
+func RotateKEK(ctx context.Context, envGetter func(string) string, logger *zap.SugaredLogger) error {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+
+	conf := NewConfig()
+	err := ParseConfig(&conf, envGetter, validate)
+	if err != nil {
+		return err
+	}
+
+	if conf.StorageDriver == StorageDriverInMemory {
+		return errors.New("the in-memory storage keeps no keys to rotate")
+	}
+
+	keks, err := loadKEKs(conf)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := crypto.NewEnvelopeMarshaler(crypto.NewMarshaler(), keks)
+	if err != nil {
+		return fmt.Errorf("failed to set up key encryption: %w", err)
+	}
+
+	store, closeStore, err := newPersister(ctx, conf, envelope)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	var devices, keys int
+
+	query := domain.DeviceQuery{Limit: rotationPageSize}
+	for {
+		page, err := store.QueryDevices(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to query devices: %w", err)
+		}
+
+		for _, device := range page.Devices {
+			changed, err := store.RewriteDeviceKeys(ctx, device.ID, envelope.Rewrap)
+			if err != nil {
+				return fmt.Errorf("failed to rewrap keys of device %s: %w", device.ID, err)
+			}
+
+			devices++
+			keys += changed
+		}
+
+		if page.Next == nil {
+			break
+		}
+
+		query.After = page.Next
+	}
+
+	logger.Infow("rotated key-encryption key", "kek", envelope.CurrentKEK(), "devices", devices, "keys", keys)
+
+	return nil
+}
@@ -1,9 +1,11 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/ecdsa"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/base64"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
 )
 
 // ECCKeyPair is a DTO that holds ECC private and public keys.
@@ -14,6 +16,10 @@ type ECCKeyPair struct {
 
 func (ECCKeyPair) IsKeyPair() {}
 
+func (ECCKeyPair) Algorithm() domain.Algorithm {
+	return domain.AlgorithmECC
+}
+
 // ECCMarshaler can encode and decode an ECC key pair.
 type ECCMarshaler struct{}
 
@@ -22,42 +28,146 @@ func NewECCMarshaler() *ECCMarshaler {
 	return &ECCMarshaler{}
 }
 
-// Marshal takes an ECCKeyPair and encodes it to be written on disk.
-// It returns the public and the private key as a byte slice.
+// Marshal takes an ECCKeyPair and encodes it to be written on disk, the private key as PKCS #8 and the public key
+// as PKIX. It returns the public and the private key as a byte slice.
 func (m ECCMarshaler) Marshal(keyPair ECCKeyPair) ([]byte, []byte, error) {
-	privateKeyBytes, err := x509.MarshalECPrivateKey(keyPair.Private)
+	return encodeKeyPair(keyPair.Private, keyPair.Public)
+}
+
+// Unmarshal assembles an ECCKeyPair from an encoded private key, either PKCS #8 or SEC 1.
+func (m ECCMarshaler) Unmarshal(privateKeyBytes []byte) (*ECCKeyPair, error) {
+	key, err := decodePrivateKey(privateKeyBytes)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	privateKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not an ECC key", key)
+	}
+
+	return &ECCKeyPair{
+		Private: privateKey,
+		Public:  &privateKey.PublicKey,
+	}, nil
+}
+
+// eccAlgorithm registers the ECDSA key pairs.
+type eccAlgorithm struct{}
+
+func (eccAlgorithm) KeyParams(requested domain.KeyParams) (domain.KeyParams, error) {
+	if requested.RSABits != 0 || requested.Padding != "" || requested.SaltLength != 0 {
+		return domain.KeyParams{}, fmt.Errorf("%w: ECC keys have no RSA parameters", domain.ErrInvalidKeyParams)
 	}
 
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(keyPair.Public)
+	params := domain.KeyParams{Curve: requested.Curve, Hash: requested.Hash}
+	if params.Curve == "" {
+		params.Curve = defaultCurve
+	}
+
+	if _, err := ellipticCurve(params.Curve); err != nil {
+		return domain.KeyParams{}, err
+	}
+
+	if params.Hash == "" {
+		params.Hash = curveHashes[params.Curve]
+	}
+
+	if _, err := hashFunction(params.Hash); err != nil {
+		return domain.KeyParams{}, err
+	}
+
+	return params, nil
+}
+
+func (eccAlgorithm) GenerateKeyPair(params domain.KeyParams) (domain.KeyPair, error) {
+	curve, err := ellipticCurve(params.Curve)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&ECCGenerator{}).Generate(curve)
+}
+
+func (eccAlgorithm) Marshal(kp domain.KeyPair) ([]byte, []byte, error) {
+	keyPair, err := asKeyPair[*ECCKeyPair](kp)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	encodedPrivate := pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE_KEY",
-		Bytes: privateKeyBytes,
-	})
+	return NewECCMarshaler().Marshal(*keyPair)
+}
 
-	encodedPublic := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC_KEY",
-		Bytes: publicKeyBytes,
-	})
+func (eccAlgorithm) Unmarshal(privateKeyBytes []byte) (domain.KeyPair, error) {
+	return NewECCMarshaler().Unmarshal(privateKeyBytes)
+}
 
-	return encodedPublic, encodedPrivate, nil
+func (eccAlgorithm) CreateSigner(kp domain.KeyPair, params domain.KeyParams) (domain.Signer, error) {
+	keyPair, err := asKeyPair[*ECCKeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashFunction(params.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECCSigner{private: keyPair.Private, hash: hash}, nil
 }
 
-// Unmarshal assembles an ECCKeyPair from an encoded private key.
-func (m ECCMarshaler) Unmarshal(privateKeyBytes []byte) (*ECCKeyPair, error) {
-	block, _ := pem.Decode(privateKeyBytes)
-	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+func (eccAlgorithm) CreateVerifier(kp domain.KeyPair, params domain.KeyParams) (domain.Verifier, error) {
+	keyPair, err := asKeyPair[*ECCKeyPair](kp)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ECCKeyPair{
-		Private: privateKey,
-		Public:  &privateKey.PublicKey,
+	hash, err := hashFunction(params.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECCVerifier{public: keyPair.Public, hash: hash}, nil
+}
+
+func (eccAlgorithm) PublicKey(kp domain.KeyPair) (crypto.PublicKey, error) {
+	keyPair, err := asKeyPair[*ECCKeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyPair.Public, nil
+}
+
+func (eccAlgorithm) EncodeJWK(kp domain.KeyPair, params domain.KeyParams) (domain.JWK, error) {
+	keyPair, err := asKeyPair[*ECCKeyPair](kp)
+	if err != nil {
+		return domain.JWK{}, err
+	}
+
+	hash, err := hashFunction(params.Hash)
+	if err != nil {
+		return domain.JWK{}, err
+	}
+
+	curve := keyPair.Public.Curve.Params()
+	size := (curve.BitSize + 7) / 8
+
+	return domain.JWK{
+		KeyType:   "EC",
+		Algorithm: ecdsaJWA(domain.Curve(curve.Name), hash),
+		Curve:     curve.Name,
+		X:         base64.RawURLEncoding.EncodeToString(keyPair.Public.X.FillBytes(make([]byte, size))),
+		Y:         base64.RawURLEncoding.EncodeToString(keyPair.Public.Y.FillBytes(make([]byte, size))),
 	}, nil
 }
+
+// ecdsaJWA returns the JSON Web Algorithm name for ECDSA signatures on the given curve with the given hash. JWA only
+// names the curves combined with the hash of the same strength, for the other combinations it returns "".
+func ecdsaJWA(curve domain.Curve, hash crypto.Hash) string {
+	if hashFunctions[curveHashes[curve]] != hash {
+		return ""
+	}
+
+	return fmt.Sprintf("ES%d", hash.Size()*8)
+}
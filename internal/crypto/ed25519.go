@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+)
+
+// ED25519KeyPair is a DTO that holds Ed25519 private and public keys.
+type ED25519KeyPair struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+func (ED25519KeyPair) IsKeyPair() {}
+
+func (ED25519KeyPair) Algorithm() domain.Algorithm {
+	return domain.AlgorithmED25519
+}
+
+// ED25519Generator generates an Ed25519 key pair.
+type ED25519Generator struct{}
+
+// Generate generates a new ED25519KeyPair.
+func (g *ED25519Generator) Generate() (*ED25519KeyPair, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ED25519KeyPair{
+		Public:  public,
+		Private: private,
+	}, nil
+}
+
+// ED25519Marshaler can encode and decode an Ed25519 key pair.
+type ED25519Marshaler struct{}
+
+// NewED25519Marshaler creates a new ED25519Marshaler.
+func NewED25519Marshaler() *ED25519Marshaler {
+	return &ED25519Marshaler{}
+}
+
+// Marshal takes an ED25519KeyPair and encodes it to be written on disk, the private key as PKCS #8 and the public
+// key as PKIX. It returns the public and the private key as a byte slice.
+func (m *ED25519Marshaler) Marshal(keyPair ED25519KeyPair) ([]byte, []byte, error) {
+	return encodeKeyPair(keyPair.Private, keyPair.Public)
+}
+
+// Unmarshal assembles an ED25519KeyPair from a PKCS #8 encoded private key.
+func (m *ED25519Marshaler) Unmarshal(privateKeyBytes []byte) (*ED25519KeyPair, error) {
+	key, err := decodePrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not an Ed25519 key", key)
+	}
+
+	return &ED25519KeyPair{
+		Private: privateKey,
+		Public:  privateKey.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+// ED25519Signer is a signer implementation for Ed25519 key pairs. Ed25519 hashes the message itself, so unlike the
+// other signers it signs the data directly.
+type ED25519Signer struct {
+	keyPair ED25519KeyPair
+}
+
+func (es *ED25519Signer) Sign(dataToBeSigned []byte) ([]byte, error) {
+	return ed25519.Sign(es.keyPair.Private, dataToBeSigned), nil
+}
+
+// ED25519Verifier is a verifier implementation for signatures created by ED25519Signer.
+type ED25519Verifier struct {
+	public ed25519.PublicKey
+}
+
+func (ev *ED25519Verifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	return ed25519.Verify(ev.public, signedData, signature), nil
+}
+
+// ed25519Algorithm registers the Ed25519 key pairs.
+type ed25519Algorithm struct{}
+
+func (ed25519Algorithm) KeyParams(requested domain.KeyParams) (domain.KeyParams, error) {
+	if requested != (domain.KeyParams{}) {
+		return domain.KeyParams{}, fmt.Errorf("%w: Ed25519 keys have no parameters", domain.ErrInvalidKeyParams)
+	}
+
+	return domain.KeyParams{}, nil
+}
+
+func (ed25519Algorithm) GenerateKeyPair(domain.KeyParams) (domain.KeyPair, error) {
+	return (&ED25519Generator{}).Generate()
+}
+
+func (ed25519Algorithm) Marshal(kp domain.KeyPair) ([]byte, []byte, error) {
+	keyPair, err := asKeyPair[*ED25519KeyPair](kp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewED25519Marshaler().Marshal(*keyPair)
+}
+
+func (ed25519Algorithm) Unmarshal(privateKeyBytes []byte) (domain.KeyPair, error) {
+	return NewED25519Marshaler().Unmarshal(privateKeyBytes)
+}
+
+func (ed25519Algorithm) CreateSigner(kp domain.KeyPair, _ domain.KeyParams) (domain.Signer, error) {
+	keyPair, err := asKeyPair[*ED25519KeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ED25519Signer{keyPair: *keyPair}, nil
+}
+
+func (ed25519Algorithm) CreateVerifier(kp domain.KeyPair, _ domain.KeyParams) (domain.Verifier, error) {
+	keyPair, err := asKeyPair[*ED25519KeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ED25519Verifier{public: keyPair.Public}, nil
+}
+
+func (ed25519Algorithm) PublicKey(kp domain.KeyPair) (crypto.PublicKey, error) {
+	keyPair, err := asKeyPair[*ED25519KeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyPair.Public, nil
+}
+
+// EncodeJWK encodes the public key as an octet key pair (RFC 8037).
+func (ed25519Algorithm) EncodeJWK(kp domain.KeyPair, _ domain.KeyParams) (domain.JWK, error) {
+	keyPair, err := asKeyPair[*ED25519KeyPair](kp)
+	if err != nil {
+		return domain.JWK{}, err
+	}
+
+	return domain.JWK{
+		KeyType:   "OKP",
+		Algorithm: "EdDSA",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(keyPair.Public),
+	}, nil
+}
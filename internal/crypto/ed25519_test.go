@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestED25519Signer_Deterministic(t *testing.T) {
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmED25519, domain.KeyParams{})
+	require.NoError(t, err)
+
+	signer, err := NewSignerCreator().CreateSigner(uuid.New(), domain.DeviceKey{KeyPair: kp})
+	require.NoError(t, err)
+
+	first, err := signer.Sign([]byte("data"))
+	require.NoError(t, err)
+	second, err := signer.Sign([]byte("data"))
+	require.NoError(t, err)
+
+	require.Equal(t, first, second)
+	require.Len(t, first, ed25519.SignatureSize)
+
+	// The message is signed as it is, without hashing it first
+	require.True(t, ed25519.Verify(kp.(*ED25519KeyPair).Public, []byte("data"), first))
+}
+
+func TestED25519Algorithm_EncodeJWK(t *testing.T) {
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmED25519, domain.KeyParams{})
+	require.NoError(t, err)
+
+	jwk, err := NewPublicKeyEncoder().EncodeJWK(kp, domain.KeyParams{})
+	require.NoError(t, err)
+
+	require.Equal(t, "OKP", jwk.KeyType)
+	require.Equal(t, "EdDSA", jwk.Algorithm)
+	require.Equal(t, "Ed25519", jwk.Curve)
+
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	require.NoError(t, err)
+	require.Equal(t, []byte(kp.(*ED25519KeyPair).Public), x)
+}
+
+func TestED25519Marshaler_Unmarshal(t *testing.T) {
+	_, err := NewED25519Marshaler().Unmarshal([]byte("not a pem"))
+	require.Error(t, err)
+
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmECC, domain.KeyParams{Curve: domain.CurveP256})
+	require.NoError(t, err)
+
+	_, private, err := NewMarshaler().Marshal(uuid.Nil, 1, kp)
+	require.NoError(t, err)
+
+	_, err = NewED25519Marshaler().Unmarshal(private)
+	require.Error(t, err)
+}
@@ -0,0 +1,332 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+)
+
+const (
+	kekSize = 32 // AES-256
+	dekSize = 32
+
+	// wrappedKeyType is the PEM block type of an encrypted private key. The headers hold the ID of the key-encryption
+	// key, the data key wrapped with it and the device key the private key belongs to, the block itself the private
+	// key encrypted with the data key.
+	wrappedKeyType      = "WRAPPED PRIVATE KEY"
+	kekIDHeader         = "Kek-Id"
+	wrappedDEKHeader    = "Wrapped-Dek"
+	deviceKeyHeader     = "Device-Key"
+	kekIDFingerprintLen = 8
+)
+
+// KEK is a key-encryption key. It encrypts the data keys the private keys of the devices are encrypted with, so
+// replacing it only takes to encrypt the data keys again.
+type KEK struct {
+	// ID is derived from the key, so the same key always has the same ID
+	ID string
+
+	aead cipher.AEAD
+}
+
+// NewKEK creates a KEK from a 256-bit AES key.
+func NewKEK(key []byte) (KEK, error) {
+	if len(key) != kekSize {
+		return KEK{}, fmt.Errorf("key-encryption key must be %d bytes long, not %d", kekSize, len(key))
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return KEK{}, err
+	}
+
+	fingerprint := sha256.Sum256(key)
+
+	return KEK{ID: hex.EncodeToString(fingerprint[:kekIDFingerprintLen]), aead: aead}, nil
+}
+
+// ParseKEKs creates the KEKs from base64 encoded keys.
+func ParseKEKs(encoded []string) ([]KEK, error) {
+	keks := make([]KEK, 0, len(encoded))
+	for i, e := range encoded {
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key-encryption key %d: %w", i+1, err)
+		}
+
+		kek, err := NewKEK(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key-encryption key %d: %w", i+1, err)
+		}
+
+		keks = append(keks, kek)
+	}
+
+	return keks, nil
+}
+
+// EnvelopeMarshaler encrypts the private keys the Marshaler encodes. Every private key is encrypted with AES-GCM under
+// a data key of its own, which is wrapped with the current KEK and stored next to it, with the ID of the KEK. The ID
+// and the version of the device key are authenticated with the private key, so it can not be passed off as the key of
+// another device or version.
+//
+// Keys wrapped with an earlier KEK can be read as long as the KEK is known, and private keys stored before the
+// encryption was turned on are read as they are. So are the keys wrapped before they were bound to their device key.
+// Rewrap moves all of them to the current KEK and binds them.
+type EnvelopeMarshaler struct {
+	marshaler *Marshaler
+	current   KEK
+	keks      map[string]KEK
+}
+
+// NewEnvelopeMarshaler creates an EnvelopeMarshaler which wraps new keys with the first KEK. The other KEKs are only
+// used to read the keys wrapped before.
+func NewEnvelopeMarshaler(marshaler *Marshaler, keks []KEK) (*EnvelopeMarshaler, error) {
+	if len(keks) == 0 {
+		return nil, errors.New("no key-encryption key is given")
+	}
+
+	m := &EnvelopeMarshaler{
+		marshaler: marshaler,
+		current:   keks[0],
+		keks:      make(map[string]KEK, len(keks)),
+	}
+
+	for _, kek := range keks {
+		if _, ok := m.keks[kek.ID]; ok {
+			return nil, fmt.Errorf("key-encryption key %s is given twice", kek.ID)
+		}
+
+		m.keks[kek.ID] = kek
+	}
+
+	return m, nil
+}
+
+// CurrentKEK returns the ID of the KEK new keys are wrapped with.
+func (m *EnvelopeMarshaler) CurrentKEK() string {
+	return m.current.ID
+}
+
+// Marshal encodes the key pair like the Marshaler and encrypts the private key for the device key with the given
+// version. The public key is not encrypted.
+func (m *EnvelopeMarshaler) Marshal(deviceID uuid.UUID, version int, pair domain.KeyPair) ([]byte, []byte, error) {
+	public, private, err := m.marshaler.Marshal(deviceID, version, pair)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := m.wrap(deviceKeyID(deviceID, version), private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return public, wrapped, nil
+}
+
+// Unmarshal decrypts the private key of the device key with the given version and decodes it like the Marshaler.
+func (m *EnvelopeMarshaler) Unmarshal(
+	deviceID uuid.UUID, version int, algo domain.Algorithm, privateKeyBytes []byte,
+) (domain.KeyPair, error) {
+	private, err := m.unwrap(deviceKeyID(deviceID, version), privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.marshaler.Unmarshal(deviceID, version, algo, private)
+}
+
+// Rewrap returns the private key of the device key with the given version wrapped with the current KEK. Only the data
+// key is wrapped again, a private key which is not encrypted or not bound to its device key yet is encrypted again. A
+// key which is already wrapped with the current KEK is returned as it is, and so is the reference to a key kept in a
+// token.
+func (m *EnvelopeMarshaler) Rewrap(deviceID uuid.UUID, version int, privateKeyBytes []byte) ([]byte, error) {
+	deviceKey := deviceKeyID(deviceID, version)
+
+	block, _ := pem.Decode(privateKeyBytes)
+	if block != nil && block.Type == TokenKeyType {
+		return privateKeyBytes, nil
+	}
+
+	if block == nil || block.Type != wrappedKeyType {
+		return m.wrap(deviceKey, privateKeyBytes)
+	}
+
+	if _, ok := block.Headers[deviceKeyHeader]; !ok {
+		private, err := m.unwrap(deviceKey, privateKeyBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return m.wrap(deviceKey, private)
+	}
+
+	if err := checkDeviceKey(block, deviceKey); err != nil {
+		return nil, err
+	}
+
+	if block.Headers[kekIDHeader] == m.current.ID {
+		return privateKeyBytes, nil
+	}
+
+	dek, err := m.unwrapDEK(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.encode(deviceKey, dek, block.Bytes)
+}
+
+// wrap encrypts the private key of the device key with a new data key, which is wrapped with the current KEK.
+func (m *EnvelopeMarshaler) wrap(deviceKey string, private []byte) ([]byte, error) {
+	dek := make([]byte, dekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := seal(dekAEAD, private, []byte(deviceKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt private key: %w", err)
+	}
+
+	return m.encode(deviceKey, dek, encrypted)
+}
+
+// encode wraps the data key with the current KEK and puts it next to the encrypted private key of the device key.
+func (m *EnvelopeMarshaler) encode(deviceKey string, dek, encrypted []byte) ([]byte, error) {
+	// The KEK ID is authenticated with the data key, so the header can not be changed to point to another KEK
+	wrappedDEK, err := seal(m.current.aead, dek, []byte(m.current.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: wrappedKeyType,
+		Headers: map[string]string{
+			kekIDHeader:      m.current.ID,
+			wrappedDEKHeader: base64.StdEncoding.EncodeToString(wrappedDEK),
+			deviceKeyHeader:  deviceKey,
+		},
+		Bytes: encrypted,
+	}), nil
+}
+
+// unwrap decrypts a wrapped private key of the device key. Private keys which are not wrapped are returned as they are.
+func (m *EnvelopeMarshaler) unwrap(deviceKey string, privateKeyBytes []byte) ([]byte, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil || block.Type != wrappedKeyType {
+		return privateKeyBytes, nil
+	}
+
+	// Keys wrapped before they were bound to their device key were encrypted without additional data
+	var additionalData []byte
+	if _, ok := block.Headers[deviceKeyHeader]; ok {
+		if err := checkDeviceKey(block, deviceKey); err != nil {
+			return nil, err
+		}
+
+		additionalData = []byte(deviceKey)
+	}
+
+	dek, err := m.unwrapDEK(block)
+	if err != nil {
+		return nil, err
+	}
+
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := open(dekAEAD, block.Bytes, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+
+	return private, nil
+}
+
+// unwrapDEK returns the data key of a wrapped private key.
+func (m *EnvelopeMarshaler) unwrapDEK(block *pem.Block) ([]byte, error) {
+	id := block.Headers[kekIDHeader]
+
+	kek, ok := m.keks[id]
+	if !ok {
+		return nil, fmt.Errorf("private key is wrapped with key-encryption key %q, which is not configured", id)
+	}
+
+	wrappedDEK, err := base64.StdEncoding.DecodeString(block.Headers[wrappedDEKHeader])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wrapped data key: %w", err)
+	}
+
+	dek, err := open(kek.aead, wrappedDEK, []byte(kek.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with key-encryption key %s: %w", kek.ID, err)
+	}
+
+	return dek, nil
+}
+
+// deviceKeyID identifies the device key a private key belongs to, it is authenticated with the encrypted private key.
+func deviceKeyID(deviceID uuid.UUID, version int) string {
+	return fmt.Sprintf("%s#%d", deviceID, version)
+}
+
+// checkDeviceKey returns an error if the wrapped private key belongs to another device key. The header is only checked
+// for a clear error, the private key can not be decrypted for another device key anyway.
+func checkDeviceKey(block *pem.Block, deviceKey string) error {
+	if bound := block.Headers[deviceKeyHeader]; bound != deviceKey {
+		return fmt.Errorf("private key belongs to device key %s, not %s", bound, deviceKey)
+	}
+
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return aead, nil
+}
+
+// seal encrypts the plaintext under a random nonce, which is put in front of the ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a ciphertext created by seal.
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
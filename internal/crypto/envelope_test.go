@@ -0,0 +1,262 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKEK(t *testing.T) KEK {
+	key := make([]byte, kekSize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	kek, err := NewKEK(key)
+	require.NoError(t, err)
+
+	return kek
+}
+
+func newTestEnvelope(t *testing.T, keks ...KEK) *EnvelopeMarshaler {
+	m, err := NewEnvelopeMarshaler(NewMarshaler(), keks)
+	require.NoError(t, err)
+
+	return m
+}
+
+// wrapUnbound wraps the private key like the marshaler did before the keys were bound to their device key.
+func wrapUnbound(t *testing.T, m *EnvelopeMarshaler, private []byte) []byte {
+	dek := make([]byte, dekSize)
+	_, err := rand.Read(dek)
+	require.NoError(t, err)
+
+	dekAEAD, err := newAEAD(dek)
+	require.NoError(t, err)
+
+	encrypted, err := seal(dekAEAD, private, nil)
+	require.NoError(t, err)
+
+	wrapped, err := m.encode("", dek, encrypted)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(wrapped)
+	delete(block.Headers, "Device-Key")
+
+	return pem.EncodeToMemory(block)
+}
+
+func TestEnvelopeMarshaler_RoundTrip(t *testing.T) {
+	kek := newTestKEK(t)
+	m := newTestEnvelope(t, kek)
+	deviceID := uuid.New()
+
+	for _, algorithm := range Algorithms() {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			kp, err := NewGenerator().GenerateKeyPair(algorithm, mustKeyParams(t, algorithm))
+			require.NoError(t, err)
+
+			public, wrapped, err := m.Marshal(deviceID, 1, kp)
+			require.NoError(t, err)
+
+			// The public key is left as it is, the private key is stored with the ID of the KEK and the device key
+			plainPublic, plainPrivate, err := NewMarshaler().Marshal(deviceID, 1, kp)
+			require.NoError(t, err)
+			require.Equal(t, plainPublic, public)
+
+			block, _ := pem.Decode(wrapped)
+			require.NotNil(t, block)
+			require.Equal(t, "WRAPPED PRIVATE KEY", block.Type)
+			require.Equal(t, kek.ID, block.Headers["Kek-Id"])
+			require.Equal(t, deviceID.String()+"#1", block.Headers["Device-Key"])
+
+			plainBlock, _ := pem.Decode(plainPrivate)
+			require.False(t, bytes.Contains(wrapped, plainBlock.Bytes))
+
+			unmarshaled, err := m.Unmarshal(deviceID, 1, algorithm, wrapped)
+			require.NoError(t, err)
+			require.Equal(t, kp, unmarshaled)
+
+			// The key can not be read as the key of another device or version
+			_, err = m.Unmarshal(uuid.New(), 1, algorithm, wrapped)
+			require.ErrorContains(t, err, "belongs to device key")
+
+			_, err = m.Unmarshal(deviceID, 2, algorithm, wrapped)
+			require.ErrorContains(t, err, "belongs to device key")
+
+			// Without the KEK the key can not be read
+			_, err = NewMarshaler().Unmarshal(deviceID, 1, algorithm, wrapped)
+			require.ErrorContains(t, err, "key-encryption key \""+kek.ID+"\", which is not configured")
+
+			_, err = newTestEnvelope(t, newTestKEK(t)).Unmarshal(deviceID, 1, algorithm, wrapped)
+			require.ErrorContains(t, err, "which is not configured")
+		})
+	}
+}
+
+func TestEnvelopeMarshaler_Tampered(t *testing.T) {
+	kek := newTestKEK(t)
+	m := newTestEnvelope(t, kek)
+
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmED25519, domain.KeyParams{})
+	require.NoError(t, err)
+
+	deviceID := uuid.New()
+	_, wrapped, err := m.Marshal(deviceID, 1, kp)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		tamper  func(block *pem.Block)
+		wantErr string
+	}{
+		{
+			name:    "encrypted key",
+			tamper:  func(block *pem.Block) { block.Bytes[len(block.Bytes)-1] ^= 1 },
+			wantErr: "failed to decrypt private key",
+		},
+		{
+			name:    "truncated key",
+			tamper:  func(block *pem.Block) { block.Bytes = block.Bytes[:4] },
+			wantErr: "failed to decrypt private key",
+		},
+		{
+			name: "wrapped data key",
+			tamper: func(block *pem.Block) {
+				dek, err := base64.StdEncoding.DecodeString(block.Headers["Wrapped-Dek"])
+				require.NoError(t, err)
+
+				dek[0] ^= 1
+				block.Headers["Wrapped-Dek"] = base64.StdEncoding.EncodeToString(dek)
+			},
+			wantErr: "failed to unwrap data key",
+		},
+		{
+			name:    "data key encoding",
+			tamper:  func(block *pem.Block) { block.Headers["Wrapped-Dek"] = "not base64!" },
+			wantErr: "failed to decode wrapped data key",
+		},
+		{
+			name:    "device key",
+			tamper:  func(block *pem.Block) { block.Headers["Device-Key"] = uuid.NewString() + "#1" },
+			wantErr: "belongs to device key",
+		},
+		{
+			// The key was encrypted with the device key, it can not be passed off as one wrapped before keys were bound
+			name:    "device key removed",
+			tamper:  func(block *pem.Block) { delete(block.Headers, "Device-Key") },
+			wantErr: "failed to decrypt private key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, _ := pem.Decode(wrapped)
+			tt.tamper(block)
+
+			_, err := m.Unmarshal(deviceID, 1, domain.AlgorithmED25519, pem.EncodeToMemory(block))
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestEnvelopeMarshaler_Rewrap(t *testing.T) {
+	oldKEK, newKEK := newTestKEK(t), newTestKEK(t)
+
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmECC, mustKeyParams(t, domain.AlgorithmECC))
+	require.NoError(t, err)
+
+	deviceID := uuid.New()
+
+	_, plain, err := NewMarshaler().Marshal(deviceID, 1, kp)
+	require.NoError(t, err)
+
+	_, wrapped, err := newTestEnvelope(t, oldKEK).Marshal(deviceID, 1, kp)
+	require.NoError(t, err)
+
+	unbound := wrapUnbound(t, newTestEnvelope(t, oldKEK), plain)
+
+	// The new KEK is the current one, the old one is still known
+	m := newTestEnvelope(t, newKEK, oldKEK)
+
+	// Keys stored before the encryption was turned on or before they were bound to their device key are read as they
+	// are
+	for _, private := range [][]byte{plain, unbound} {
+		unmarshaled, err := m.Unmarshal(deviceID, 1, domain.AlgorithmECC, private)
+		require.NoError(t, err)
+		require.Equal(t, kp, unmarshaled)
+	}
+
+	for name, private := range map[string][]byte{"plain": plain, "old KEK": wrapped, "unbound": unbound} {
+		t.Run(name, func(t *testing.T) {
+			rewrapped, err := m.Rewrap(deviceID, 1, private)
+			require.NoError(t, err)
+
+			block, _ := pem.Decode(rewrapped)
+			require.Equal(t, newKEK.ID, block.Headers["Kek-Id"])
+			require.Equal(t, deviceID.String()+"#1", block.Headers["Device-Key"])
+
+			// The new KEK is enough to read the key now, as the key of its device only
+			unmarshaled, err := newTestEnvelope(t, newKEK).Unmarshal(deviceID, 1, domain.AlgorithmECC, rewrapped)
+			require.NoError(t, err)
+			require.Equal(t, kp, unmarshaled)
+
+			_, err = newTestEnvelope(t, newKEK).Unmarshal(deviceID, 2, domain.AlgorithmECC, rewrapped)
+			require.Error(t, err)
+
+			again, err := m.Rewrap(deviceID, 1, rewrapped)
+			require.NoError(t, err)
+			require.Equal(t, rewrapped, again)
+		})
+	}
+
+	// A key is not rewrapped for another device key
+	_, err = m.Rewrap(uuid.New(), 1, wrapped)
+	require.ErrorContains(t, err, "belongs to device key")
+
+	// Only the data key is wrapped again
+	rewrapped, err := m.Rewrap(deviceID, 1, wrapped)
+	require.NoError(t, err)
+
+	oldBlock, _ := pem.Decode(wrapped)
+	newBlock, _ := pem.Decode(rewrapped)
+	require.Equal(t, oldBlock.Bytes, newBlock.Bytes)
+	require.NotEqual(t, oldBlock.Headers["Wrapped-Dek"], newBlock.Headers["Wrapped-Dek"])
+
+	// References to keys kept in a token are left to the token
+	reference := pem.EncodeToMemory(&pem.Block{Type: TokenKeyType, Headers: map[string]string{"Key-Id": "00"}})
+	rewrapped, err = m.Rewrap(deviceID, 2, reference)
+	require.NoError(t, err)
+	require.Equal(t, reference, rewrapped)
+}
+
+func TestParseKEKs(t *testing.T) {
+	key := make([]byte, kekSize)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	keks, err := ParseKEKs([]string{encoded})
+	require.NoError(t, err)
+	require.Len(t, keks, 1)
+
+	// The ID only depends on the key
+	again, err := NewKEK(key)
+	require.NoError(t, err)
+	require.Equal(t, keks[0].ID, again.ID)
+	require.Len(t, again.ID, 16)
+
+	_, err = ParseKEKs([]string{encoded, "not base64!"})
+	require.ErrorContains(t, err, "key-encryption key 2")
+
+	_, err = ParseKEKs([]string{base64.StdEncoding.EncodeToString(key[:16])})
+	require.ErrorContains(t, err, "must be 32 bytes long")
+
+	_, err = NewEnvelopeMarshaler(NewMarshaler(), nil)
+	require.Error(t, err)
+
+	_, err = NewEnvelopeMarshaler(NewMarshaler(), []KEK{keks[0], again})
+	require.ErrorContains(t, err, "given twice")
+}
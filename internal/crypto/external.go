@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+)
+
+// TokenKeyType is the PEM block type stored for a private key kept in a hardware token. The block only refers to the
+// key, which never leaves the token.
+const TokenKeyType = "TOKEN PRIVATE KEY"
+
+// NewExternalSigner creates a signer for a private key the service does not hold itself, like a key in an HSM. The key
+// must sign digests like the keys of the standard library do: ECDSA signatures ASN.1 encoded, RSA signatures padded as
+// the options tell. The signatures are the same the signers of the in-process keys create.
+func NewExternalSigner(key crypto.Signer, params domain.KeyParams) (domain.Signer, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		opts, err := rsaSignerOpts(params)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RSASigner{private: key, opts: opts}, nil
+	case *ecdsa.PublicKey:
+		hash, err := hashFunction(params.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ECCSigner{private: key, hash: hash}, nil
+	default:
+		return nil, fmt.Errorf("unsupported external key type %T", key.Public())
+	}
+}
+
+// PublicKeyPair returns a key pair which only holds the public key, for a private key the service does not hold
+// itself. It can be used to verify signatures and be encoded for export, but not to sign.
+func PublicKeyPair(public crypto.PublicKey) (KeyPair, error) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return &RSAKeyPair{Public: public}, nil
+	case *ecdsa.PublicKey:
+		return &ECCKeyPair{Public: public}, nil
+	default:
+		return nil, fmt.Errorf("unsupported external key type %T", public)
+	}
+}
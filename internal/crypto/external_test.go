@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalSigner(t *testing.T) {
+	tests := []struct {
+		algorithm domain.Algorithm
+		params    domain.KeyParams
+	}{
+		{algorithm: domain.AlgorithmRSA},
+		{algorithm: domain.AlgorithmRSA, params: domain.KeyParams{Padding: domain.PaddingPSS}},
+		{algorithm: domain.AlgorithmECC},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.algorithm)+" "+string(tt.params.Padding), func(t *testing.T) {
+			params, err := NewGenerator().KeyParams(tt.algorithm, tt.params)
+			require.NoError(t, err)
+
+			kp, err := NewGenerator().GenerateKeyPair(tt.algorithm, params)
+			require.NoError(t, err)
+
+			// The in-process private keys sign like the ones kept outside
+			var private crypto.Signer
+			switch kp := kp.(type) {
+			case *RSAKeyPair:
+				private = kp.Private
+			case *ECCKeyPair:
+				private = kp.Private
+			}
+
+			external, err := NewExternalSigner(private, params)
+			require.NoError(t, err)
+
+			signature, err := external.Sign([]byte("data"))
+			require.NoError(t, err)
+
+			// Only the public key is needed to check the signature
+			public, err := PublicKeyPair(private.Public())
+			require.NoError(t, err)
+			require.Equal(t, tt.algorithm, public.Algorithm())
+
+			verifier, err := NewVerifierCreator().CreateVerifier(public, params)
+			require.NoError(t, err)
+
+			valid, err := verifier.Verify([]byte("data"), signature)
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			jwk, err := NewPublicKeyEncoder().EncodeJWK(public, params)
+			require.NoError(t, err)
+
+			expected, err := NewPublicKeyEncoder().EncodeJWK(kp, params)
+			require.NoError(t, err)
+			require.Equal(t, expected, jwk)
+		})
+	}
+
+	_, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	_, err = NewExternalSigner(private, domain.KeyParams{})
+	require.ErrorContains(t, err, "unsupported external key type")
+
+	_, err = PublicKeyPair(private.Public())
+	require.ErrorContains(t, err, "unsupported external key type")
+}
@@ -5,41 +5,76 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/pem"
 	"fmt"
 	"github.com/gren236/fiskaly-go-challenge/internal/domain"
 )
 
-type Generator struct {
-	rsa *RSAGenerator
-	ecc *ECCGenerator
-}
+// Generator generates key pairs with the registered algorithms.
+type Generator struct{}
 
 // NewGenerator creates a new Generator.
 func NewGenerator() *Generator {
-	return &Generator{
-		rsa: &RSAGenerator{},
-		ecc: &ECCGenerator{},
+	return &Generator{}
+}
+
+// KeyParams fills in the defaults of the algorithm for the parameters which are not requested.
+func (g *Generator) KeyParams(algorithm domain.Algorithm, requested domain.KeyParams) (domain.KeyParams, error) {
+	alg, err := lookup(algorithm)
+	if err != nil {
+		return domain.KeyParams{}, err
 	}
+
+	return alg.KeyParams(requested)
+}
+
+// GenerateKeyPair generates a key pair with the parameters returned by KeyParams.
+func (g *Generator) GenerateKeyPair(algorithm domain.Algorithm, params domain.KeyParams) (domain.KeyPair, error) {
+	alg, err := lookup(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return alg.GenerateKeyPair(params)
 }
 
-func (g *Generator) GenerateKeyPair(algorithm domain.Algorithm) (domain.KeyPair, error) {
-	switch algorithm {
-	case domain.AlgorithmECC:
-		return g.ecc.Generate()
-	case domain.AlgorithmRSA:
-		return g.rsa.Generate()
-	default:
-		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+// ImportKeyPair reads a private key of the algorithm created elsewhere with the marshaler of the algorithm. Besides the
+// PEM blocks the Marshaler reads, it takes DER encoded PKCS #8 keys. The key size and the curve are returned as they
+// are, they are not checked against the supported ones.
+func (g *Generator) ImportKeyPair(
+	algorithm domain.Algorithm, privateKey []byte,
+) (domain.KeyPair, domain.KeyParams, error) {
+	alg, err := lookup(algorithm)
+	if err != nil {
+		return nil, domain.KeyParams{}, err
+	}
+
+	if block, _ := pem.Decode(privateKey); block == nil {
+		privateKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey})
+	}
+
+	kp, err := alg.Unmarshal(privateKey)
+	if err != nil {
+		return nil, domain.KeyParams{}, fmt.Errorf("%w: %s", domain.ErrInvalidImport, err)
 	}
+
+	var params domain.KeyParams
+	switch kp := kp.(type) {
+	case *RSAKeyPair:
+		params.RSABits = kp.Public.N.BitLen()
+	case *ECCKeyPair:
+		params.Curve = domain.Curve(kp.Public.Curve.Params().Name)
+	}
+
+	return kp, params, nil
 }
 
 // RSAGenerator generates an RSA key pair.
 type RSAGenerator struct{}
 
-// Generate generates a new RSAKeyPair.
-func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := rsa.GenerateKey(rand.Reader, 512)
+// Generate generates a new RSAKeyPair with a modulus of the given size.
+func (g *RSAGenerator) Generate(bits int) (*RSAKeyPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return nil, err
 	}
@@ -53,10 +88,9 @@ func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
 // ECCGenerator generates an ECC key pair.
 type ECCGenerator struct{}
 
-// Generate generates a new ECCKeyPair.
-func (g *ECCGenerator) Generate() (*ECCKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+// Generate generates a new ECCKeyPair on the given curve.
+func (g *ECCGenerator) Generate(curve elliptic.Curve) (*ECCKeyPair, error) {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
@@ -66,3 +100,8 @@ func (g *ECCGenerator) Generate() (*ECCKeyPair, error) {
 		Private: key,
 	}, nil
 }
+
+// DiscardKeyPair does nothing, the key pairs are only kept in memory.
+func (g *Generator) DiscardKeyPair(domain.KeyPair) error {
+	return nil
+}
@@ -0,0 +1,456 @@
+//go:build pkcs11
+
+package hsm
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/gren236/fiskaly-go-challenge/internal/persistence"
+	"github.com/miekg/pkcs11"
+	"math/big"
+	"slices"
+)
+
+const (
+	keyIDSize = 16
+
+	// keyObjects is the most objects a key is kept in, the private and the public key
+	keyObjects = 2
+
+	// Headers of the PEM block stored for a key in the token, the block itself holds the public key
+	tokenHeader = "Token"
+	keyIDHeader = "Key-Id"
+)
+
+// rsaPublicExponent is the public exponent of the generated RSA keys, 65537.
+var rsaPublicExponent = []byte{0x01, 0x00, 0x01}
+
+// namedCurves are the curves the ECC keys can be generated on, with their object identifiers (RFC 5480).
+var namedCurves = map[domain.Curve]struct {
+	oid   asn1.ObjectIdentifier
+	curve elliptic.Curve
+	ecdh  ecdh.Curve
+}{
+	domain.CurveP256: {oid: asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}, curve: elliptic.P256(), ecdh: ecdh.P256()},
+	domain.CurveP384: {oid: asn1.ObjectIdentifier{1, 3, 132, 0, 34}, curve: elliptic.P384(), ecdh: ecdh.P384()},
+	domain.CurveP521: {oid: asn1.ObjectIdentifier{1, 3, 132, 0, 35}, curve: elliptic.P521(), ecdh: ecdh.P521()},
+}
+
+// Backend does everything the service does with the device keys with keys in the token. It generates them in the
+// token, stores references to them and signs with the token, while the public keys are used like the ones of the
+// in-process keys. Only RSA and ECC keys are supported.
+//
+// The keys of devices created with the software backend are still read, with the marshaler they were stored with, and
+// used as they are.
+type Backend struct {
+	token     *Token
+	generator *crypto.Generator
+	fallback  persistence.KeyPairMarshaler
+	signers   *crypto.SignerCreator
+	verifiers *crypto.VerifierCreator
+	encoder   *crypto.PublicKeyEncoder
+}
+
+// NewBackend creates a Backend which keeps the keys in the token. The private keys which are not kept in it are read
+// with the fallback, the marshaler of the software backend, which decrypts them if they are encrypted with a KEK.
+func NewBackend(token *Token, fallback persistence.KeyPairMarshaler) *Backend {
+	return &Backend{
+		token:     token,
+		generator: crypto.NewGenerator(),
+		fallback:  fallback,
+		signers:   crypto.NewSignerCreator(),
+		verifiers: crypto.NewVerifierCreator(),
+		encoder:   crypto.NewPublicKeyEncoder(),
+	}
+}
+
+// Algorithms returns the algorithms of the keys which can be kept in the token.
+func (b *Backend) Algorithms() []domain.Algorithm {
+	return []domain.Algorithm{domain.AlgorithmRSA, domain.AlgorithmECC}
+}
+
+// KeyParams fills in the defaults of the algorithm for the parameters which are not requested.
+func (b *Backend) KeyParams(algorithm domain.Algorithm, requested domain.KeyParams) (domain.KeyParams, error) {
+	if !slices.Contains(b.Algorithms(), algorithm) {
+		return domain.KeyParams{}, fmt.Errorf("%w: %s keys can not be kept in the HSM", domain.ErrInvalidAlgorithm, algorithm)
+	}
+
+	return b.generator.KeyParams(algorithm, requested)
+}
+
+// GenerateKeyPair generates a key pair in the token. The private key is marked sensitive and not extractable.
+func (b *Backend) GenerateKeyPair(algorithm domain.Algorithm, params domain.KeyParams) (domain.KeyPair, error) {
+	id, err := newKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mechanism uint
+		public    []*pkcs11.Attribute
+	)
+	switch algorithm {
+	case domain.AlgorithmRSA:
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, params.RSABits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, rsaPublicExponent),
+		}
+	case domain.AlgorithmECC:
+		curve, ok := namedCurves[params.Curve]
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported curve %s", domain.ErrInvalidKeyParams, params.Curve)
+		}
+
+		oid, err := asn1.Marshal(curve.oid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode curve: %w", err)
+		}
+
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oid),
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s keys can not be kept in the HSM", domain.ErrInvalidAlgorithm, algorithm)
+	}
+
+	public = append(public,
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, hex.EncodeToString(id)),
+	)
+	private := privateKeyAttributes(id)
+
+	keyPair := &KeyPair{ID: id, token: b.token}
+	err = b.token.withSession(func(session pkcs11.SessionHandle) error {
+		publicObject, privateObject, err := b.token.ctx.GenerateKeyPair(
+			session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, public, private,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to generate key pair in token: %w", err)
+		}
+
+		keyPair.object = privateObject
+
+		publicKey, err := b.readPublicKey(session, publicObject, algorithm, params)
+		if err != nil {
+			return err
+		}
+
+		keyPair.public, err = crypto.PublicKeyPair(publicKey)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keyPair, nil
+}
+
+// ImportKeyPair reads a private key created elsewhere like crypto.Generator does and creates it in the token, marked
+// sensitive and not extractable, so it is only used through the token from then on.
+func (b *Backend) ImportKeyPair(
+	algorithm domain.Algorithm, privateKey []byte,
+) (domain.KeyPair, domain.KeyParams, error) {
+	if !slices.Contains(b.Algorithms(), algorithm) {
+		return nil, domain.KeyParams{}, fmt.Errorf(
+			"%w: %s keys can not be kept in the HSM", domain.ErrInvalidAlgorithm, algorithm,
+		)
+	}
+
+	kp, params, err := b.generator.ImportKeyPair(algorithm, privateKey)
+	if err != nil {
+		return nil, domain.KeyParams{}, err
+	}
+
+	var (
+		publicKey  any
+		attributes []*pkcs11.Attribute
+	)
+	switch kp := kp.(type) {
+	case *crypto.RSAKeyPair:
+		key := kp.Private
+		if len(key.Primes) != 2 {
+			return nil, domain.KeyParams{}, fmt.Errorf("%w: multi-prime RSA keys are not supported", domain.ErrInvalidImport)
+		}
+
+		publicKey = kp.Public
+		attributes = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(key.E)).Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, key.D.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, key.Primes[0].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, key.Primes[1].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, key.Precomputed.Dp.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, key.Precomputed.Dq.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, key.Precomputed.Qinv.Bytes()),
+		}
+	case *crypto.ECCKeyPair:
+		curve, ok := namedCurves[params.Curve]
+		if !ok {
+			return nil, domain.KeyParams{}, fmt.Errorf("%w: unsupported curve %s", domain.ErrInvalidKeyParams, params.Curve)
+		}
+
+		oid, err := asn1.Marshal(curve.oid)
+		if err != nil {
+			return nil, domain.KeyParams{}, fmt.Errorf("failed to encode curve: %w", err)
+		}
+
+		publicKey = kp.Public
+		size := (curve.curve.Params().BitSize + 7) / 8
+		attributes = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oid),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, kp.Private.D.FillBytes(make([]byte, size))),
+		}
+	default:
+		return nil, domain.KeyParams{}, fmt.Errorf("unsupported key pair type %T", kp)
+	}
+
+	id, err := newKeyID()
+	if err != nil {
+		return nil, domain.KeyParams{}, err
+	}
+
+	public, err := crypto.PublicKeyPair(publicKey)
+	if err != nil {
+		return nil, domain.KeyParams{}, err
+	}
+
+	keyPair := &KeyPair{ID: id, public: public, token: b.token}
+	err = b.token.withSession(func(session pkcs11.SessionHandle) error {
+		keyPair.object, err = b.token.ctx.CreateObject(session, append(attributes, privateKeyAttributes(id)...))
+		if err != nil {
+			return fmt.Errorf("failed to create private key in token: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, domain.KeyParams{}, err
+	}
+
+	return keyPair, params, nil
+}
+
+// DiscardKeyPair destroys the objects of a key pair generated or imported in the token, which could not be stored.
+// Other key pairs are left as they are.
+func (b *Backend) DiscardKeyPair(kp domain.KeyPair) error {
+	keyPair, ok := kp.(*KeyPair)
+	if !ok {
+		return nil
+	}
+
+	return b.token.withSession(func(session pkcs11.SessionHandle) error {
+		// Generated key pairs have a public key object as well, both have the ID of the key
+		template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, keyPair.ID)}
+		if err := b.token.ctx.FindObjectsInit(session, template); err != nil {
+			return fmt.Errorf("failed to search key %x: %w", keyPair.ID, err)
+		}
+
+		objects, _, err := b.token.ctx.FindObjects(session, keyObjects)
+		finalErr := b.token.ctx.FindObjectsFinal(session)
+		if err != nil {
+			return fmt.Errorf("failed to search key %x: %w", keyPair.ID, err)
+		}
+		if finalErr != nil {
+			return fmt.Errorf("failed to search key %x: %w", keyPair.ID, finalErr)
+		}
+
+		for _, object := range objects {
+			if err := b.token.ctx.DestroyObject(session, object); err != nil {
+				return fmt.Errorf("failed to destroy key %x in token: %w", keyPair.ID, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// readPublicKey reads the public key of a generated key pair from the token.
+func (b *Backend) readPublicKey(
+	session pkcs11.SessionHandle, object pkcs11.ObjectHandle, algorithm domain.Algorithm, params domain.KeyParams,
+) (any, error) {
+	if algorithm == domain.AlgorithmRSA {
+		attributes, err := b.token.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", err)
+		}
+
+		exponent := new(big.Int).SetBytes(attributes[1].Value)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("unsupported public exponent %s", exponent)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(attributes[0].Value), E: int(exponent.Int64())}, nil
+	}
+
+	attributes, err := b.token.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	// The point should be DER encoded as an OCTET STRING, some tokens return it as it is
+	point := attributes[0].Value
+	var encoded []byte
+	if rest, err := asn1.Unmarshal(point, &encoded); err == nil && len(rest) == 0 {
+		point = encoded
+	}
+
+	curve := namedCurves[params.Curve]
+	if _, err := curve.ecdh.NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	size := (len(point) - 1) / 2
+
+	return &ecdsa.PublicKey{
+		Curve: curve.curve,
+		X:     new(big.Int).SetBytes(point[1 : 1+size]),
+		Y:     new(big.Int).SetBytes(point[1+size:]),
+	}, nil
+}
+
+// newKeyID returns a random ID for a key in the token.
+func newKeyID() ([]byte, error) {
+	id := make([]byte, keyIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate key ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// privateKeyAttributes are the attributes of the private keys in the token. They can only sign and never leave it.
+func privateKeyAttributes(id []byte) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, hex.EncodeToString(id)),
+	}
+}
+
+// Marshal encodes the key pair to be written on disk. The public key is encoded as PKIX, in place of the private key
+// a reference to it is stored, with the label of the token and the ID of the key.
+func (b *Backend) Marshal(_ uuid.UUID, _ int, kp domain.KeyPair) ([]byte, []byte, error) {
+	keyPair, ok := kp.(*KeyPair)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported key pair type %T", kp)
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(keyPair.Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+	private := pem.EncodeToMemory(&pem.Block{
+		Type: crypto.TokenKeyType,
+		Headers: map[string]string{
+			tokenHeader: b.token.Label(),
+			keyIDHeader: hex.EncodeToString(keyPair.ID),
+		},
+		Bytes: publicKeyBytes,
+	})
+
+	return public, private, nil
+}
+
+// Unmarshal assembles the key pair from the stored reference to the private key. The token is only asked for the
+// key when signing. Private keys which are not kept in a token are decoded by the fallback marshaler.
+func (b *Backend) Unmarshal(
+	deviceID uuid.UUID, version int, algo domain.Algorithm, privateKeyBytes []byte,
+) (domain.KeyPair, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil || block.Type != crypto.TokenKeyType {
+		return b.fallback.Unmarshal(deviceID, version, algo, privateKeyBytes)
+	}
+
+	if token := block.Headers[tokenHeader]; token != b.token.Label() {
+		return nil, fmt.Errorf("private key is kept in token %q, not in %q", token, b.token.Label())
+	}
+
+	id, err := hex.DecodeString(block.Headers[keyIDHeader])
+	if err != nil || len(id) == 0 {
+		return nil, fmt.Errorf("invalid key ID %q", block.Headers[keyIDHeader])
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	public, err := crypto.PublicKeyPair(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if public.Algorithm() != algo {
+		return nil, fmt.Errorf("key %x is an %s key, not %s", id, public.Algorithm(), algo)
+	}
+
+	return &KeyPair{ID: id, public: public, token: b.token}, nil
+}
+
+// CreateSigner creates a signer which signs with the private key in the token. Key pairs which are not kept in the
+// token sign like the ones of the software backend.
+func (b *Backend) CreateSigner(deviceID uuid.UUID, key domain.DeviceKey) (domain.Signer, error) {
+	keyPair, ok := key.KeyPair.(*KeyPair)
+	if !ok {
+		return b.signers.CreateSigner(deviceID, key)
+	}
+
+	return crypto.NewExternalSigner(keyPair, key.Params)
+}
+
+// CreateVerifier creates a verifier for the public key of the key pair.
+func (b *Backend) CreateVerifier(kp domain.KeyPair, params domain.KeyParams) (domain.Verifier, error) {
+	return b.verifiers.CreateVerifier(publicKeyPair(kp), params)
+}
+
+// EncodePEM encodes the public key as a PKIX "PUBLIC KEY" PEM block.
+func (b *Backend) EncodePEM(kp domain.KeyPair) ([]byte, error) {
+	return b.encoder.EncodePEM(publicKeyPair(kp))
+}
+
+// EncodeJWK encodes the public key as a JSON Web Key.
+func (b *Backend) EncodeJWK(kp domain.KeyPair, params domain.KeyParams) (domain.JWK, error) {
+	return b.encoder.EncodeJWK(publicKeyPair(kp), params)
+}
+
+// publicKeyPair returns the key pair with the public key of a key pair in the token, other key pairs are returned as
+// they are.
+func publicKeyPair(kp domain.KeyPair) domain.KeyPair {
+	if keyPair, ok := kp.(*KeyPair); ok {
+		return keyPair.public
+	}
+
+	return kp
+}
@@ -0,0 +1,446 @@
+//go:build pkcs11
+
+package hsm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/gren236/fiskaly-go-challenge/internal/persistence"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const (
+	testTokenLabel = "signature-service"
+	testPIN        = "1234"
+	testSOPIN      = "5678"
+)
+
+// softHSMModules are the paths the package managers install the SoftHSM2 library to.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// newTestToken initializes a token in a SoftHSM2 token directory of its own and opens it. The test is skipped if
+// SoftHSM2 is not installed, SOFTHSM2_MODULE can point to the library if it is not found.
+func newTestToken(t *testing.T) *Token {
+	t.Helper()
+
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		for _, path := range softHSMModules {
+			if _, err := os.Stat(path); err == nil {
+				module = path
+				break
+			}
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM2 is not installed, set SOFTHSM2_MODULE to the path of its library")
+	}
+
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	require.NoError(t, os.Mkdir(tokens, 0o700))
+
+	conf := filepath.Join(dir, "softhsm2.conf")
+	content := fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens)
+	require.NoError(t, os.WriteFile(conf, []byte(content), 0o600))
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	initTestToken(t, module)
+
+	token, err := OpenToken(Config{Module: module, TokenLabel: testTokenLabel, PIN: testPIN, Sessions: 4})
+	require.NoError(t, err)
+	t.Cleanup(token.Close)
+
+	return token
+}
+
+// initTestToken initializes the token in the free slot and sets the PIN of the user.
+func initTestToken(t *testing.T, module string) {
+	ctx := pkcs11.New(module)
+	require.NotNil(t, ctx)
+	defer ctx.Destroy()
+
+	require.NoError(t, ctx.Initialize())
+	defer ctx.Finalize() // nolint:errcheck
+
+	slots, err := ctx.GetSlotList(true)
+	require.NoError(t, err)
+	require.NotEmpty(t, slots)
+	require.NoError(t, ctx.InitToken(slots[0], testSOPIN, testTokenLabel))
+
+	// SoftHSM2 moves the token to another slot once it is initialized
+	token := &Token{label: testTokenLabel, ctx: ctx}
+	slot, err := token.findSlot()
+	require.NoError(t, err)
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	require.NoError(t, err)
+	defer ctx.CloseSession(session) // nolint:errcheck
+
+	require.NoError(t, ctx.Login(session, pkcs11.CKU_SO, testSOPIN))
+	require.NoError(t, ctx.InitPIN(session, testPIN))
+	require.NoError(t, ctx.Logout(session))
+}
+
+func TestBackend_SignAndVerify(t *testing.T) {
+	backend := NewBackend(newTestToken(t), crypto.NewMarshaler())
+
+	tests := []struct {
+		algorithm domain.Algorithm
+		params    domain.KeyParams
+	}{
+		{algorithm: domain.AlgorithmRSA},
+		{algorithm: domain.AlgorithmRSA, params: domain.KeyParams{Hash: domain.HashSHA512, Padding: domain.PaddingPSS}},
+		{algorithm: domain.AlgorithmRSA, params: domain.KeyParams{Padding: domain.PaddingPSS, SaltLength: 20}},
+		{algorithm: domain.AlgorithmECC, params: domain.KeyParams{Curve: domain.CurveP256}},
+		{algorithm: domain.AlgorithmECC, params: domain.KeyParams{Curve: domain.CurveP384}},
+		{algorithm: domain.AlgorithmECC, params: domain.KeyParams{Curve: domain.CurveP521, Hash: domain.HashSHA256}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %+v", tt.algorithm, tt.params), func(t *testing.T) {
+			params, err := backend.KeyParams(tt.algorithm, tt.params)
+			require.NoError(t, err)
+
+			kp, err := backend.GenerateKeyPair(tt.algorithm, params)
+			require.NoError(t, err)
+
+			public, private, err := backend.Marshal(uuid.Nil, 1, kp)
+			require.NoError(t, err)
+
+			// Only the public key and the reference to the private key are stored
+			exported, err := backend.EncodePEM(kp)
+			require.NoError(t, err)
+			require.Equal(t, exported, public)
+
+			block, _ := pem.Decode(private)
+			require.Equal(t, crypto.TokenKeyType, block.Type)
+			require.Equal(t, testTokenLabel, block.Headers["Token"])
+
+			publicBlock, _ := pem.Decode(public)
+			require.Equal(t, publicBlock.Bytes, block.Bytes)
+
+			// A key pair read back signs with the same key in the token
+			unmarshaled, err := backend.Unmarshal(uuid.Nil, 1, tt.algorithm, private)
+			require.NoError(t, err)
+
+			verifier, err := backend.CreateVerifier(kp, params)
+			require.NoError(t, err)
+
+			for _, keyPair := range []domain.KeyPair{kp, unmarshaled} {
+				signer, err := backend.CreateSigner(uuid.New(), domain.DeviceKey{KeyPair: keyPair, Params: params})
+				require.NoError(t, err)
+
+				signature, err := signer.Sign([]byte("data"))
+				require.NoError(t, err)
+
+				valid, err := verifier.Verify([]byte("data"), signature)
+				require.NoError(t, err)
+				require.True(t, valid)
+
+				valid, err = verifier.Verify([]byte("other data"), signature)
+				require.NoError(t, err)
+				require.False(t, valid)
+			}
+
+			// The signatures can be verified outside the service as well
+			jwk, err := backend.EncodeJWK(kp, params)
+			require.NoError(t, err)
+			require.NotEmpty(t, jwk.KeyType)
+		})
+	}
+}
+
+func TestBackend_PrivateKeyStaysInToken(t *testing.T) {
+	token := newTestToken(t)
+	backend := NewBackend(token, crypto.NewMarshaler())
+
+	kp, err := backend.GenerateKeyPair(domain.AlgorithmECC, domain.KeyParams{Curve: domain.CurveP256})
+	require.NoError(t, err)
+
+	err = token.withSession(func(session pkcs11.SessionHandle) error {
+		object, err := kp.(*KeyPair).privateKey(session)
+		require.NoError(t, err)
+
+		attributes, err := token.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []byte{1}, attributes[0].Value)
+		require.Equal(t, []byte{0}, attributes[1].Value)
+
+		_, err = token.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		require.ErrorIs(t, err, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_SENSITIVE))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBackend_ImportKeyPair(t *testing.T) {
+	backend := NewBackend(newTestToken(t), crypto.NewMarshaler())
+
+	tests := []struct {
+		algorithm domain.Algorithm
+		params    domain.KeyParams
+	}{
+		{algorithm: domain.AlgorithmRSA, params: domain.KeyParams{RSABits: 2048}},
+		{algorithm: domain.AlgorithmECC, params: domain.KeyParams{Curve: domain.CurveP256}},
+		{algorithm: domain.AlgorithmECC, params: domain.KeyParams{Curve: domain.CurveP521}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %+v", tt.algorithm, tt.params), func(t *testing.T) {
+			params, err := crypto.NewGenerator().KeyParams(tt.algorithm, tt.params)
+			require.NoError(t, err)
+
+			// The key was created outside the token
+			software, err := crypto.NewGenerator().GenerateKeyPair(tt.algorithm, params)
+			require.NoError(t, err)
+
+			_, privateKey, err := crypto.NewMarshaler().Marshal(uuid.Nil, 1, software)
+			require.NoError(t, err)
+
+			kp, importedParams, err := backend.ImportKeyPair(tt.algorithm, privateKey)
+			require.NoError(t, err)
+			require.Equal(t, params.RSABits, importedParams.RSABits)
+			require.Equal(t, params.Curve, importedParams.Curve)
+
+			// The token signs with the imported key
+			signer, err := backend.CreateSigner(uuid.New(), domain.DeviceKey{KeyPair: kp, Params: params})
+			require.NoError(t, err)
+
+			signature, err := signer.Sign([]byte("data"))
+			require.NoError(t, err)
+
+			verifier, err := crypto.NewVerifierCreator().CreateVerifier(software, params)
+			require.NoError(t, err)
+
+			valid, err := verifier.Verify([]byte("data"), signature)
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			// Only the reference to it is stored
+			_, private, err := backend.Marshal(uuid.Nil, 1, kp)
+			require.NoError(t, err)
+
+			block, _ := pem.Decode(private)
+			require.Equal(t, crypto.TokenKeyType, block.Type)
+		})
+	}
+
+	_, _, err := backend.ImportKeyPair(domain.AlgorithmED25519, []byte("key"))
+	require.ErrorIs(t, err, domain.ErrInvalidAlgorithm)
+}
+
+func TestBackend_Unmarshal(t *testing.T) {
+	backend := NewBackend(newTestToken(t), crypto.NewMarshaler())
+
+	kp, err := backend.GenerateKeyPair(domain.AlgorithmECC, domain.KeyParams{Curve: domain.CurveP256})
+	require.NoError(t, err)
+
+	_, private, err := backend.Marshal(uuid.Nil, 1, kp)
+	require.NoError(t, err)
+
+	_, err = backend.Unmarshal(uuid.Nil, 1, domain.AlgorithmRSA, private)
+	require.ErrorContains(t, err, "not RSA")
+
+	block, _ := pem.Decode(private)
+	block.Headers["Token"] = "other"
+	_, err = backend.Unmarshal(uuid.Nil, 1, domain.AlgorithmECC, pem.EncodeToMemory(block))
+	require.ErrorContains(t, err, `kept in token "other"`)
+
+	// A key which is not in the token fails when it is used
+	block.Headers["Token"] = testTokenLabel
+	block.Headers["Key-Id"] = "00"
+	missing, err := backend.Unmarshal(uuid.Nil, 1, domain.AlgorithmECC, pem.EncodeToMemory(block))
+	require.NoError(t, err)
+
+	signer, err := backend.CreateSigner(uuid.New(), domain.DeviceKey{
+		KeyPair: missing,
+		Params:  domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA256},
+	})
+	require.NoError(t, err)
+	_, err = signer.Sign([]byte("data"))
+	require.ErrorContains(t, err, "not found")
+
+	// Keys of devices created with the software backend are read and sign as they did
+	params := domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA256}
+	software, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+	_, softwarePrivate, err := crypto.NewMarshaler().Marshal(uuid.Nil, 1, software)
+	require.NoError(t, err)
+
+	unmarshaled, err := backend.Unmarshal(uuid.Nil, 1, domain.AlgorithmECC, softwarePrivate)
+	require.NoError(t, err)
+	require.Equal(t, software, unmarshaled)
+
+	signer, err = backend.CreateSigner(uuid.New(), domain.DeviceKey{KeyPair: unmarshaled, Params: params})
+	require.NoError(t, err)
+	signature, err := signer.Sign([]byte("data"))
+	require.NoError(t, err)
+
+	verifier, err := backend.CreateVerifier(unmarshaled, params)
+	require.NoError(t, err)
+	valid, err := verifier.Verify([]byte("data"), signature)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	_, err = backend.KeyParams(domain.AlgorithmED25519, domain.KeyParams{})
+	require.ErrorIs(t, err, domain.ErrInvalidAlgorithm)
+}
+
+func TestBackend_UnmarshalEncrypted(t *testing.T) {
+	ctx := context.Background()
+	token := newTestToken(t)
+	path := filepath.Join(t.TempDir(), "signatures.db")
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	kek, err := crypto.NewKEK(key)
+	require.NoError(t, err)
+	envelope, err := crypto.NewEnvelopeMarshaler(crypto.NewMarshaler(), []crypto.KEK{kek})
+	require.NoError(t, err)
+
+	// The device is created with the software backend, its private key encrypted with the KEK
+	params := domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA256}
+	software, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+	device := domain.Device{
+		ID:         uuid.New(),
+		KeyPair:    software,
+		Algorithm:  domain.AlgorithmECC,
+		KeyParams:  params,
+		KeyVersion: 1,
+		Status:     domain.StatusActive,
+	}
+
+	store, err := persistence.NewSQLite(ctx, path, envelope, 0)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateDevice(ctx, device))
+	require.NoError(t, store.Close())
+
+	// The HSM backend reads it with the same KEK
+	store, err = persistence.NewSQLite(ctx, path, NewBackend(token, envelope), 0)
+	require.NoError(t, err)
+	defer store.Close()
+
+	stored, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, software, stored.KeyPair)
+}
+
+func TestBackend_DiscardKeyPair(t *testing.T) {
+	backend := NewBackend(newTestToken(t), crypto.NewMarshaler())
+	params := domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA256}
+
+	generated, err := backend.GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+
+	software, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+	_, privateKey, err := crypto.NewMarshaler().Marshal(uuid.Nil, 1, software)
+	require.NoError(t, err)
+
+	imported, _, err := backend.ImportKeyPair(domain.AlgorithmECC, privateKey)
+	require.NoError(t, err)
+
+	for _, kp := range []domain.KeyPair{generated, imported} {
+		require.NoError(t, backend.DiscardKeyPair(kp))
+
+		// Neither the private nor the public key is left in the token
+		err = backend.token.withSession(func(session pkcs11.SessionHandle) error {
+			template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, kp.(*KeyPair).ID)}
+			require.NoError(t, backend.token.ctx.FindObjectsInit(session, template))
+			objects, _, err := backend.token.ctx.FindObjects(session, keyObjects)
+			require.NoError(t, backend.token.ctx.FindObjectsFinal(session))
+			require.NoError(t, err)
+			require.Empty(t, objects)
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// Key pairs which are not kept in the token are left as they are
+	require.NoError(t, backend.DiscardKeyPair(software))
+}
+
+func TestBackend_Concurrent(t *testing.T) {
+	backend := NewBackend(newTestToken(t), crypto.NewMarshaler())
+	params := domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA256}
+
+	kp, err := backend.GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+
+	signer, err := backend.CreateSigner(uuid.New(), domain.DeviceKey{KeyPair: kp, Params: params})
+	require.NoError(t, err)
+
+	verifier, err := backend.CreateVerifier(kp, params)
+	require.NoError(t, err)
+
+	// More signers than sessions
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data := []byte(fmt.Sprintf("data %d", i))
+			signature, err := signer.Sign(data)
+			if err != nil {
+				t.Errorf("failed to sign: %v", err)
+				return
+			}
+
+			if valid, err := verifier.Verify(data, signature); err != nil || !valid {
+				t.Errorf("invalid signature: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBackend_Services(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	backend := NewBackend(newTestToken(t), crypto.NewMarshaler())
+	store := persistence.NewInMemory(backend, 16)
+
+	deviceSvc := domain.NewDeviceService(logger, store, backend, domain.KeyPolicy{})
+	signatureSvc := domain.NewSignatureService(logger, deviceSvc, backend, backend, store, 0)
+
+	device, err := deviceSvc.CreateDevice(ctx, nil, domain.AlgorithmECC, domain.KeyParams{})
+	require.NoError(t, err)
+
+	for _, data := range []string{"first", "second"} {
+		_, err := signatureSvc.SignTransaction(ctx, device.ID, data)
+		require.NoError(t, err)
+	}
+
+	audit, err := signatureSvc.AuditChain(ctx, device.ID)
+	require.NoError(t, err)
+	require.True(t, audit.Valid)
+	require.Equal(t, 2, audit.Checked)
+}
@@ -0,0 +1,5 @@
+// Package hsm keeps the device keys in a hardware security module, through its PKCS #11 library. The keys are
+// generated in the token and never leave it, the service only stores a reference to them.
+//
+// The package needs cgo and is only built with the pkcs11 build tag.
+package hsm
@@ -0,0 +1,204 @@
+//go:build pkcs11
+
+package hsm
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/miekg/pkcs11"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// hashes are the PKCS #11 mechanisms and mask generation functions of the hash functions, and the DigestInfo
+// prefixes of PKCS #1 v1.5 signatures (RFC 8017, section 9.2).
+var hashes = map[gocrypto.Hash]struct {
+	mechanism uint
+	mgf       uint
+	prefix    []byte
+}{
+	gocrypto.SHA256: {
+		mechanism: pkcs11.CKM_SHA256,
+		mgf:       pkcs11.CKG_MGF1_SHA256,
+		prefix: []byte{
+			0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+			0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20,
+		},
+	},
+	gocrypto.SHA384: {
+		mechanism: pkcs11.CKM_SHA384,
+		mgf:       pkcs11.CKG_MGF1_SHA384,
+		prefix: []byte{
+			0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+			0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30,
+		},
+	},
+	gocrypto.SHA512: {
+		mechanism: pkcs11.CKM_SHA512,
+		mgf:       pkcs11.CKG_MGF1_SHA512,
+		prefix: []byte{
+			0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+			0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40,
+		},
+	},
+}
+
+// KeyPair is a key pair whose private key is kept in the token. It holds the ID of the key in the token and a key
+// pair with the public key, which verifies the signatures and is exported.
+//
+// KeyPair implements crypto.Signer, signing the digests in the token.
+type KeyPair struct {
+	ID []byte
+
+	public crypto.KeyPair
+	token  *Token
+
+	mu     sync.Mutex
+	object pkcs11.ObjectHandle // the private key, found on first use
+}
+
+func (*KeyPair) IsKeyPair() {}
+
+func (kp *KeyPair) Algorithm() domain.Algorithm {
+	return kp.public.Algorithm()
+}
+
+// Public returns the public key.
+func (kp *KeyPair) Public() gocrypto.PublicKey {
+	switch public := kp.public.(type) {
+	case *crypto.RSAKeyPair:
+		return public.Public
+	case *crypto.ECCKeyPair:
+		return public.Public
+	default:
+		return nil
+	}
+}
+
+// Sign signs the digest with the private key in the token. ECDSA signatures are ASN.1 encoded, RSA signatures use PSS
+// padding if the options are *rsa.PSSOptions and PKCS #1 v1.5 otherwise.
+func (kp *KeyPair) Sign(_ io.Reader, digest []byte, opts gocrypto.SignerOpts) ([]byte, error) {
+	hash, ok := hashes[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function %s", opts.HashFunc())
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("digest does not match the hash function")
+	}
+
+	var (
+		mechanism *pkcs11.Mechanism
+		message   []byte
+	)
+	switch public := kp.Public().(type) {
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+		message = digest
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			saltLength := pss.SaltLength
+			if saltLength == rsa.PSSSaltLengthEqualsHash {
+				saltLength = opts.HashFunc().Size()
+			}
+			if saltLength <= 0 {
+				return nil, fmt.Errorf("unsupported salt length %d", pss.SaltLength)
+			}
+
+			params := pkcs11.NewPSSParams(hash.mechanism, hash.mgf, uint(saltLength))
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+			message = digest
+		} else {
+			// The token only pads, the DigestInfo is put in front of the digest here
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			message = append(append([]byte{}, hash.prefix...), digest...)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	var signature []byte
+	err := kp.token.withSession(func(session pkcs11.SessionHandle) error {
+		object, err := kp.privateKey(session)
+		if err != nil {
+			return err
+		}
+
+		if err := kp.token.ctx.SignInit(session, []*pkcs11.Mechanism{mechanism}, object); err != nil {
+			return fmt.Errorf("failed to start signing: %w", err)
+		}
+
+		signature, err = kp.token.ctx.Sign(session, message)
+		if err != nil {
+			return fmt.Errorf("failed to sign digest: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := kp.Public().(*ecdsa.PublicKey); ok {
+		return encodeECDSASignature(signature)
+	}
+
+	return signature, nil
+}
+
+// privateKey returns the handle of the private key in the token.
+func (kp *KeyPair) privateKey(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	if kp.object != 0 {
+		return kp.object, nil
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, kp.ID),
+	}
+	if err := kp.token.ctx.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("failed to search private key: %w", err)
+	}
+
+	objects, _, err := kp.token.ctx.FindObjects(session, 1)
+	finalErr := kp.token.ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, fmt.Errorf("failed to search private key: %w", err)
+	}
+	if finalErr != nil {
+		return 0, fmt.Errorf("failed to search private key: %w", finalErr)
+	}
+	if len(objects) == 0 {
+		return 0, fmt.Errorf("private key %x not found in token %q", kp.ID, kp.token.Label())
+	}
+
+	kp.object = objects[0]
+
+	return kp.object, nil
+}
+
+// encodeECDSASignature converts the signature PKCS #11 returns, r and s of the same length one after the other, to
+// the ASN.1 encoding of the standard library.
+func encodeECDSASignature(signature []byte) ([]byte, error) {
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, fmt.Errorf("malformed ECDSA signature of %d bytes", len(signature))
+	}
+
+	size := len(signature) / 2
+
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(signature[:size]),
+		S: new(big.Int).SetBytes(signature[size:]),
+	})
+}
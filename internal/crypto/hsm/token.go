@@ -0,0 +1,135 @@
+//go:build pkcs11
+
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"strings"
+)
+
+// Config selects the token the keys are kept in.
+type Config struct {
+	// Module is the path of the PKCS #11 library of the HSM
+	Module string
+	// TokenLabel is the label of the token
+	TokenLabel string
+	// PIN is the PIN of the user of the token
+	PIN string
+	// Sessions is the number of sessions opened with the token, which is the number of keys used at once
+	Sessions int
+}
+
+// Token is a logged in connection to a PKCS #11 token. A PKCS #11 session can only run one operation at a time, so
+// the token keeps a pool of them.
+type Token struct {
+	label    string
+	ctx      *pkcs11.Ctx
+	sessions chan pkcs11.SessionHandle
+}
+
+// OpenToken loads the PKCS #11 library, finds the token with the configured label and logs in to it.
+func OpenToken(conf Config) (*Token, error) {
+	if conf.Sessions <= 0 {
+		return nil, errors.New("at least one session is needed")
+	}
+
+	ctx := pkcs11.New(conf.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS #11 library %s", conf.Module)
+	}
+
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+
+		return nil, fmt.Errorf("failed to initialize PKCS #11 library: %w", err)
+	}
+
+	t := &Token{
+		label:    conf.TokenLabel,
+		ctx:      ctx,
+		sessions: make(chan pkcs11.SessionHandle, conf.Sessions),
+	}
+
+	if err := t.open(conf); err != nil {
+		t.Close()
+
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *Token) open(conf Config) error {
+	slot, err := t.findSlot()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < conf.Sessions; i++ {
+		session, err := t.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return fmt.Errorf("failed to open session: %w", err)
+		}
+
+		t.sessions <- session
+
+		// The login is shared by all the sessions of the application
+		if i == 0 {
+			err = t.ctx.Login(session, pkcs11.CKU_USER, conf.PIN)
+			if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+				return fmt.Errorf("failed to log in to token %q: %w", t.label, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// findSlot returns the slot the token with the label is in.
+func (t *Token) findSlot() (uint, error) {
+	slots, err := t.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list slots: %w", err)
+	}
+
+	for _, slot := range slots {
+		info, err := t.ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read token of slot %d: %w", slot, err)
+		}
+
+		// Labels are padded with spaces
+		if strings.TrimRight(info.Label, " \x00") == t.label {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("token %q not found", t.label)
+}
+
+// Label returns the label of the token.
+func (t *Token) Label() string {
+	return t.label
+}
+
+// Close closes the sessions, which logs the application out, and unloads the library.
+func (t *Token) Close() {
+	for len(t.sessions) > 0 {
+		_ = t.ctx.CloseSession(<-t.sessions)
+	}
+
+	_ = t.ctx.Finalize()
+	t.ctx.Destroy()
+}
+
+// withSession runs fn with a session nobody else uses in the meantime. It waits for one if all are in use.
+func (t *Token) withSession(fn func(session pkcs11.SessionHandle) error) error {
+	session := <-t.sessions
+	defer func() {
+		t.sessions <- session
+	}()
+
+	return fn(session)
+}
@@ -1,40 +1,104 @@
 package crypto
 
 import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/gren236/fiskaly-go-challenge/internal/domain"
 )
 
-type Marshaler struct {
-	rsa *RSAMarshaler
-	ecc *ECCMarshaler
-}
+// PEM block types of the private keys written by earlier versions, which are still read.
+const (
+	legacyRSAPrivateKeyType = "RSA_PRIVATE_KEY"
+	legacyECCPrivateKeyType = "PRIVATE_KEY"
+)
+
+// Marshaler encodes and decodes key pairs of the registered algorithms to be written on disk. The private keys are
+// written as they are, whichever device key they belong to.
+type Marshaler struct{}
 
 func NewMarshaler() *Marshaler {
-	return &Marshaler{
-		rsa: NewRSAMarshaler(),
-		ecc: NewECCMarshaler(),
+	return &Marshaler{}
+}
+
+func (m Marshaler) Marshal(_ uuid.UUID, _ int, pair domain.KeyPair) ([]byte, []byte, error) {
+	algorithm, err := algorithmOf(pair)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	return algorithm.Marshal(pair)
 }
 
-func (m Marshaler) Marshal(pair domain.KeyPair) ([]byte, []byte, error) {
-	switch kp := pair.(type) {
-	case *RSAKeyPair:
-		return m.rsa.Marshal(*kp)
-	case *ECCKeyPair:
-		return m.ecc.Marshal(*kp)
-	default:
-		return nil, nil, fmt.Errorf("unsupported key pair type")
+func (m Marshaler) Unmarshal(
+	_ uuid.UUID, _ int, algo domain.Algorithm, privateKeyBytes []byte,
+) (domain.KeyPair, error) {
+	algorithm, err := lookup(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	return algorithm.Unmarshal(privateKeyBytes)
+}
+
+// encodeKeyPair encodes the private key as a PKCS #8 "PRIVATE KEY" and the public key as a PKIX "PUBLIC KEY" PEM
+// block. It returns the public and the private key.
+func encodeKeyPair(private, public any) ([]byte, []byte, error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal public key: %w", err)
 	}
+
+	encodedPrivate := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	encodedPublic := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	})
+
+	return encodedPublic, encodedPrivate, nil
 }
 
-func (m Marshaler) Unmarshal(algo domain.Algorithm, privateKeyBytes []byte) (domain.KeyPair, error) {
-	switch algo {
-	case domain.AlgorithmRSA:
-		return m.rsa.Unmarshal(privateKeyBytes)
-	case domain.AlgorithmECC:
-		return m.ecc.Unmarshal(privateKeyBytes)
+// decodePrivateKey parses a PEM encoded private key. Besides PKCS #8, it reads the PKCS #1 and SEC 1 blocks OpenSSL
+// writes for RSA and EC keys and the ones of earlier versions.
+func decodePrivateKey(privateKeyBytes []byte) (any, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY", legacyRSAPrivateKeyType:
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY", legacyECCPrivateKeyType:
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case wrappedKeyType:
+		return nil, fmt.Errorf("private key is wrapped with key-encryption key %q, which is not configured",
+			block.Headers[kekIDHeader])
+	case TokenKeyType:
+		return nil, errors.New("private key is kept in a PKCS #11 token, which is not configured")
 	default:
-		return nil, fmt.Errorf("unsupported algorithm: %s", algo)
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q PEM block: %w", block.Type, err)
+	}
+
+	return key, nil
 }
@@ -0,0 +1,183 @@
+package crypto
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshaler_RoundTrip(t *testing.T) {
+	for _, algorithm := range Algorithms() {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			kp, err := NewGenerator().GenerateKeyPair(algorithm, mustKeyParams(t, algorithm))
+			require.NoError(t, err)
+
+			public, private, err := NewMarshaler().Marshal(uuid.Nil, 1, kp)
+			require.NoError(t, err)
+
+			// Both blocks are standard, so other tools can read them
+			privateBlock, rest := pem.Decode(private)
+			require.NotNil(t, privateBlock)
+			require.Empty(t, rest)
+			require.Equal(t, "PRIVATE KEY", privateBlock.Type)
+			_, err = x509.ParsePKCS8PrivateKey(privateBlock.Bytes)
+			require.NoError(t, err)
+
+			publicBlock, rest := pem.Decode(public)
+			require.NotNil(t, publicBlock)
+			require.Empty(t, rest)
+			require.Equal(t, "PUBLIC KEY", publicBlock.Type)
+			_, err = x509.ParsePKIXPublicKey(publicBlock.Bytes)
+			require.NoError(t, err)
+
+			unmarshaled, err := NewMarshaler().Unmarshal(uuid.Nil, 1, algorithm, private)
+			require.NoError(t, err)
+			require.Equal(t, kp, unmarshaled)
+
+			_, again, err := NewMarshaler().Marshal(uuid.Nil, 1, unmarshaled)
+			require.NoError(t, err)
+			require.Equal(t, private, again)
+		})
+	}
+}
+
+func TestMarshaler_UnmarshalLegacy(t *testing.T) {
+	rsaKeyPair, err := NewGenerator().GenerateKeyPair(domain.AlgorithmRSA, mustKeyParams(t, domain.AlgorithmRSA))
+	require.NoError(t, err)
+
+	eccKeyPair, err := NewGenerator().GenerateKeyPair(domain.AlgorithmECC, mustKeyParams(t, domain.AlgorithmECC))
+	require.NoError(t, err)
+
+	eccPrivateKeyBytes, err := x509.MarshalECPrivateKey(eccKeyPair.(*ECCKeyPair).Private)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		algorithm domain.Algorithm
+		keyPair   domain.KeyPair
+		block     *pem.Block
+	}{
+		{
+			name:      "legacy RSA",
+			algorithm: domain.AlgorithmRSA,
+			keyPair:   rsaKeyPair,
+			block: &pem.Block{
+				Type:  "RSA_PRIVATE_KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(rsaKeyPair.(*RSAKeyPair).Private),
+			},
+		},
+		{
+			name:      "PKCS #1",
+			algorithm: domain.AlgorithmRSA,
+			keyPair:   rsaKeyPair,
+			block: &pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(rsaKeyPair.(*RSAKeyPair).Private),
+			},
+		},
+		{
+			name:      "legacy ECC",
+			algorithm: domain.AlgorithmECC,
+			keyPair:   eccKeyPair,
+			block:     &pem.Block{Type: "PRIVATE_KEY", Bytes: eccPrivateKeyBytes},
+		},
+		{
+			name:      "SEC 1",
+			algorithm: domain.AlgorithmECC,
+			keyPair:   eccKeyPair,
+			block:     &pem.Block{Type: "EC PRIVATE KEY", Bytes: eccPrivateKeyBytes},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kp, err := NewMarshaler().Unmarshal(uuid.Nil, 1, tt.algorithm, pem.EncodeToMemory(tt.block))
+			require.NoError(t, err)
+			require.Equal(t, tt.keyPair, kp)
+
+			// Keys read in an old format are written in the standard one
+			_, private, err := NewMarshaler().Marshal(uuid.Nil, 1, kp)
+			require.NoError(t, err)
+
+			block, _ := pem.Decode(private)
+			require.Equal(t, "PRIVATE KEY", block.Type)
+		})
+	}
+}
+
+func TestMarshaler_UnmarshalMalformed(t *testing.T) {
+	rsaKeyPair, err := NewGenerator().GenerateKeyPair(domain.AlgorithmRSA, mustKeyParams(t, domain.AlgorithmRSA))
+	require.NoError(t, err)
+
+	_, rsaPrivate, err := NewMarshaler().Marshal(uuid.Nil, 1, rsaKeyPair)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(rsaPrivate)
+	truncated := pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes[:len(block.Bytes)/2]})
+
+	tests := []struct {
+		name      string
+		algorithm domain.Algorithm
+		input     []byte
+		wantErr   string
+	}{
+		{
+			name:      "empty",
+			algorithm: domain.AlgorithmECC,
+			input:     nil,
+			wantErr:   "private key is not PEM encoded",
+		},
+		{
+			name:      "not PEM",
+			algorithm: domain.AlgorithmRSA,
+			input:     []byte("not a pem"),
+			wantErr:   "private key is not PEM encoded",
+		},
+		{
+			name:      "cut off PEM",
+			algorithm: domain.AlgorithmRSA,
+			input:     rsaPrivate[:len(rsaPrivate)/2],
+			wantErr:   "private key is not PEM encoded",
+		},
+		{
+			name:      "unsupported block type",
+			algorithm: domain.AlgorithmRSA,
+			input:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes}),
+			wantErr:   `unsupported PEM block type "CERTIFICATE"`,
+		},
+		{
+			name:      "truncated key",
+			algorithm: domain.AlgorithmRSA,
+			input:     truncated,
+			wantErr:   `failed to parse "PRIVATE KEY" PEM block`,
+		},
+		{
+			name:      "wrong encoding for the block type",
+			algorithm: domain.AlgorithmECC,
+			input:     pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: block.Bytes}),
+			wantErr:   `failed to parse "EC PRIVATE KEY" PEM block`,
+		},
+		{
+			name:      "key of another algorithm",
+			algorithm: domain.AlgorithmECC,
+			input:     rsaPrivate,
+			wantErr:   "private key is *rsa.PrivateKey, not an ECC key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMarshaler().Unmarshal(uuid.Nil, 1, tt.algorithm, tt.input)
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func mustKeyParams(t *testing.T, algorithm domain.Algorithm) domain.KeyParams {
+	params, err := NewGenerator().KeyParams(algorithm, domain.KeyParams{})
+	require.NoError(t, err)
+
+	return params
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+)
+
+// Defaults for the key parameters which are not requested.
+const (
+	defaultRSABits = 2048
+	defaultCurve   = domain.CurveP384
+	defaultHash    = domain.HashSHA256
+)
+
+// rsaKeySizes are the supported sizes of RSA keys, in bits.
+var rsaKeySizes = []int{2048, 3072, 4096}
+
+var hashFunctions = map[domain.Hash]crypto.Hash{
+	domain.HashSHA256: crypto.SHA256,
+	domain.HashSHA384: crypto.SHA384,
+	domain.HashSHA512: crypto.SHA512,
+}
+
+var curves = map[domain.Curve]elliptic.Curve{
+	domain.CurveP256: elliptic.P256(),
+	domain.CurveP384: elliptic.P384(),
+	domain.CurveP521: elliptic.P521(),
+}
+
+// curveHashes are the hash functions of the same strength as the curves, they are used if no hash is requested.
+var curveHashes = map[domain.Curve]domain.Hash{
+	domain.CurveP256: domain.HashSHA256,
+	domain.CurveP384: domain.HashSHA384,
+	domain.CurveP521: domain.HashSHA512,
+}
+
+// hashFunction returns the hash function with the given name. Keys created before the hash function could be chosen
+// have none set, they were all used with SHA-256.
+func hashFunction(name domain.Hash) (crypto.Hash, error) {
+	if name == "" {
+		return crypto.SHA256, nil
+	}
+
+	hash, ok := hashFunctions[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: unsupported hash %s", domain.ErrInvalidKeyParams, name)
+	}
+
+	return hash, nil
+}
+
+// ellipticCurve returns the curve with the given name.
+func ellipticCurve(name domain.Curve) (elliptic.Curve, error) {
+	curve, ok := curves[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported curve %s", domain.ErrInvalidKeyParams, name)
+	}
+
+	return curve, nil
+}
@@ -0,0 +1,280 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/pem"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerator_KeyParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm domain.Algorithm
+		requested domain.KeyParams
+		expected  domain.KeyParams
+		wantErr   bool
+	}{
+		{
+			name:      "RSA defaults",
+			algorithm: domain.AlgorithmRSA,
+			expected:  domain.KeyParams{RSABits: 2048, Padding: domain.PaddingPKCS1v15, Hash: domain.HashSHA256},
+		},
+		{
+			name:      "RSA requested",
+			algorithm: domain.AlgorithmRSA,
+			requested: domain.KeyParams{RSABits: 4096, Hash: domain.HashSHA512},
+			expected:  domain.KeyParams{RSABits: 4096, Padding: domain.PaddingPKCS1v15, Hash: domain.HashSHA512},
+		},
+		{
+			name:      "RSA-PSS salt as long as the hash",
+			algorithm: domain.AlgorithmRSA,
+			requested: domain.KeyParams{Padding: domain.PaddingPSS, Hash: domain.HashSHA384},
+			expected: domain.KeyParams{
+				RSABits: 2048, Padding: domain.PaddingPSS, SaltLength: 48, Hash: domain.HashSHA384,
+			},
+		},
+		{
+			name:      "RSA-PSS salt too long",
+			algorithm: domain.AlgorithmRSA,
+			requested: domain.KeyParams{Padding: domain.PaddingPSS, SaltLength: 223},
+			wantErr:   true,
+		},
+		{
+			name:      "RSA salt without PSS",
+			algorithm: domain.AlgorithmRSA,
+			requested: domain.KeyParams{SaltLength: 32},
+			wantErr:   true,
+		},
+		{
+			name:      "RSA unsupported padding",
+			algorithm: domain.AlgorithmRSA,
+			requested: domain.KeyParams{Padding: "OAEP"},
+			wantErr:   true,
+		},
+		{
+			name:      "RSA unsupported size",
+			algorithm: domain.AlgorithmRSA,
+			requested: domain.KeyParams{RSABits: 512},
+			wantErr:   true,
+		},
+		{
+			name:      "RSA with curve",
+			algorithm: domain.AlgorithmRSA,
+			requested: domain.KeyParams{Curve: domain.CurveP256},
+			wantErr:   true,
+		},
+		{
+			name:      "ECC defaults",
+			algorithm: domain.AlgorithmECC,
+			expected:  domain.KeyParams{Curve: domain.CurveP384, Hash: domain.HashSHA384},
+		},
+		{
+			name:      "ECC hash follows curve",
+			algorithm: domain.AlgorithmECC,
+			requested: domain.KeyParams{Curve: domain.CurveP521},
+			expected:  domain.KeyParams{Curve: domain.CurveP521, Hash: domain.HashSHA512},
+		},
+		{
+			name:      "ECC unsupported hash",
+			algorithm: domain.AlgorithmECC,
+			requested: domain.KeyParams{Hash: "MD5"},
+			wantErr:   true,
+		},
+		{
+			name:      "ECC with padding",
+			algorithm: domain.AlgorithmECC,
+			requested: domain.KeyParams{Padding: domain.PaddingPSS},
+			wantErr:   true,
+		},
+		{
+			name:      "ED25519 with hash",
+			algorithm: domain.AlgorithmED25519,
+			requested: domain.KeyParams{Hash: domain.HashSHA256},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := NewGenerator().KeyParams(tt.algorithm, tt.requested)
+			if tt.wantErr {
+				require.ErrorIs(t, err, domain.ErrInvalidKeyParams)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, params)
+		})
+	}
+}
+
+func TestGenerator_GenerateKeyPair_Params(t *testing.T) {
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmRSA, domain.KeyParams{RSABits: 3072})
+	require.NoError(t, err)
+	assert.Equal(t, 3072, kp.(*RSAKeyPair).Public.N.BitLen())
+
+	kp, err = NewGenerator().GenerateKeyPair(domain.AlgorithmECC, domain.KeyParams{Curve: domain.CurveP256})
+	require.NoError(t, err)
+	assert.Equal(t, "P-256", kp.(*ECCKeyPair).Public.Curve.Params().Name)
+}
+
+func TestGenerator_ImportKeyPair(t *testing.T) {
+	for _, algorithm := range Algorithms() {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			params := mustKeyParams(t, algorithm)
+			kp, err := NewGenerator().GenerateKeyPair(algorithm, params)
+			require.NoError(t, err)
+
+			_, private, err := NewMarshaler().Marshal(uuid.Nil, 1, kp)
+			require.NoError(t, err)
+
+			// The PEM block and the DER encoded PKCS #8 key in it are both read
+			block, _ := pem.Decode(private)
+			for _, privateKey := range [][]byte{private, block.Bytes} {
+				imported, importedParams, err := NewGenerator().ImportKeyPair(algorithm, privateKey)
+				require.NoError(t, err)
+				assert.Equal(t, kp, imported)
+				assert.Equal(t, params.RSABits, importedParams.RSABits)
+				assert.Equal(t, params.Curve, importedParams.Curve)
+			}
+
+			for _, other := range Algorithms() {
+				if other != algorithm {
+					_, _, err = NewGenerator().ImportKeyPair(other, private)
+					assert.ErrorIs(t, err, domain.ErrInvalidImport)
+				}
+			}
+		})
+	}
+
+	_, _, err := NewGenerator().ImportKeyPair(domain.AlgorithmECC, []byte("not a key"))
+	assert.ErrorIs(t, err, domain.ErrInvalidImport)
+}
+
+func TestSigner_Hash(t *testing.T) {
+	rsaParams := domain.KeyParams{RSABits: 2048, Hash: domain.HashSHA512}
+	rsaKp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmRSA, rsaParams)
+	require.NoError(t, err)
+
+	pssParams := domain.KeyParams{RSABits: 2048, Padding: domain.PaddingPSS, SaltLength: 20, Hash: domain.HashSHA256}
+
+	eccParams := domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA384}
+	eccKp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmECC, eccParams)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		kp     domain.KeyPair
+		params domain.KeyParams
+		verify func(digest, signature []byte) bool
+		jwa    string
+	}{
+		{
+			name:   "RSA",
+			kp:     rsaKp,
+			params: rsaParams,
+			verify: func(digest, signature []byte) bool {
+				return rsa.VerifyPKCS1v15(rsaKp.(*RSAKeyPair).Public, crypto.SHA512, digest, signature) == nil
+			},
+			jwa: "RS512",
+		},
+		{
+			name:   "RSA-PSS",
+			kp:     rsaKp,
+			params: pssParams,
+			verify: func(digest, signature []byte) bool {
+				opts := &rsa.PSSOptions{SaltLength: 20}
+				return rsa.VerifyPSS(rsaKp.(*RSAKeyPair).Public, crypto.SHA256, digest, signature, opts) == nil
+			},
+			jwa: "", // JWA has no name for PSS with a salt shorter than the hash
+		},
+		{
+			name:   "ECC",
+			kp:     eccKp,
+			params: eccParams,
+			verify: func(digest, signature []byte) bool {
+				return ecdsa.VerifyASN1(eccKp.(*ECCKeyPair).Public, digest, signature)
+			},
+			jwa: "", // JWA has no name for P-256 with SHA-384
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := domain.DeviceKey{KeyPair: tt.kp, Params: tt.params}
+			signer, err := NewSignerCreator().CreateSigner(uuid.New(), key)
+			require.NoError(t, err)
+
+			signature, err := signer.Sign([]byte("data"))
+			require.NoError(t, err)
+
+			hash, err := hashFunction(tt.params.Hash)
+			require.NoError(t, err)
+
+			digest, err := hashData([]byte("data"), hash)
+			require.NoError(t, err)
+			assert.True(t, tt.verify(digest, signature))
+
+			// The signature does not verify with a different hash function
+			verifier, err := NewVerifierCreator().CreateVerifier(tt.kp, domain.KeyParams{Hash: domain.HashSHA256})
+			require.NoError(t, err)
+
+			valid, err := verifier.Verify([]byte("data"), signature)
+			require.NoError(t, err)
+			assert.False(t, valid)
+
+			jwk, err := NewPublicKeyEncoder().EncodeJWK(tt.kp, tt.params)
+			require.NoError(t, err)
+			assert.Equal(t, tt.jwa, jwk.Algorithm)
+		})
+	}
+}
+
+func TestRSAVerifier_Padding(t *testing.T) {
+	params, err := NewGenerator().KeyParams(domain.AlgorithmRSA, domain.KeyParams{Padding: domain.PaddingPSS})
+	require.NoError(t, err)
+
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmRSA, params)
+	require.NoError(t, err)
+
+	signer, err := NewSignerCreator().CreateSigner(uuid.New(), domain.DeviceKey{KeyPair: kp, Params: params})
+	require.NoError(t, err)
+
+	signature, err := signer.Sign([]byte("data"))
+	require.NoError(t, err)
+
+	jwk, err := NewPublicKeyEncoder().EncodeJWK(kp, params)
+	require.NoError(t, err)
+	assert.Equal(t, "PS256", jwk.Algorithm)
+
+	tests := []struct {
+		name   string
+		params domain.KeyParams
+		valid  bool
+	}{
+		{name: "same parameters", params: params, valid: true},
+		{name: "PKCS #1 v1.5", params: domain.KeyParams{Padding: domain.PaddingPKCS1v15, Hash: params.Hash}},
+		{name: "other salt length", params: domain.KeyParams{
+			Padding: domain.PaddingPSS, SaltLength: 20, Hash: params.Hash,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewVerifierCreator().CreateVerifier(kp, tt.params)
+			require.NoError(t, err)
+
+			valid, err := verifier.Verify([]byte("data"), signature)
+			require.NoError(t, err)
+			assert.Equal(t, tt.valid, valid)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+)
+
+// PublicKeyEncoder exports the public part of a key pair in standard formats, so the signatures can be verified
+// outside the service.
+type PublicKeyEncoder struct{}
+
+func NewPublicKeyEncoder() *PublicKeyEncoder {
+	return &PublicKeyEncoder{}
+}
+
+// EncodePEM encodes the public key as a PKIX "PUBLIC KEY" PEM block.
+func (e *PublicKeyEncoder) EncodePEM(kp domain.KeyPair) ([]byte, error) {
+	algorithm, err := algorithmOf(kp)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := algorithm.PublicKey(kp)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	}), nil
+}
+
+// EncodeJWK encodes the public key as a JSON Web Key. The algorithm matches the one the signers use with the key
+// parameters, if JWA has a name for it.
+func (e *PublicKeyEncoder) EncodeJWK(kp domain.KeyPair, params domain.KeyParams) (domain.JWK, error) {
+	algorithm, err := algorithmOf(kp)
+	if err != nil {
+		return domain.JWK{}, err
+	}
+
+	return algorithm.EncodeJWK(kp, params)
+}
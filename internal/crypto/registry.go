@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"sync"
+)
+
+// Algorithm implements everything the service does with the keys of one signature algorithm. The key pairs passed to
+// it are always the ones it generated or unmarshaled itself.
+type Algorithm interface {
+	// KeyParams fills in the defaults for the parameters which are not requested. It returns ErrInvalidKeyParams if
+	// the parameters are not supported.
+	KeyParams(requested domain.KeyParams) (domain.KeyParams, error)
+	GenerateKeyPair(params domain.KeyParams) (domain.KeyPair, error)
+	// Marshal encodes the key pair to be written on disk. It returns the public and the private key.
+	Marshal(kp domain.KeyPair) ([]byte, []byte, error)
+	// Unmarshal assembles the key pair from an encoded private key.
+	Unmarshal(privateKeyBytes []byte) (domain.KeyPair, error)
+	CreateSigner(kp domain.KeyPair, params domain.KeyParams) (domain.Signer, error)
+	CreateVerifier(kp domain.KeyPair, params domain.KeyParams) (domain.Verifier, error)
+	PublicKey(kp domain.KeyPair) (crypto.PublicKey, error)
+	EncodeJWK(kp domain.KeyPair, params domain.KeyParams) (domain.JWK, error)
+}
+
+// KeyPair is implemented by the key pairs of all registered algorithms, so the algorithm of a key pair can be found.
+type KeyPair interface {
+	domain.KeyPair
+	Algorithm() domain.Algorithm
+}
+
+var registry = struct {
+	sync.RWMutex
+	algorithms map[domain.Algorithm]Algorithm
+	names      []domain.Algorithm // in registration order
+}{
+	algorithms: make(map[domain.Algorithm]Algorithm),
+}
+
+func init() {
+	Register(domain.AlgorithmRSA, rsaAlgorithm{})
+	Register(domain.AlgorithmECC, eccAlgorithm{})
+	Register(domain.AlgorithmED25519, ed25519Algorithm{})
+}
+
+// Register makes the algorithm available under the given name. Like the registration functions of the standard
+// library, it is meant to be called from init functions and panics if the name is already taken.
+func Register(name domain.Algorithm, algorithm Algorithm) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.algorithms[name]; ok {
+		panic(fmt.Sprintf("crypto: algorithm %s is already registered", name))
+	}
+
+	registry.algorithms[name] = algorithm
+	registry.names = append(registry.names, name)
+}
+
+// Algorithms returns the names of all registered algorithms, in registration order.
+func Algorithms() []domain.Algorithm {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	return append([]domain.Algorithm(nil), registry.names...)
+}
+
+// lookup returns the algorithm registered under the name. It fails with ErrInvalidAlgorithm if there is none.
+func lookup(name domain.Algorithm) (Algorithm, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	algorithm, ok := registry.algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", domain.ErrInvalidAlgorithm, name)
+	}
+
+	return algorithm, nil
+}
+
+// algorithmOf returns the algorithm the key pair belongs to.
+func algorithmOf(kp domain.KeyPair) (Algorithm, error) {
+	keyPair, ok := kp.(KeyPair)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key pair type %T", kp)
+	}
+
+	return lookup(keyPair.Algorithm())
+}
+
+// asKeyPair converts the key pair to the concrete type an algorithm works with.
+func asKeyPair[T domain.KeyPair](kp domain.KeyPair) (T, error) {
+	keyPair, ok := kp.(T)
+	if !ok {
+		return keyPair, fmt.Errorf("unsupported key pair type %T", kp)
+	}
+
+	return keyPair, nil
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Algorithms(t *testing.T) {
+	require.Equal(t, []domain.Algorithm{domain.AlgorithmRSA, domain.AlgorithmECC, domain.AlgorithmED25519}, Algorithms())
+}
+
+func TestRegistry_Dispatch(t *testing.T) {
+	for _, algorithm := range Algorithms() {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			params, err := NewGenerator().KeyParams(algorithm, domain.KeyParams{})
+			require.NoError(t, err)
+
+			kp, err := NewGenerator().GenerateKeyPair(algorithm, params)
+			require.NoError(t, err)
+			require.Equal(t, algorithm, kp.(KeyPair).Algorithm())
+
+			_, private, err := NewMarshaler().Marshal(uuid.Nil, 1, kp)
+			require.NoError(t, err)
+
+			unmarshaled, err := NewMarshaler().Unmarshal(uuid.Nil, 1, algorithm, private)
+			require.NoError(t, err)
+
+			signer, err := NewSignerCreator().CreateSigner(uuid.New(), domain.DeviceKey{KeyPair: kp, Params: params})
+			require.NoError(t, err)
+
+			signature, err := signer.Sign([]byte("data"))
+			require.NoError(t, err)
+
+			verifier, err := NewVerifierCreator().CreateVerifier(unmarshaled, params)
+			require.NoError(t, err)
+
+			valid, err := verifier.Verify([]byte("data"), signature)
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			_, err = NewPublicKeyEncoder().EncodeJWK(unmarshaled, params)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRegistry_UnknownAlgorithm(t *testing.T) {
+	_, err := NewGenerator().GenerateKeyPair("DSA", domain.KeyParams{})
+	require.ErrorIs(t, err, domain.ErrInvalidAlgorithm)
+
+	_, err = NewMarshaler().Unmarshal(uuid.Nil, 1, "DSA", nil)
+	require.ErrorIs(t, err, domain.ErrInvalidAlgorithm)
+}
+
+func TestRegister_Duplicate(t *testing.T) {
+	require.Panics(t, func() {
+		Register(domain.AlgorithmRSA, rsaAlgorithm{})
+	})
+}
@@ -1,9 +1,13 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/base64"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"math/big"
+	"slices"
 )
 
 // RSAKeyPair is a DTO that holds RSA private and public keys.
@@ -14,6 +18,10 @@ type RSAKeyPair struct {
 
 func (RSAKeyPair) IsKeyPair() {}
 
+func (RSAKeyPair) Algorithm() domain.Algorithm {
+	return domain.AlgorithmRSA
+}
+
 // RSAMarshaler can encode and decode an RSA key pair.
 type RSAMarshaler struct{}
 
@@ -22,35 +30,192 @@ func NewRSAMarshaler() *RSAMarshaler {
 	return &RSAMarshaler{}
 }
 
-// Marshal takes an RSAKeyPair and encodes it to be written on disk.
-// It returns the public and the private key as a byte slice.
+// Marshal takes an RSAKeyPair and encodes it to be written on disk, the private key as PKCS #8 and the public key
+// as PKIX. It returns the public and the private key as a byte slice.
 func (m *RSAMarshaler) Marshal(keyPair RSAKeyPair) ([]byte, []byte, error) {
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(keyPair.Private)
-	publicKeyBytes := x509.MarshalPKCS1PublicKey(keyPair.Public)
-
-	encodedPrivate := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA_PRIVATE_KEY",
-		Bytes: privateKeyBytes,
-	})
-
-	encodePublic := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA_PUBLIC_KEY",
-		Bytes: publicKeyBytes,
-	})
-
-	return encodePublic, encodedPrivate, nil
+	return encodeKeyPair(keyPair.Private, keyPair.Public)
 }
 
-// Unmarshal takes an encoded RSA private key and transforms it into a rsa.PrivateKey.
+// Unmarshal assembles an RSAKeyPair from an encoded private key, either PKCS #8 or PKCS #1.
 func (m *RSAMarshaler) Unmarshal(privateKeyBytes []byte) (*RSAKeyPair, error) {
-	block, _ := pem.Decode(privateKeyBytes)
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	key, err := decodePrivateKey(privateKeyBytes)
 	if err != nil {
 		return nil, err
 	}
 
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not an RSA key", key)
+	}
+
 	return &RSAKeyPair{
 		Private: privateKey,
 		Public:  &privateKey.PublicKey,
 	}, nil
 }
+
+// rsaAlgorithm registers the RSA key pairs, signed with PKCS #1 v1.5 or PSS padding.
+type rsaAlgorithm struct{}
+
+func (rsaAlgorithm) KeyParams(requested domain.KeyParams) (domain.KeyParams, error) {
+	if requested.Curve != "" {
+		return domain.KeyParams{}, fmt.Errorf("%w: RSA keys have no curve", domain.ErrInvalidKeyParams)
+	}
+
+	params := requested
+	if params.RSABits == 0 {
+		params.RSABits = defaultRSABits
+	}
+	if params.Padding == "" {
+		params.Padding = domain.PaddingPKCS1v15
+	}
+	if params.Hash == "" {
+		params.Hash = defaultHash
+	}
+
+	if !slices.Contains(rsaKeySizes, params.RSABits) {
+		return domain.KeyParams{}, fmt.Errorf("%w: unsupported RSA key size %d, supported sizes are %v",
+			domain.ErrInvalidKeyParams, params.RSABits, rsaKeySizes,
+		)
+	}
+
+	hash, err := hashFunction(params.Hash)
+	if err != nil {
+		return domain.KeyParams{}, err
+	}
+
+	switch params.Padding {
+	case domain.PaddingPKCS1v15:
+		if params.SaltLength != 0 {
+			return domain.KeyParams{}, fmt.Errorf("%w: salt length is only used with PSS padding",
+				domain.ErrInvalidKeyParams,
+			)
+		}
+	case domain.PaddingPSS:
+		// The salt is as long as the hash by default, as RFC 8017 recommends and JWA requires
+		if params.SaltLength == 0 {
+			params.SaltLength = hash.Size()
+		}
+
+		// The encoded message must fit the hash, the salt and two more bytes
+		maxSaltLength := (params.RSABits-1+7)/8 - hash.Size() - 2
+		if params.SaltLength < 0 || params.SaltLength > maxSaltLength {
+			return domain.KeyParams{}, fmt.Errorf("%w: salt length must be between 1 and %d bytes",
+				domain.ErrInvalidKeyParams, maxSaltLength,
+			)
+		}
+	default:
+		return domain.KeyParams{}, fmt.Errorf("%w: unsupported padding %s", domain.ErrInvalidKeyParams, params.Padding)
+	}
+
+	return params, nil
+}
+
+func (rsaAlgorithm) GenerateKeyPair(params domain.KeyParams) (domain.KeyPair, error) {
+	return (&RSAGenerator{}).Generate(params.RSABits)
+}
+
+func (rsaAlgorithm) Marshal(kp domain.KeyPair) ([]byte, []byte, error) {
+	keyPair, err := asKeyPair[*RSAKeyPair](kp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewRSAMarshaler().Marshal(*keyPair)
+}
+
+func (rsaAlgorithm) Unmarshal(privateKeyBytes []byte) (domain.KeyPair, error) {
+	return NewRSAMarshaler().Unmarshal(privateKeyBytes)
+}
+
+func (rsaAlgorithm) CreateSigner(kp domain.KeyPair, params domain.KeyParams) (domain.Signer, error) {
+	keyPair, err := asKeyPair[*RSAKeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := rsaSignerOpts(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RSASigner{private: keyPair.Private, opts: opts}, nil
+}
+
+func (rsaAlgorithm) CreateVerifier(kp domain.KeyPair, params domain.KeyParams) (domain.Verifier, error) {
+	keyPair, err := asKeyPair[*RSAKeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := rsaSignerOpts(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RSAVerifier{public: keyPair.Public, opts: opts}, nil
+}
+
+func (rsaAlgorithm) PublicKey(kp domain.KeyPair) (crypto.PublicKey, error) {
+	keyPair, err := asKeyPair[*RSAKeyPair](kp)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyPair.Public, nil
+}
+
+func (rsaAlgorithm) EncodeJWK(kp domain.KeyPair, params domain.KeyParams) (domain.JWK, error) {
+	keyPair, err := asKeyPair[*RSAKeyPair](kp)
+	if err != nil {
+		return domain.JWK{}, err
+	}
+
+	opts, err := rsaSignerOpts(params)
+	if err != nil {
+		return domain.JWK{}, err
+	}
+
+	return domain.JWK{
+		KeyType:   "RSA",
+		Algorithm: rsaJWA(opts),
+		Modulus:   base64.RawURLEncoding.EncodeToString(keyPair.Public.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(keyPair.Public.E)).Bytes()),
+	}, nil
+}
+
+// rsaSignerOpts returns the options RSA keys with the given parameters sign with: the hash function for PKCS #1 v1.5
+// padding, or the PSS options. Keys created before the padding could be chosen have none set, they all used PKCS #1
+// v1.5.
+func rsaSignerOpts(params domain.KeyParams) (crypto.SignerOpts, error) {
+	hash, err := hashFunction(params.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	switch params.Padding {
+	case "", domain.PaddingPKCS1v15:
+		return hash, nil
+	case domain.PaddingPSS:
+		return &rsa.PSSOptions{SaltLength: params.SaltLength, Hash: hash}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported padding %s", domain.ErrInvalidKeyParams, params.Padding)
+	}
+}
+
+// rsaJWA returns the JSON Web Algorithm name for RSA signatures with the given options. JWA only names PSS with a salt
+// as long as the hash, for other salt lengths it returns "".
+func rsaJWA(opts crypto.SignerOpts) string {
+	bits := opts.HashFunc().Size() * 8
+
+	pss, ok := opts.(*rsa.PSSOptions)
+	if !ok {
+		return fmt.Sprintf("RS%d", bits)
+	}
+
+	if pss.SaltLength != pss.Hash.Size() {
+		return ""
+	}
+
+	return fmt.Sprintf("PS%d", bits)
+}
@@ -3,9 +3,12 @@ package crypto
 import (
 	"crypto"
 	"crypto/rand"
-	"crypto/sha256"
+	_ "crypto/sha256" // registers SHA-224 and SHA-256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/gren236/fiskaly-go-challenge/pkg/cache"
 )
 
 type SignerCreator struct{}
@@ -17,29 +20,73 @@ func NewSignerCreator() *SignerCreator {
 // CreateSigner creates a new signer. Usually, it's not idiomatic in Go to return an interface instead of concrete type.
 // However, in this case, it's necessary to return an interface because the concrete type of the signer is determined
 // at runtime. BTW, Go std libraries use this pattern in some places, e.g., gob package.
-func (sc *SignerCreator) CreateSigner(kp domain.KeyPair) (domain.Signer, error) {
-	switch kp := kp.(type) {
-	case *ECCKeyPair:
-		return &ECCSigner{keyPair: *kp}, nil
-	case *RSAKeyPair:
-		return &RSASigner{keyPair: *kp}, nil
-	default:
-		return nil, fmt.Errorf("unsupported key pair type")
+func (sc *SignerCreator) CreateSigner(_ uuid.UUID, key domain.DeviceKey) (domain.Signer, error) {
+	algorithm, err := algorithmOf(key.KeyPair)
+	if err != nil {
+		return nil, err
 	}
+
+	return algorithm.CreateSigner(key.KeyPair, key.Params)
+}
+
+// signerKey identifies the key of a device a signer was created for.
+type signerKey struct {
+	deviceID uuid.UUID
+	version  int
+}
+
+// CachingSignerCreator keeps the signers another creator created for the recently used device keys, so they are not
+// created again for every signature. The signers are kept by device ID and key version, they have to be dropped with
+// Forget when the keys of a device change.
+type CachingSignerCreator struct {
+	creator domain.SignerCreator
+	signers *cache.LRU[signerKey, domain.Signer]
+}
+
+// NewCachingSignerCreator creates a CachingSignerCreator which keeps up to size signers created by creator.
+func NewCachingSignerCreator(creator domain.SignerCreator, size int) *CachingSignerCreator {
+	return &CachingSignerCreator{
+		creator: creator,
+		signers: cache.NewLRU[signerKey, domain.Signer](size),
+	}
+}
+
+func (c *CachingSignerCreator) CreateSigner(deviceID uuid.UUID, key domain.DeviceKey) (domain.Signer, error) {
+	id := signerKey{deviceID: deviceID, version: key.Version}
+	if signer, ok := c.signers.Get(id); ok {
+		return signer, nil
+	}
+
+	signer, err := c.creator.CreateSigner(deviceID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.signers.Add(id, signer)
+
+	return signer, nil
+}
+
+// Forget drops the signers of the device, after its keys were changed.
+func (c *CachingSignerCreator) Forget(deviceID uuid.UUID) {
+	c.signers.RemoveFunc(func(id signerKey) bool {
+		return id.deviceID == deviceID
+	})
 }
 
 // ECCSigner is a signer implementation for ECC key pairs.
 type ECCSigner struct {
-	keyPair ECCKeyPair
+	private crypto.Signer
+	hash    crypto.Hash
 }
 
 func (es *ECCSigner) Sign(dataToBeSigned []byte) ([]byte, error) {
-	rawDataHash, err := hashData(dataToBeSigned)
+	rawDataHash, err := hashData(dataToBeSigned, es.hash)
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := es.keyPair.Private.Sign(rand.Reader, rawDataHash, crypto.SHA256)
+	data, err := es.private.Sign(rand.Reader, rawDataHash, es.hash)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign data: %w", err)
 	}
@@ -47,18 +94,20 @@ func (es *ECCSigner) Sign(dataToBeSigned []byte) ([]byte, error) {
 	return data, nil
 }
 
-// RSASigner is a signer implementation for RSA key pairs.
+// RSASigner is a signer implementation for RSA key pairs. The options select the padding, *rsa.PSSOptions for PSS and
+// the hash function for PKCS #1 v1.5.
 type RSASigner struct {
-	keyPair RSAKeyPair
+	private crypto.Signer
+	opts    crypto.SignerOpts
 }
 
 func (rs *RSASigner) Sign(dataToBeSigned []byte) ([]byte, error) {
-	rawDataHash, err := hashData(dataToBeSigned)
+	rawDataHash, err := hashData(dataToBeSigned, rs.opts.HashFunc())
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := rs.keyPair.Private.Sign(rand.Reader, rawDataHash, crypto.SHA256)
+	data, err := rs.private.Sign(rand.Reader, rawDataHash, rs.opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign data: %w", err)
 	}
@@ -66,12 +115,12 @@ func (rs *RSASigner) Sign(dataToBeSigned []byte) ([]byte, error) {
 	return data, nil
 }
 
-func hashData(data []byte) ([]byte, error) {
-	sha256Hash := sha256.New()
-	_, err := sha256Hash.Write(data)
+func hashData(data []byte, hash crypto.Hash) ([]byte, error) {
+	hasher := hash.New()
+	_, err := hasher.Write(data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash data: %w", err)
 	}
 
-	return sha256Hash.Sum(nil), nil
+	return hasher.Sum(nil), nil
 }
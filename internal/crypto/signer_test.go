@@ -0,0 +1,51 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingSignerCreator(t *testing.T) {
+	params := mustKeyParams(t, domain.AlgorithmECC)
+	kp, err := NewGenerator().GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+
+	deviceID := uuid.New()
+	key := domain.DeviceKey{Version: 1, KeyPair: kp, Algorithm: domain.AlgorithmECC, Params: params}
+
+	creator := NewCachingSignerCreator(NewSignerCreator(), 4)
+
+	signer, err := creator.CreateSigner(deviceID, key)
+	require.NoError(t, err)
+
+	cached, err := creator.CreateSigner(deviceID, key)
+	require.NoError(t, err)
+	require.Same(t, signer, cached)
+
+	// Signers are kept by device and key version
+	rotated := key
+	rotated.Version = 2
+	other, err := creator.CreateSigner(deviceID, rotated)
+	require.NoError(t, err)
+	require.NotSame(t, signer, other)
+
+	other, err = creator.CreateSigner(uuid.New(), key)
+	require.NoError(t, err)
+	require.NotSame(t, signer, other)
+
+	// Forgotten signers are created again
+	creator.Forget(deviceID)
+	recreated, err := creator.CreateSigner(deviceID, key)
+	require.NoError(t, err)
+	require.NotSame(t, signer, recreated)
+
+	_, err = creator.CreateSigner(uuid.New(), domain.DeviceKey{Params: params})
+	require.Error(t, err)
+
+	uncached, err := NewCachingSignerCreator(NewSignerCreator(), 0).CreateSigner(deviceID, key)
+	require.NoError(t, err)
+	require.NotSame(t, signer, uncached)
+}
@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+)
+
+type VerifierCreator struct{}
+
+func NewVerifierCreator() *VerifierCreator {
+	return &VerifierCreator{}
+}
+
+// CreateVerifier creates a new verifier for the public key of the given key pair.
+func (vc *VerifierCreator) CreateVerifier(kp domain.KeyPair, params domain.KeyParams) (domain.Verifier, error) {
+	algorithm, err := algorithmOf(kp)
+	if err != nil {
+		return nil, err
+	}
+
+	return algorithm.CreateVerifier(kp, params)
+}
+
+// ECCVerifier is a verifier implementation for signatures created by ECCSigner.
+type ECCVerifier struct {
+	public *ecdsa.PublicKey
+	hash   crypto.Hash
+}
+
+func (ev *ECCVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	rawDataHash, err := hashData(signedData, ev.hash)
+	if err != nil {
+		return false, err
+	}
+
+	return ecdsa.VerifyASN1(ev.public, rawDataHash, signature), nil
+}
+
+// RSAVerifier is a verifier implementation for signatures created by RSASigner.
+type RSAVerifier struct {
+	public *rsa.PublicKey
+	opts   crypto.SignerOpts
+}
+
+func (rv *RSAVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	hash := rv.opts.HashFunc()
+
+	rawDataHash, err := hashData(signedData, hash)
+	if err != nil {
+		return false, err
+	}
+
+	if pss, ok := rv.opts.(*rsa.PSSOptions); ok {
+		err = rsa.VerifyPSS(rv.public, hash, rawDataHash, signature, pss)
+	} else {
+		err = rsa.VerifyPKCS1v15(rv.public, hash, rawDataHash, signature)
+	}
+	if errors.Is(err, rsa.ErrVerification) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to verify signature: %w", err)
+	}
+
+	return true, nil
+}
@@ -2,74 +2,348 @@ package domain
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"slices"
+	"time"
 )
 
 type Algorithm string
 
 const (
-	AlgorithmECC Algorithm = "ECC"
-	AlgorithmRSA Algorithm = "RSA"
+	AlgorithmECC     Algorithm = "ECC"
+	AlgorithmRSA     Algorithm = "RSA"
+	AlgorithmED25519 Algorithm = "ED25519"
 )
 
 func (a Algorithm) String() string {
 	return string(a)
 }
 
+// Padding is the signature scheme of an RSA key pair.
+type Padding string
+
+const (
+	PaddingPKCS1v15 Padding = "PKCS1v15"
+	PaddingPSS      Padding = "PSS"
+)
+
+func (p Padding) String() string {
+	return string(p)
+}
+
+// Curve is the elliptic curve of an ECC key pair.
+type Curve string
+
+const (
+	CurveP256 Curve = "P-256"
+	CurveP384 Curve = "P-384"
+	CurveP521 Curve = "P-521"
+)
+
+func (c Curve) String() string {
+	return string(c)
+}
+
+// Hash is the hash function the data is hashed with before it is signed.
+type Hash string
+
+const (
+	HashSHA256 Hash = "SHA-256"
+	HashSHA384 Hash = "SHA-384"
+	HashSHA512 Hash = "SHA-512"
+)
+
+func (h Hash) String() string {
+	return string(h)
+}
+
+// KeyParams are the parameters a key pair is generated and used with. Only the ones which apply to the algorithm of
+// the key pair are set, the others are left empty.
+type KeyParams struct {
+	RSABits    int     // size of the modulus, RSA keys only
+	Padding    Padding // RSA keys only
+	SaltLength int     // in bytes, RSA keys with PSS padding only
+	Curve      Curve   // ECC keys only
+	Hash       Hash    // RSA and ECC keys only, Ed25519 hashes the data itself
+}
+
+// KeyPolicy limits the key parameters devices can use, on top of the ones the algorithms support.
+type KeyPolicy struct {
+	MinRSABits int     // 0 means no lower bound
+	Curves     []Curve // allowed curves, empty means all of them
+	Hashes     []Hash  // allowed hash functions, empty means all of them
+}
+
+// Check returns ErrInvalidKeyParams if the policy does not allow the parameters.
+func (p KeyPolicy) Check(params KeyParams) error {
+	if params.RSABits != 0 && params.RSABits < p.MinRSABits {
+		return fmt.Errorf("%w: RSA keys must have at least %d bits", ErrInvalidKeyParams, p.MinRSABits)
+	}
+
+	if params.Curve != "" && len(p.Curves) > 0 && !slices.Contains(p.Curves, params.Curve) {
+		return fmt.Errorf("%w: curve %s is not allowed", ErrInvalidKeyParams, params.Curve)
+	}
+
+	if params.Hash != "" && len(p.Hashes) > 0 && !slices.Contains(p.Hashes, params.Hash) {
+		return fmt.Errorf("%w: hash %s is not allowed", ErrInvalidKeyParams, params.Hash)
+	}
+
+	return nil
+}
+
+// Status is the lifecycle state of a device. Only active devices can sign data.
+type Status string
+
+const (
+	StatusActive         Status = "ACTIVE"
+	StatusDeactivated    Status = "DEACTIVATED"
+	StatusDecommissioned Status = "DECOMMISSIONED"
+)
+
+// statusTransitions lists the statuses a device can be moved to from each status. Decommissioning is final.
+var statusTransitions = map[Status][]Status{
+	StatusActive:      {StatusDeactivated, StatusDecommissioned},
+	StatusDeactivated: {StatusActive, StatusDecommissioned},
+}
+
+func (s Status) String() string {
+	return string(s)
+}
+
+// CanTransitionTo reports whether a device with this status can be moved to the next status.
+func (s Status) CanTransitionTo(next Status) bool {
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+
+	return false
+}
+
 type KeyPair interface {
 	IsKeyPair()
 }
 
+// JWK holds the public parameters of a key in the JSON Web Key format (RFC 7517). All the values are base64url
+// encoded as the format requires.
+type JWK struct {
+	KeyType   string // kty
+	Algorithm string // alg
+	Curve     string // crv, EC and OKP keys only
+	X         string // x, EC and OKP keys only
+	Y         string // y, EC keys only
+	Modulus   string // n, RSA keys only
+	Exponent  string // e, RSA keys only
+}
+
+// DeviceKey is a version of a device key pair.
+type DeviceKey struct {
+	Version   int
+	KeyPair   KeyPair
+	Algorithm Algorithm
+	Params    KeyParams
+	ValidFrom uint64 // counter of the first signature created with the key
+}
+
+// RetiredKey is a key pair which was used by a device before a key rotation. It is kept to verify the signatures
+// created while it was valid.
+type RetiredKey struct {
+	DeviceKey
+	ValidUntil uint64 // counter of the first signature created with the next key
+	RetiredAt  time.Time
+}
+
+// KeyRotation describes the key pair which replaces the current key of a device.
+type KeyRotation struct {
+	KeyPair   KeyPair
+	Algorithm Algorithm
+	Params    KeyParams
+	Version   int
+	ValidFrom uint64 // counter of the first signature created with the new key
+	RotatedAt time.Time
+}
+
 type Device struct {
 	ID               uuid.UUID
 	SignatureCounter uint64
-	KeyPair          KeyPair
-	Algorithm        Algorithm
+	KeyPair          KeyPair   // current key pair
+	Algorithm        Algorithm // algorithm of the current key pair
+	KeyParams        KeyParams // parameters of the current key pair
+	KeyVersion       int       // version of the current key pair, starts with 1
+	KeyValidFrom     uint64    // counter of the first signature created with the current key pair
+	RetiredKeys      []RetiredKey
 	Label            *string
+	Status           Status
+	CreatedAt        time.Time
+	StatusChangedAt  time.Time
+
+	// Devices imported from another system continue its signature chain. Both are empty for devices created here.
+	ImportedCounter   uint64 // signature counter the device was imported with
+	ImportedSignature string // base64 encoded last signature created before the import, empty if there was none
+}
+
+// ChainBase returns the signature the first signature of the device links to: the last one created before it was
+// imported, or the base64 encoded device ID.
+func (d Device) ChainBase() string {
+	if d.ImportedSignature != "" {
+		return d.ImportedSignature
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(d.ID.String()))
+}
+
+// KeyAt returns the key which was valid when the signature with the given counter was created.
+func (d Device) KeyAt(counter uint64) DeviceKey {
+	for _, key := range d.RetiredKeys {
+		if counter >= key.ValidFrom && counter < key.ValidUntil {
+			return key.DeviceKey
+		}
+	}
+
+	return d.CurrentKey()
+}
+
+// Keys returns the current key of the device followed by its retired keys.
+func (d Device) Keys() []DeviceKey {
+	keys := make([]DeviceKey, 0, len(d.RetiredKeys)+1)
+	keys = append(keys, d.CurrentKey())
+	for _, key := range d.RetiredKeys {
+		keys = append(keys, key.DeviceKey)
+	}
+
+	return keys
+}
+
+// Key returns the key with the given version. It returns ErrKeyNotFound if the device never had it.
+func (d Device) Key(version int) (DeviceKey, error) {
+	for _, key := range d.Keys() {
+		if key.Version == version {
+			return key, nil
+		}
+	}
+
+	return DeviceKey{}, fmt.Errorf("%w: device %s has no key version %d", ErrKeyNotFound, d.ID, version)
+}
+
+// CurrentKey returns the key the device signs with.
+func (d Device) CurrentKey() DeviceKey {
+	return DeviceKey{
+		Version:   d.KeyVersion,
+		KeyPair:   d.KeyPair,
+		Algorithm: d.Algorithm,
+		Params:    d.KeyParams,
+		ValidFrom: d.KeyValidFrom,
+	}
+}
+
+// DeviceCursor points to the last device of a page. Devices are ordered by creation time, then by ID.
+type DeviceCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// DeviceQuery filters and paginates devices.
+type DeviceQuery struct {
+	LabelPrefix string        // empty means any label
+	Algorithm   Algorithm     // empty means any algorithm
+	After       *DeviceCursor // cursor of the previous page, nil for the first page
+	Limit       int           // maximum number of devices, 0 means no limit
+}
+
+// DevicePage is a page of devices returned for a DeviceQuery.
+type DevicePage struct {
+	Devices []Device
+	Next    *DeviceCursor // cursor of the next page, nil if this is the last one
 }
 
 type DevicePersister interface {
+	RunTransaction(ctx context.Context, deviceID uuid.UUID, fn func(ctx context.Context) error) error
+
 	CreateDevice(ctx context.Context, device Device) error
 	IncrementSignatureCounter(ctx context.Context, id uuid.UUID) error
+	UpdateDeviceStatus(ctx context.Context, id uuid.UUID, status Status, changedAt time.Time) error
+	RotateDeviceKey(ctx context.Context, id uuid.UUID, rotation KeyRotation) error
 	GetDevices(ctx context.Context) ([]Device, error)
+	QueryDevices(ctx context.Context, query DeviceQuery) (DevicePage, error)
 	GetDevice(ctx context.Context, id uuid.UUID) (Device, error)
 }
 
 type KeyPairGenerator interface {
-	GenerateKeyPair(algorithm Algorithm) (KeyPair, error)
+	// KeyParams fills in the defaults of the algorithm for the parameters which are not set. It returns
+	// ErrInvalidKeyParams if the algorithm does not support them.
+	KeyParams(algorithm Algorithm, requested KeyParams) (KeyParams, error)
+	GenerateKeyPair(algorithm Algorithm, params KeyParams) (KeyPair, error)
+	// ImportKeyPair reads a private key of the algorithm created elsewhere, PEM encoded or DER encoded PKCS #8. It
+	// returns the key pair with the parameters given by the key, the RSA key size and the curve, and ErrInvalidImport
+	// if the key is not a key of the algorithm.
+	ImportKeyPair(algorithm Algorithm, privateKey []byte) (KeyPair, KeyParams, error)
+	// DiscardKeyPair deletes a generated or imported key pair which could not be stored. Key pairs which only live in
+	// memory need nothing to be done.
+	DiscardKeyPair(kp KeyPair) error
+}
+
+// DeviceImport describes a device moved from another system, with its private key and the state of its signature
+// chain.
+type DeviceImport struct {
+	Label      *string
+	Algorithm  Algorithm
+	KeyParams  KeyParams // the key size and the curve are taken from the key, the others get the algorithm defaults
+	PrivateKey []byte    // PEM encoded, or DER encoded PKCS #8
+
+	SignatureCounter uint64 // number of signatures created before
+	LastSignature    string // base64 encoded last signature, empty if none was created
 }
 
 type DeviceService struct {
 	logger    *zap.SugaredLogger
 	persister DevicePersister
 	generator KeyPairGenerator
+	policy    KeyPolicy
 }
 
-func NewDeviceService(logger *zap.SugaredLogger, persister DevicePersister, generator KeyPairGenerator) *DeviceService {
+func NewDeviceService(
+	logger *zap.SugaredLogger, persister DevicePersister, generator KeyPairGenerator, policy KeyPolicy,
+) *DeviceService {
 	return &DeviceService{
 		logger:    logger,
 		persister: persister,
 		generator: generator,
+		policy:    policy,
 	}
 }
 
-func (s *DeviceService) CreateDevice(ctx context.Context, label *string, algorithm Algorithm) (Device, error) {
-	keyPair, err := s.generator.GenerateKeyPair(algorithm)
+// CreateDevice creates a device with a new key pair. Key parameters which are not set get the algorithm defaults.
+func (s *DeviceService) CreateDevice(
+	ctx context.Context, label *string, algorithm Algorithm, requested KeyParams,
+) (Device, error) {
+	keyPair, params, err := s.generateKeyPair(algorithm, requested)
 	if err != nil {
 		return Device{}, err
 	}
 
+	now := time.Now()
 	device := Device{
 		ID:               uuid.New(),
 		SignatureCounter: 0,
 		KeyPair:          keyPair,
 		Algorithm:        algorithm,
+		KeyParams:        params,
+		KeyVersion:       1,
+		KeyValidFrom:     0,
 		Label:            label,
+		Status:           StatusActive,
+		CreatedAt:        now,
+		StatusChangedAt:  now,
 	}
 
 	err = s.persister.CreateDevice(ctx, device)
 	if err != nil {
+		s.discardKeyPair(keyPair)
+
 		return Device{}, err
 	}
 
@@ -78,6 +352,119 @@ func (s *DeviceService) CreateDevice(ctx context.Context, label *string, algorit
 	return device, nil
 }
 
+// ImportDevice creates a device with a key pair created elsewhere, which continues the signature chain of the system
+// it comes from: its next signature has the imported counter and links to the imported last signature.
+func (s *DeviceService) ImportDevice(ctx context.Context, imp DeviceImport) (Device, error) {
+	if imp.SignatureCounter == 0 && imp.LastSignature != "" {
+		return Device{}, fmt.Errorf("%w: a device without signatures has no last signature", ErrInvalidImport)
+	}
+	if imp.SignatureCounter != 0 && imp.LastSignature == "" {
+		return Device{}, fmt.Errorf("%w: the last signature is required", ErrInvalidImport)
+	}
+
+	// The signature is put in the data signed next, which must stay parseable
+	if _, err := base64.StdEncoding.DecodeString(imp.LastSignature); err != nil {
+		return Device{}, fmt.Errorf("%w: the last signature is not base64 encoded", ErrInvalidImport)
+	}
+
+	keyPair, keyParams, err := s.generator.ImportKeyPair(imp.Algorithm, imp.PrivateKey)
+	if err != nil {
+		return Device{}, err
+	}
+
+	params, err := s.importedKeyParams(imp.Algorithm, imp.KeyParams, keyParams)
+	if err != nil {
+		s.discardKeyPair(keyPair)
+
+		return Device{}, err
+	}
+
+	now := time.Now()
+	device := Device{
+		ID:                uuid.New(),
+		SignatureCounter:  imp.SignatureCounter,
+		KeyPair:           keyPair,
+		Algorithm:         imp.Algorithm,
+		KeyParams:         params,
+		KeyVersion:        1,
+		KeyValidFrom:      imp.SignatureCounter,
+		Label:             imp.Label,
+		Status:            StatusActive,
+		CreatedAt:         now,
+		StatusChangedAt:   now,
+		ImportedCounter:   imp.SignatureCounter,
+		ImportedSignature: imp.LastSignature,
+	}
+
+	err = s.persister.CreateDevice(ctx, device)
+	if err != nil {
+		s.discardKeyPair(keyPair)
+
+		return Device{}, err
+	}
+
+	s.logger.Infow("device imported",
+		"id", device.ID, "algorithm", device.Algorithm, "label", device.Label, "counter", device.SignatureCounter,
+	)
+
+	return device, nil
+}
+
+// importedKeyParams resolves the requested parameters of an imported key pair and checks them against the policy.
+// The key size and the curve are the ones of the key, they may only be requested if they match.
+func (s *DeviceService) importedKeyParams(algorithm Algorithm, requested, key KeyParams) (KeyParams, error) {
+	if requested.RSABits != 0 && requested.RSABits != key.RSABits {
+		return KeyParams{}, fmt.Errorf("%w: the key has %d bits, not %d", ErrInvalidKeyParams, key.RSABits, requested.RSABits)
+	}
+	if requested.Curve != "" && requested.Curve != key.Curve {
+		return KeyParams{}, fmt.Errorf("%w: the key is on curve %s, not %s", ErrInvalidKeyParams, key.Curve, requested.Curve)
+	}
+
+	requested.RSABits = key.RSABits
+	requested.Curve = key.Curve
+
+	params, err := s.generator.KeyParams(algorithm, requested)
+	if err != nil {
+		return KeyParams{}, err
+	}
+
+	err = s.policy.Check(params)
+	if err != nil {
+		return KeyParams{}, err
+	}
+
+	return params, nil
+}
+
+// generateKeyPair resolves the requested key parameters, checks them against the policy and generates a key pair
+// with them.
+func (s *DeviceService) generateKeyPair(algorithm Algorithm, requested KeyParams) (KeyPair, KeyParams, error) {
+	params, err := s.generator.KeyParams(algorithm, requested)
+	if err != nil {
+		return nil, KeyParams{}, err
+	}
+
+	err = s.policy.Check(params)
+	if err != nil {
+		return nil, KeyParams{}, err
+	}
+
+	keyPair, err := s.generator.GenerateKeyPair(algorithm, params)
+	if err != nil {
+		return nil, KeyParams{}, err
+	}
+
+	return keyPair, params, nil
+}
+
+// discardKeyPair deletes a key pair which could not be stored, so it is not left behind in the key backend. The error
+// the key pair could not be stored with is returned anyway, a failure to delete it is only logged.
+func (s *DeviceService) discardKeyPair(kp KeyPair) {
+	if err := s.generator.DiscardKeyPair(kp); err != nil {
+		s.logger.Errorw("failed to discard key pair", "error", err)
+	}
+}
+
 func (s *DeviceService) IncrementSignatureCounter(ctx context.Context, id uuid.UUID) error {
 	return s.persister.IncrementSignatureCounter(ctx, id)
 }
@@ -86,6 +473,110 @@ func (s *DeviceService) GetDevices(ctx context.Context) ([]Device, error) {
 	return s.persister.GetDevices(ctx)
 }
 
+// QueryDevices returns a page of the devices matching the query.
+func (s *DeviceService) QueryDevices(ctx context.Context, query DeviceQuery) (DevicePage, error) {
+	return s.persister.QueryDevices(ctx, query)
+}
+
 func (s *DeviceService) GetDevice(ctx context.Context, id uuid.UUID) (Device, error) {
 	return s.persister.GetDevice(ctx, id)
 }
+
+// ChangeStatus moves the device to the given status if the transition is allowed, see Status.CanTransitionTo.
+func (s *DeviceService) ChangeStatus(ctx context.Context, id uuid.UUID, status Status) (Device, error) {
+	var device Device
+
+	err := s.persister.RunTransaction(ctx, id, func(ctx context.Context) error {
+		current, err := s.persister.GetDevice(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if !current.Status.CanTransitionTo(status) {
+			return &StatusTransitionError{From: current.Status, To: status}
+		}
+
+		changedAt := time.Now()
+
+		err = s.persister.UpdateDeviceStatus(ctx, id, status, changedAt)
+		if err != nil {
+			return fmt.Errorf("failed to update device status: %w", err)
+		}
+
+		device = current
+		device.Status = status
+		device.StatusChangedAt = changedAt
+
+		return nil
+	})
+	if err != nil {
+		return Device{}, err
+	}
+
+	s.logger.Infow("device status changed", "id", id, "status", status)
+
+	return device, nil
+}
+
+// RotateKey replaces the device key pair with a newly generated one. The current key pair is retired, but kept to
+// verify the signatures it created. The signature chain is not affected: the first signature created with the new key
+// links to the last signature created with the old one.
+func (s *DeviceService) RotateKey(
+	ctx context.Context, id uuid.UUID, algorithm Algorithm, requested KeyParams,
+) (Device, error) {
+	// Key generation can take a while, so it is done before the device is locked
+	keyPair, params, err := s.generateKeyPair(algorithm, requested)
+	if err != nil {
+		return Device{}, err
+	}
+
+	var device Device
+
+	err = s.persister.RunTransaction(ctx, id, func(ctx context.Context) error {
+		current, err := s.persister.GetDevice(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if current.Status == StatusDecommissioned {
+			return &DeviceInactiveError{ID: current.ID, Status: current.Status}
+		}
+
+		rotation := KeyRotation{
+			KeyPair:   keyPair,
+			Algorithm: algorithm,
+			Params:    params,
+			Version:   current.KeyVersion + 1,
+			ValidFrom: current.SignatureCounter,
+			RotatedAt: time.Now(),
+		}
+
+		err = s.persister.RotateDeviceKey(ctx, id, rotation)
+		if err != nil {
+			return fmt.Errorf("failed to rotate device key: %w", err)
+		}
+
+		device = current
+		device.RetiredKeys = append(device.RetiredKeys, RetiredKey{
+			DeviceKey:  current.CurrentKey(),
+			ValidUntil: rotation.ValidFrom,
+			RetiredAt:  rotation.RotatedAt,
+		})
+		device.KeyPair = rotation.KeyPair
+		device.Algorithm = rotation.Algorithm
+		device.KeyParams = rotation.Params
+		device.KeyVersion = rotation.Version
+		device.KeyValidFrom = rotation.ValidFrom
+
+		return nil
+	})
+	if err != nil {
+		s.discardKeyPair(keyPair)
+
+		return Device{}, err
+	}
+
+	s.logger.Infow("device key rotated", "id", id, "algorithm", algorithm, "version", device.KeyVersion)
+
+	return device, nil
+}
@@ -3,7 +3,9 @@ package domain
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -15,6 +17,27 @@ type MockDevicePersister struct {
 	mock.Mock
 }
 
+func (m *MockDevicePersister) RunTransaction(ctx context.Context, deviceID uuid.UUID, fn func(ctx context.Context) error) error {
+	args := m.Called(ctx, deviceID, fn)
+
+	err := fn(ctx)
+	if err != nil {
+		return err
+	}
+
+	return args.Error(0)
+}
+
+func (m *MockDevicePersister) UpdateDeviceStatus(ctx context.Context, id uuid.UUID, status Status, changedAt time.Time) error {
+	args := m.Called(ctx, id, status, changedAt)
+	return args.Error(0)
+}
+
+func (m *MockDevicePersister) RotateDeviceKey(ctx context.Context, id uuid.UUID, rotation KeyRotation) error {
+	args := m.Called(ctx, id, rotation)
+	return args.Error(0)
+}
+
 func (m *MockDevicePersister) CreateDevice(ctx context.Context, device Device) error {
 	args := m.Called(ctx, device)
 	return args.Error(0)
@@ -33,6 +56,11 @@ func (m *MockDevicePersister) GetDevices(ctx context.Context) ([]Device, error)
 	return args.Get(0).([]Device), args.Error(1)
 }
 
+func (m *MockDevicePersister) QueryDevices(ctx context.Context, query DeviceQuery) (DevicePage, error) {
+	args := m.Called(ctx, query)
+	return args.Get(0).(DevicePage), args.Error(1)
+}
+
 func (m *MockDevicePersister) GetDevice(ctx context.Context, id uuid.UUID) (Device, error) {
 	args := m.Called(ctx, id)
 	return args.Get(0).(Device), args.Error(1)
@@ -42,14 +70,32 @@ type MockKeyPairGenerator struct {
 	mock.Mock
 }
 
-func (m *MockKeyPairGenerator) GenerateKeyPair(algorithm Algorithm) (KeyPair, error) {
-	args := m.Called(algorithm)
+func (m *MockKeyPairGenerator) KeyParams(algorithm Algorithm, requested KeyParams) (KeyParams, error) {
+	args := m.Called(algorithm, requested)
+	return args.Get(0).(KeyParams), args.Error(1)
+}
+
+func (m *MockKeyPairGenerator) GenerateKeyPair(algorithm Algorithm, params KeyParams) (KeyPair, error) {
+	args := m.Called(algorithm, params)
 	if args.Get(0) == nil {
 		return &MockKeyPair{}, args.Error(1)
 	}
 	return args.Get(0).(KeyPair), args.Error(1)
 }
 
+func (m *MockKeyPairGenerator) ImportKeyPair(algorithm Algorithm, privateKey []byte) (KeyPair, KeyParams, error) {
+	args := m.Called(algorithm, privateKey)
+	if args.Get(0) == nil {
+		return nil, args.Get(1).(KeyParams), args.Error(2)
+	}
+	return args.Get(0).(KeyPair), args.Get(1).(KeyParams), args.Error(2)
+}
+
+func (m *MockKeyPairGenerator) DiscardKeyPair(kp KeyPair) error {
+	args := m.Called(kp)
+	return args.Error(0)
+}
+
 type MockKeyPair struct {
 	mock.Mock
 }
@@ -60,22 +106,28 @@ func TestDeviceService_CreateDevice_Success(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
 	generator := new(MockKeyPairGenerator)
-	service := NewDeviceService(logger, persister, generator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
 
 	ctx := context.Background()
 	label := "test-device"
 	algorithm := AlgorithmRSA
 	keyPair := new(MockKeyPair)
 
-	generator.On("GenerateKeyPair", algorithm).Return(keyPair, nil)
+	params := KeyParams{RSABits: 2048, Hash: HashSHA256}
+
+	generator.On("KeyParams", algorithm, KeyParams{}).Return(params, nil)
+	generator.On("GenerateKeyPair", algorithm, params).Return(keyPair, nil)
 	persister.On("CreateDevice", ctx, mock.AnythingOfType("Device")).Return(nil)
 
-	device, err := service.CreateDevice(ctx, &label, algorithm)
+	device, err := service.CreateDevice(ctx, &label, algorithm, KeyParams{})
 
 	assert.NoError(t, err)
 	assert.NotNil(t, device)
 	assert.Equal(t, algorithm, device.Algorithm)
+	assert.Equal(t, params, device.KeyParams)
 	assert.Equal(t, &label, device.Label)
+	assert.Equal(t, StatusActive, device.Status)
+	assert.False(t, device.CreatedAt.IsZero())
 	generator.AssertExpectations(t)
 	persister.AssertExpectations(t)
 }
@@ -84,15 +136,16 @@ func TestDeviceService_CreateDevice_GenerateKeyPairError(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
 	generator := new(MockKeyPairGenerator)
-	service := NewDeviceService(logger, persister, generator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
 
 	ctx := context.Background()
 	label := "test-device"
 	algorithm := AlgorithmRSA
 
-	generator.On("GenerateKeyPair", algorithm).Return(nil, errors.New("key pair generation error"))
+	generator.On("KeyParams", algorithm, KeyParams{}).Return(KeyParams{}, nil)
+	generator.On("GenerateKeyPair", algorithm, KeyParams{}).Return(nil, errors.New("key pair generation error"))
 
-	device, err := service.CreateDevice(ctx, &label, algorithm)
+	device, err := service.CreateDevice(ctx, &label, algorithm, KeyParams{})
 
 	assert.Error(t, err)
 	assert.EqualError(t, err, "key pair generation error")
@@ -105,17 +158,20 @@ func TestDeviceService_CreateDevice_PersisterError(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
 	generator := new(MockKeyPairGenerator)
-	service := NewDeviceService(logger, persister, generator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
 
 	ctx := context.Background()
 	label := "test-device"
 	algorithm := AlgorithmRSA
 	keyPair := new(MockKeyPair)
 
-	generator.On("GenerateKeyPair", algorithm).Return(keyPair, nil)
+	generator.On("KeyParams", algorithm, KeyParams{}).Return(KeyParams{}, nil)
+	generator.On("GenerateKeyPair", algorithm, KeyParams{}).Return(keyPair, nil)
 	persister.On("CreateDevice", ctx, mock.AnythingOfType("Device")).Return(errors.New("persister error"))
+	// The key pair is not left behind in the key backend
+	generator.On("DiscardKeyPair", keyPair).Return(nil)
 
-	device, err := service.CreateDevice(ctx, &label, algorithm)
+	device, err := service.CreateDevice(ctx, &label, algorithm, KeyParams{})
 
 	assert.Error(t, err)
 	assert.EqualError(t, err, "persister error")
@@ -124,10 +180,179 @@ func TestDeviceService_CreateDevice_PersisterError(t *testing.T) {
 	persister.AssertExpectations(t)
 }
 
+func TestDeviceService_CreateDevice_KeyPolicy(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	generator := new(MockKeyPairGenerator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{MinRSABits: 3072})
+
+	ctx := context.Background()
+	params := KeyParams{RSABits: 2048, Hash: HashSHA256}
+
+	generator.On("KeyParams", AlgorithmRSA, KeyParams{}).Return(params, nil)
+
+	device, err := service.CreateDevice(ctx, nil, AlgorithmRSA, KeyParams{})
+
+	assert.ErrorIs(t, err, ErrInvalidKeyParams)
+	assert.Equal(t, Device{}, device)
+	generator.AssertNotCalled(t, "GenerateKeyPair", mock.Anything, mock.Anything)
+	persister.AssertNotCalled(t, "CreateDevice", mock.Anything, mock.Anything)
+}
+
+func TestDeviceService_ImportDevice_Success(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	generator := new(MockKeyPairGenerator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
+
+	ctx := context.Background()
+	label := "imported-device"
+	keyPair := new(MockKeyPair)
+	privateKey := []byte("private key")
+	params := KeyParams{Curve: CurveP256, Hash: HashSHA256}
+
+	generator.On("ImportKeyPair", AlgorithmECC, privateKey).Return(keyPair, KeyParams{Curve: CurveP256}, nil)
+	generator.On("KeyParams", AlgorithmECC, KeyParams{Curve: CurveP256}).Return(params, nil)
+	persister.On("CreateDevice", ctx, mock.AnythingOfType("Device")).Return(nil)
+
+	device, err := service.ImportDevice(ctx, DeviceImport{
+		Label:            &label,
+		Algorithm:        AlgorithmECC,
+		PrivateKey:       privateKey,
+		SignatureCounter: 42,
+		LastSignature:    "bGFzdA==",
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, keyPair, device.KeyPair)
+	assert.Equal(t, params, device.KeyParams)
+	assert.Equal(t, &label, device.Label)
+	assert.Equal(t, StatusActive, device.Status)
+	assert.Equal(t, uint64(42), device.SignatureCounter)
+	assert.Equal(t, uint64(42), device.KeyValidFrom)
+	assert.Equal(t, uint64(42), device.ImportedCounter)
+	assert.Equal(t, "bGFzdA==", device.ChainBase())
+	generator.AssertExpectations(t)
+	persister.AssertCalled(t, "CreateDevice", ctx, device)
+}
+
+func TestDeviceService_ImportDevice_Invalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		imp       DeviceImport
+		wantErr   error
+		discarded bool // whether the imported key pair is discarded
+	}{
+		{
+			name:    "last signature without signatures",
+			imp:     DeviceImport{Algorithm: AlgorithmECC, LastSignature: "bGFzdA=="},
+			wantErr: ErrInvalidImport,
+		},
+		{
+			name:    "missing last signature",
+			imp:     DeviceImport{Algorithm: AlgorithmECC, SignatureCounter: 1},
+			wantErr: ErrInvalidImport,
+		},
+		{
+			name:    "last signature not base64 encoded",
+			imp:     DeviceImport{Algorithm: AlgorithmECC, SignatureCounter: 1, LastSignature: "not base64!"},
+			wantErr: ErrInvalidImport,
+		},
+		{
+			name:      "requested curve does not match the key",
+			imp:       DeviceImport{Algorithm: AlgorithmECC, KeyParams: KeyParams{Curve: CurveP384}},
+			wantErr:   ErrInvalidKeyParams,
+			discarded: true,
+		},
+		{
+			name:      "key not allowed by the policy",
+			imp:       DeviceImport{Algorithm: AlgorithmECC, KeyParams: KeyParams{Hash: HashSHA512}},
+			wantErr:   ErrInvalidKeyParams,
+			discarded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := zap.NewNop().Sugar()
+			persister := new(MockDevicePersister)
+			generator := new(MockKeyPairGenerator)
+			service := NewDeviceService(logger, persister, generator, KeyPolicy{Hashes: []Hash{HashSHA256}})
+
+			keyPair := new(MockKeyPair)
+			generator.On("ImportKeyPair", AlgorithmECC, mock.Anything).
+				Return(keyPair, KeyParams{Curve: CurveP256}, nil)
+			generator.On("KeyParams", AlgorithmECC, mock.Anything).
+				Return(KeyParams{Curve: CurveP256, Hash: HashSHA512}, nil)
+			generator.On("DiscardKeyPair", keyPair).Return(nil)
+
+			device, err := service.ImportDevice(context.Background(), tt.imp)
+
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, Device{}, device)
+			persister.AssertNotCalled(t, "CreateDevice", mock.Anything, mock.Anything)
+			if tt.discarded {
+				generator.AssertCalled(t, "DiscardKeyPair", keyPair)
+			} else {
+				generator.AssertNotCalled(t, "DiscardKeyPair", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestDeviceService_ImportDevice_ImportKeyPairError(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	generator := new(MockKeyPairGenerator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
+
+	importErr := fmt.Errorf("%w: not an RSA key", ErrInvalidImport)
+	generator.On("ImportKeyPair", AlgorithmRSA, mock.Anything).Return(nil, KeyParams{}, importErr)
+
+	device, err := service.ImportDevice(context.Background(), DeviceImport{Algorithm: AlgorithmRSA})
+
+	assert.ErrorIs(t, err, ErrInvalidImport)
+	assert.Equal(t, Device{}, device)
+	persister.AssertNotCalled(t, "CreateDevice", mock.Anything, mock.Anything)
+}
+
+func TestKeyPolicy_Check(t *testing.T) {
+	policy := KeyPolicy{
+		MinRSABits: 3072,
+		Curves:     []Curve{CurveP384, CurveP521},
+		Hashes:     []Hash{HashSHA384, HashSHA512},
+	}
+
+	tests := []struct {
+		name    string
+		policy  KeyPolicy
+		params  KeyParams
+		wantErr bool
+	}{
+		{name: "allowed RSA", policy: policy, params: KeyParams{RSABits: 4096, Hash: HashSHA512}},
+		{name: "allowed ECC", policy: policy, params: KeyParams{Curve: CurveP384, Hash: HashSHA384}},
+		{name: "no params", policy: policy, params: KeyParams{}},
+		{name: "small RSA key", policy: policy, params: KeyParams{RSABits: 2048, Hash: HashSHA512}, wantErr: true},
+		{name: "curve", policy: policy, params: KeyParams{Curve: CurveP256, Hash: HashSHA384}, wantErr: true},
+		{name: "hash", policy: policy, params: KeyParams{Curve: CurveP384, Hash: HashSHA256}, wantErr: true},
+		{name: "empty policy", policy: KeyPolicy{}, params: KeyParams{RSABits: 2048, Hash: HashSHA256}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.params)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidKeyParams)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestDeviceService_IncrementSignatureCounter_Success(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
-	service := NewDeviceService(logger, persister, nil)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
 
 	ctx := context.Background()
 	id := uuid.New()
@@ -143,7 +368,7 @@ func TestDeviceService_IncrementSignatureCounter_Success(t *testing.T) {
 func TestDeviceService_IncrementSignatureCounter_PersisterError(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
-	service := NewDeviceService(logger, persister, nil)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
 
 	ctx := context.Background()
 	id := uuid.New()
@@ -160,7 +385,7 @@ func TestDeviceService_IncrementSignatureCounter_PersisterError(t *testing.T) {
 func TestDeviceService_GetDevices_Success(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
-	service := NewDeviceService(logger, persister, nil)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
 
 	ctx := context.Background()
 	devices := []Device{
@@ -180,7 +405,7 @@ func TestDeviceService_GetDevices_Success(t *testing.T) {
 func TestDeviceService_GetDevices_PersisterError(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
-	service := NewDeviceService(logger, persister, nil)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
 
 	ctx := context.Background()
 
@@ -197,7 +422,7 @@ func TestDeviceService_GetDevices_PersisterError(t *testing.T) {
 func TestDeviceService_GetDevice_Success(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
-	service := NewDeviceService(logger, persister, nil)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
 
 	ctx := context.Background()
 	id := uuid.New()
@@ -215,7 +440,7 @@ func TestDeviceService_GetDevice_Success(t *testing.T) {
 func TestDeviceService_GetDevice_PersisterError(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	persister := new(MockDevicePersister)
-	service := NewDeviceService(logger, persister, nil)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
 
 	ctx := context.Background()
 	id := uuid.New()
@@ -229,3 +454,251 @@ func TestDeviceService_GetDevice_PersisterError(t *testing.T) {
 	assert.Equal(t, Device{}, result)
 	persister.AssertExpectations(t)
 }
+
+func TestDeviceService_ChangeStatus_Success(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
+
+	ctx := context.Background()
+	id := uuid.New()
+	device := Device{ID: id, Algorithm: AlgorithmRSA, Status: StatusActive}
+
+	persister.On("RunTransaction", ctx, id, mock.Anything).Return(nil)
+	persister.On("GetDevice", ctx, id).Return(device, nil)
+	persister.On("UpdateDeviceStatus", ctx, id, StatusDeactivated, mock.AnythingOfType("time.Time")).Return(nil)
+
+	result, err := service.ChangeStatus(ctx, id, StatusDeactivated)
+
+	assert.NoError(t, err)
+	assert.Equal(t, StatusDeactivated, result.Status)
+	assert.WithinDuration(t, time.Now(), result.StatusChangedAt, time.Second)
+	persister.AssertExpectations(t)
+}
+
+func TestDeviceService_ChangeStatus_Transitions(t *testing.T) {
+	tests := []struct {
+		from    Status
+		to      Status
+		allowed bool
+	}{
+		{from: StatusActive, to: StatusDeactivated, allowed: true},
+		{from: StatusActive, to: StatusDecommissioned, allowed: true},
+		{from: StatusActive, to: StatusActive, allowed: false},
+		{from: StatusDeactivated, to: StatusActive, allowed: true},
+		{from: StatusDeactivated, to: StatusDecommissioned, allowed: true},
+		{from: StatusDecommissioned, to: StatusActive, allowed: false},
+		{from: StatusDecommissioned, to: StatusDeactivated, allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s to %s", tt.from, tt.to), func(t *testing.T) {
+			logger := zap.NewNop().Sugar()
+			persister := new(MockDevicePersister)
+			service := NewDeviceService(logger, persister, nil, KeyPolicy{})
+
+			ctx := context.Background()
+			id := uuid.New()
+
+			persister.On("RunTransaction", ctx, id, mock.Anything).Return(nil)
+			persister.On("GetDevice", ctx, id).Return(Device{ID: id, Status: tt.from}, nil)
+			persister.On("UpdateDeviceStatus", ctx, id, tt.to, mock.Anything).Return(nil)
+
+			_, err := service.ChangeStatus(ctx, id, tt.to)
+
+			if tt.allowed {
+				assert.NoError(t, err)
+				return
+			}
+
+			var transitionErr *StatusTransitionError
+			assert.ErrorAs(t, err, &transitionErr)
+			assert.ErrorIs(t, err, ErrConflict)
+			persister.AssertNotCalled(t, "UpdateDeviceStatus", ctx, id, tt.to, mock.Anything)
+		})
+	}
+}
+
+func TestDeviceService_ChangeStatus_PersisterError(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
+
+	ctx := context.Background()
+	id := uuid.New()
+
+	persister.On("RunTransaction", ctx, id, mock.Anything).Return(nil)
+	persister.On("GetDevice", ctx, id).Return(Device{ID: id, Status: StatusActive}, nil)
+	persister.On("UpdateDeviceStatus", ctx, id, StatusDecommissioned, mock.Anything).Return(errors.New("persister error"))
+
+	result, err := service.ChangeStatus(ctx, id, StatusDecommissioned)
+
+	assert.Error(t, err)
+	assert.Equal(t, Device{}, result)
+}
+
+func TestDeviceService_RotateKey_Success(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	generator := new(MockKeyPairGenerator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
+
+	ctx := context.Background()
+	id := uuid.New()
+	oldKeyPair := new(MockKeyPair)
+	newKeyPair := new(MockKeyPair)
+	device := Device{
+		ID:               id,
+		SignatureCounter: 5,
+		KeyPair:          oldKeyPair,
+		Algorithm:        AlgorithmRSA,
+		KeyVersion:       1,
+		Status:           StatusActive,
+	}
+
+	params := KeyParams{Curve: CurveP256, Hash: HashSHA256}
+
+	generator.On("KeyParams", AlgorithmECC, KeyParams{Curve: CurveP256}).Return(params, nil)
+	generator.On("GenerateKeyPair", AlgorithmECC, params).Return(newKeyPair, nil)
+	persister.On("RunTransaction", ctx, id, mock.Anything).Return(nil)
+	persister.On("GetDevice", ctx, id).Return(device, nil)
+	persister.On("RotateDeviceKey", ctx, id, mock.MatchedBy(func(rotation KeyRotation) bool {
+		return rotation.KeyPair == newKeyPair && rotation.Algorithm == AlgorithmECC && rotation.Params == params &&
+			rotation.Version == 2 && rotation.ValidFrom == 5
+	})).Return(nil)
+
+	result, err := service.RotateKey(ctx, id, AlgorithmECC, KeyParams{Curve: CurveP256})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.KeyVersion)
+	assert.Equal(t, AlgorithmECC, result.Algorithm)
+	assert.Equal(t, params, result.KeyParams)
+	assert.Equal(t, uint64(5), result.KeyValidFrom)
+	assert.Len(t, result.RetiredKeys, 1)
+	assert.Equal(t, 1, result.RetiredKeys[0].Version)
+	assert.Equal(t, uint64(0), result.RetiredKeys[0].ValidFrom)
+	assert.Equal(t, uint64(5), result.RetiredKeys[0].ValidUntil)
+	persister.AssertExpectations(t)
+	generator.AssertExpectations(t)
+}
+
+func TestDeviceService_RotateKey_Decommissioned(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	generator := new(MockKeyPairGenerator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
+
+	ctx := context.Background()
+	id := uuid.New()
+
+	keyPair := new(MockKeyPair)
+	generator.On("KeyParams", AlgorithmECC, KeyParams{}).Return(KeyParams{}, nil)
+	generator.On("GenerateKeyPair", AlgorithmECC, KeyParams{}).Return(keyPair, nil)
+	generator.On("DiscardKeyPair", keyPair).Return(nil)
+	persister.On("RunTransaction", ctx, id, mock.Anything).Return(nil)
+	persister.On("GetDevice", ctx, id).Return(Device{ID: id, Status: StatusDecommissioned}, nil)
+
+	result, err := service.RotateKey(ctx, id, AlgorithmECC, KeyParams{})
+
+	var inactiveErr *DeviceInactiveError
+	assert.ErrorAs(t, err, &inactiveErr)
+	assert.ErrorIs(t, err, ErrDeviceInactive)
+	assert.Equal(t, Device{}, result)
+	persister.AssertNotCalled(t, "RotateDeviceKey", mock.Anything, mock.Anything, mock.Anything)
+	// The new key pair is not left behind in the key backend
+	generator.AssertCalled(t, "DiscardKeyPair", keyPair)
+}
+
+func TestDeviceService_RotateKey_GenerateKeyPairError(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	generator := new(MockKeyPairGenerator)
+	service := NewDeviceService(logger, persister, generator, KeyPolicy{})
+
+	ctx := context.Background()
+	id := uuid.New()
+
+	generator.On("KeyParams", AlgorithmECC, KeyParams{}).Return(KeyParams{}, nil)
+	generator.On("GenerateKeyPair", AlgorithmECC, KeyParams{}).Return(nil, errors.New("generator error"))
+
+	result, err := service.RotateKey(ctx, id, AlgorithmECC, KeyParams{})
+
+	assert.EqualError(t, err, "generator error")
+	assert.Equal(t, Device{}, result)
+	persister.AssertNotCalled(t, "RunTransaction", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDevice_KeyAt(t *testing.T) {
+	first := new(MockKeyPair)
+	second := new(MockKeyPair)
+	current := new(MockKeyPair)
+	device := Device{
+		KeyPair:      current,
+		KeyVersion:   3,
+		KeyValidFrom: 7,
+		RetiredKeys: []RetiredKey{
+			{DeviceKey: DeviceKey{Version: 1, KeyPair: first, ValidFrom: 0}, ValidUntil: 4},
+			{DeviceKey: DeviceKey{Version: 2, KeyPair: second, ValidFrom: 4}, ValidUntil: 7},
+		},
+	}
+
+	tests := []struct {
+		counter uint64
+		version int
+	}{
+		{counter: 0, version: 1},
+		{counter: 3, version: 1},
+		{counter: 4, version: 2},
+		{counter: 6, version: 2},
+		{counter: 7, version: 3},
+		{counter: 100, version: 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("counter %d", tt.counter), func(t *testing.T) {
+			assert.Equal(t, tt.version, device.KeyAt(tt.counter).Version)
+		})
+	}
+}
+
+func TestDevice_Keys(t *testing.T) {
+	retired := new(MockKeyPair)
+	current := new(MockKeyPair)
+	device := Device{
+		KeyPair:      current,
+		KeyVersion:   2,
+		KeyValidFrom: 4,
+		RetiredKeys: []RetiredKey{
+			{DeviceKey: DeviceKey{Version: 1, KeyPair: retired, ValidFrom: 0}, ValidUntil: 4},
+		},
+	}
+
+	keys := device.Keys()
+	assert.Len(t, keys, 2)
+	assert.Equal(t, device.CurrentKey(), keys[0])
+	assert.Same(t, current, keys[0].KeyPair)
+	assert.Same(t, retired, keys[1].KeyPair)
+
+	key, err := device.Key(1)
+	assert.NoError(t, err)
+	assert.Same(t, retired, key.KeyPair)
+
+	_, err = device.Key(3)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestDeviceService_QueryDevices(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockDevicePersister)
+	service := NewDeviceService(logger, persister, nil, KeyPolicy{})
+
+	ctx := context.Background()
+	query := DeviceQuery{LabelPrefix: "till", Algorithm: AlgorithmECC, Limit: 10}
+	page := DevicePage{Devices: []Device{{ID: uuid.New(), Algorithm: AlgorithmECC}}}
+
+	persister.On("QueryDevices", ctx, query).Return(page, nil)
+
+	result, err := service.QueryDevices(ctx, query)
+
+	assert.NoError(t, err)
+	assert.Equal(t, page, result)
+	persister.AssertExpectations(t)
+}
@@ -0,0 +1,81 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+)
+
+// Sentinel errors returned by the services and persisters. Callers should check them with errors.Is, as they are
+// usually wrapped with more context.
+var (
+	ErrDeviceNotFound    = errors.New("device not found")
+	ErrSignatureNotFound = errors.New("signature not found")
+	ErrKeyNotFound       = errors.New("key not found")
+	ErrInvalidAlgorithm  = errors.New("invalid algorithm")
+	ErrInvalidKeyParams  = errors.New("invalid key parameters")
+	ErrInvalidImport     = errors.New("invalid device import")
+	ErrDeviceInactive    = errors.New("device is not active")
+	ErrConflict          = errors.New("conflict")
+
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+)
+
+// DeviceInactiveError is returned when a device which is not active is asked to sign data. It matches
+// ErrDeviceInactive.
+type DeviceInactiveError struct {
+	ID     uuid.UUID
+	Status Status
+}
+
+func (e *DeviceInactiveError) Error() string {
+	return fmt.Sprintf("device %s is not active, its status is %s", e.ID, e.Status)
+}
+
+func (e *DeviceInactiveError) Is(target error) bool {
+	return target == ErrDeviceInactive
+}
+
+// StatusTransitionError is returned when a device can not be moved from its current status to the requested one. It
+// matches ErrConflict.
+type StatusTransitionError struct {
+	From Status
+	To   Status
+}
+
+func (e *StatusTransitionError) Error() string {
+	return fmt.Sprintf("device status can not be changed from %s to %s", e.From, e.To)
+}
+
+func (e *StatusTransitionError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// IdempotencyKeyReusedError is returned when an idempotency key is sent again with different data than the first time.
+// It matches ErrConflict.
+type IdempotencyKeyReusedError struct {
+	Key string
+}
+
+func (e *IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("idempotency key %q was already used with different data", e.Key)
+}
+
+func (e *IdempotencyKeyReusedError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// BatchItemError is returned when a transaction of a batch signed in BatchAllOrNothing mode fails. It wraps the error
+// of the transaction.
+type BatchItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("transaction %d of the batch: %s", e.Index, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
@@ -2,15 +2,73 @@ package domain
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type SignedData struct {
-	Signature    string // base64 encoded signature
-	OriginalData string // original data used for signing
+	DeviceID     uuid.UUID
+	Counter      uint64    // value of the device signature counter the data was signed with
+	Signature    string    // base64 encoded signature
+	OriginalData string    // original data used for signing
+	Algorithm    Algorithm // algorithm of the key the data was signed with
+	KeyVersion   int       // version of the device key the data was signed with
+	SignedAt     time.Time
+}
+
+// IdempotencyKey remembers the signature created for a client provided key, so a retried request returns that
+// signature instead of signing the data again.
+type IdempotencyKey struct {
+	Key         string
+	PayloadHash string // hex encoded SHA-256 of the data sent with the key
+	Counter     uint64 // counter of the signature created for the key
+	CreatedAt   time.Time
+}
+
+// BatchMode decides what happens to a batch of transactions when one of them can not be signed.
+type BatchMode string
+
+const (
+	BatchAllOrNothing BatchMode = "all_or_nothing" // nothing is signed, the batch fails
+	BatchBestEffort   BatchMode = "best_effort"    // the other transactions are signed anyway
+)
+
+// BatchResult is the outcome of signing one transaction of a batch. Either Signature or Err is set.
+type BatchResult struct {
+	Signature *SignedData
+	Err       error
+}
+
+// ChainAudit is the result of checking the whole signature chain of a device.
+type ChainAudit struct {
+	Valid       bool
+	Checked     int    // number of signatures found intact
+	BrokenIndex *int   // index of the first broken signature, nil if the chain is intact
+	Reason      string // why the chain is broken at BrokenIndex
+}
+
+// SignatureQuery filters and paginates the signatures of a device. Signatures are ordered by counter.
+type SignatureQuery struct {
+	CounterFrom *uint64   // inclusive, nil means no lower bound
+	CounterTo   *uint64   // inclusive, nil means no upper bound
+	CreatedFrom time.Time // inclusive, zero means no lower bound
+	CreatedTo   time.Time // exclusive, zero means no upper bound
+	After       *uint64   // cursor, the counter of the last signature of the previous page
+	Limit       int       // maximum number of signatures, 0 means no limit
+}
+
+// SignaturePage is a page of signatures returned for a SignatureQuery.
+type SignaturePage struct {
+	Signatures []SignedData
+	Next       *uint64 // cursor of the next page, nil if this is the last one
 }
 
 // Signer defines a contract for different types of signing implementations.
@@ -19,7 +77,20 @@ type Signer interface {
 }
 
 type SignerCreator interface {
-	CreateSigner(kp KeyPair) (Signer, error)
+	// CreateSigner creates a signer for the key of the device. A key is identified by the device ID and its version,
+	// so implementations can keep the signers they created.
+	CreateSigner(deviceID uuid.UUID, key DeviceKey) (Signer, error)
+}
+
+// Verifier defines a contract for checking signatures created by a Signer with the same key pair.
+type Verifier interface {
+	// Verify reports whether the signature is valid for the signed data. An error is returned only if the check
+	// itself could not be performed.
+	Verify(signedData []byte, signature []byte) (bool, error)
+}
+
+type VerifierCreator interface {
+	CreateVerifier(kp KeyPair, params KeyParams) (Verifier, error)
 }
 
 type SignaturePersister interface {
@@ -27,7 +98,16 @@ type SignaturePersister interface {
 
 	SaveSignature(ctx context.Context, deviceID uuid.UUID, data SignedData) error
 	GetLastSignature(ctx context.Context, deviceID uuid.UUID) (SignedData, error)
+	GetSignature(ctx context.Context, deviceID uuid.UUID, counter uint64) (SignedData, error)
 	GetSignatures(ctx context.Context, deviceID uuid.UUID) ([]SignedData, error)
+	QuerySignatures(ctx context.Context, deviceID uuid.UUID, query SignatureQuery) (SignaturePage, error)
+
+	// GetIdempotencyKey returns ErrIdempotencyKeyNotFound if the key was never saved for the device or was deleted.
+	GetIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key string) (IdempotencyKey, error)
+	// SaveIdempotencyKey replaces a key which was already saved for the device.
+	SaveIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key IdempotencyKey) error
+	// DeleteIdempotencyKeys deletes the device keys created before the given time.
+	DeleteIdempotencyKeys(ctx context.Context, deviceID uuid.UUID, createdBefore time.Time) error
 }
 
 type DeviceServer interface {
@@ -36,84 +116,237 @@ type DeviceServer interface {
 }
 
 type SignatureService struct {
-	logger        *zap.SugaredLogger
-	deviceSvc     DeviceServer
-	signerCreator SignerCreator
-	persister     SignaturePersister
+	logger          *zap.SugaredLogger
+	deviceSvc       DeviceServer
+	signerCreator   SignerCreator
+	verifierCreator VerifierCreator
+	persister       SignaturePersister
+
+	idempotencyRetention time.Duration
 }
 
 func NewSignatureService(
 	logger *zap.SugaredLogger,
 	deviceSvc DeviceServer,
 	signerCreator SignerCreator,
+	verifierCreator VerifierCreator,
 	persister SignaturePersister,
+	idempotencyRetention time.Duration,
 ) *SignatureService {
 	return &SignatureService{
-		logger:        logger,
-		deviceSvc:     deviceSvc,
-		signerCreator: signerCreator,
-		persister:     persister,
+		logger:               logger,
+		deviceSvc:            deviceSvc,
+		signerCreator:        signerCreator,
+		verifierCreator:      verifierCreator,
+		persister:            persister,
+		idempotencyRetention: idempotencyRetention,
 	}
 }
 
 func (ss *SignatureService) SignTransaction(ctx context.Context, deviceID uuid.UUID, data string) (SignedData, error) {
+	signedData, _, err := ss.SignTransactionIdempotent(ctx, deviceID, data, "")
+
+	return signedData, err
+}
+
+// SignTransactionIdempotent signs the data like SignTransaction, but remembers the signature under the idempotency
+// key. When the key is sent again with the same data before the retention period is over, the signature created the
+// first time is returned and replayed is true. Sending the key with different data fails with
+// IdempotencyKeyReusedError. An empty key disables the check.
+func (ss *SignatureService) SignTransactionIdempotent(
+	ctx context.Context,
+	deviceID uuid.UUID,
+	data, idempotencyKey string,
+) (signed SignedData, replayed bool, err error) {
 	var signedData *SignedData
 
-	err := ss.persister.RunTransaction(ctx, deviceID, func(ctx context.Context) error {
-		// Get device
-		device, err := ss.deviceSvc.GetDevice(ctx, deviceID)
+	err = ss.persister.RunTransaction(ctx, deviceID, func(ctx context.Context) error {
+		if idempotencyKey != "" {
+			previous, err := ss.idempotentSignature(ctx, deviceID, idempotencyKey, data)
+			if err != nil {
+				return err
+			}
+
+			if previous != nil {
+				signedData, replayed = previous, true
+
+				return nil
+			}
+		}
+
+		created, err := ss.sign(ctx, deviceID, data)
 		if err != nil {
 			return err
 		}
 
-		// Get last signature if device signature counter is not 0
-		lastSignature := base64.StdEncoding.EncodeToString([]byte(device.ID.String())) // base case
-		if device.SignatureCounter != 0 {
-			lastSignatureData, err := ss.persister.GetLastSignature(ctx, deviceID)
+		signedData = &created
+
+		// Remember the signature for retries, it is saved in the same transaction so both are stored or none
+		if idempotencyKey != "" {
+			err = ss.persister.SaveIdempotencyKey(ctx, deviceID, IdempotencyKey{
+				Key:         idempotencyKey,
+				PayloadHash: hashPayload(data),
+				Counter:     signedData.Counter,
+				CreatedAt:   signedData.SignedAt,
+			})
 			if err != nil {
-				return fmt.Errorf("failed to retrieve last signature: %w", err)
+				return fmt.Errorf("failed to save idempotency key: %w", err)
 			}
-
-			lastSignature = lastSignatureData.Signature
 		}
 
-		// Sign data
-		signer, err := ss.signerCreator.CreateSigner(device.KeyPair)
-		if err != nil {
-			return fmt.Errorf("failed to create signer: %w", err)
-		}
+		return nil
+	})
+	if err != nil {
+		return SignedData{}, false, fmt.Errorf("failed to sign transaction: %w", err)
+	}
 
-		dataToBeSigned := fmt.Sprintf("%d_%s_%s", device.SignatureCounter, data, lastSignature)
+	return *signedData, replayed, nil
+}
+
+// SignTransactions signs the batch of data in order, in a single transaction, so the signatures get consecutive
+// counters. In BatchAllOrNothing mode the first failure rolls back the whole batch and is returned as
+// BatchItemError. In BatchBestEffort mode only the failed transaction is rolled back and its error is reported in the
+// results, the next one is signed with the counter it would have used.
+func (ss *SignatureService) SignTransactions(ctx context.Context, deviceID uuid.UUID, data []string, mode BatchMode) ([]BatchResult, error) {
+	results := make([]BatchResult, len(data))
 
-		signature, err := signer.Sign([]byte(dataToBeSigned))
+	err := ss.persister.RunTransaction(ctx, deviceID, func(ctx context.Context) error {
+		// An inactive device fails the whole batch instead of every transaction of it
+		device, err := ss.deviceSvc.GetDevice(ctx, deviceID)
 		if err != nil {
-			return fmt.Errorf("failed to sign data: %w", err)
+			return err
 		}
 
-		// Save signature
-		signedData = &SignedData{
-			Signature:    base64.StdEncoding.EncodeToString(signature),
-			OriginalData: dataToBeSigned,
+		if device.Status != StatusActive {
+			return &DeviceInactiveError{ID: device.ID, Status: device.Status}
 		}
 
-		err = ss.persister.SaveSignature(ctx, deviceID, *signedData)
-		if err != nil {
-			return fmt.Errorf("failed to save signature: %w", err)
-		}
+		for i, item := range data {
+			if mode == BatchBestEffort {
+				// A nested transaction discards the writes of this transaction only
+				results[i].Err = ss.persister.RunTransaction(ctx, deviceID, func(ctx context.Context) error {
+					signed, err := ss.sign(ctx, deviceID, item)
+					if err != nil {
+						return err
+					}
 
-		// Update device signature counter
-		err = ss.deviceSvc.IncrementSignatureCounter(ctx, deviceID)
-		if err != nil {
-			return fmt.Errorf("failed to increment signature counter: %w", err)
+					results[i].Signature = &signed
+
+					return nil
+				})
+				if results[i].Err != nil {
+					results[i].Signature = nil
+				}
+
+				continue
+			}
+
+			signed, err := ss.sign(ctx, deviceID, item)
+			if err != nil {
+				return &BatchItemError{Index: i, Err: err}
+			}
+
+			results[i].Signature = &signed
 		}
 
 		return nil
 	})
 	if err != nil {
-		return SignedData{}, fmt.Errorf("failed to sign transaction: %w", err)
+		return nil, fmt.Errorf("failed to sign batch: %w", err)
+	}
+
+	return results, nil
+}
+
+// sign signs the data with the next counter value of the device and saves the signature. It has to run inside
+// RunTransaction.
+func (ss *SignatureService) sign(ctx context.Context, deviceID uuid.UUID, data string) (SignedData, error) {
+	// Get device
+	device, err := ss.deviceSvc.GetDevice(ctx, deviceID)
+	if err != nil {
+		return SignedData{}, err
+	}
+
+	if device.Status != StatusActive {
+		return SignedData{}, &DeviceInactiveError{ID: device.ID, Status: device.Status}
+	}
+
+	// Get last signature if the device created one, imported devices start with the one they were imported with
+	lastSignature := device.ChainBase() // base case
+	if device.SignatureCounter != device.ImportedCounter {
+		lastSignatureData, err := ss.persister.GetLastSignature(ctx, deviceID)
+		if err != nil {
+			return SignedData{}, fmt.Errorf("failed to retrieve last signature: %w", err)
+		}
+
+		lastSignature = lastSignatureData.Signature
+	}
+
+	// Sign data
+	signer, err := ss.signerCreator.CreateSigner(device.ID, device.CurrentKey())
+	if err != nil {
+		return SignedData{}, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	dataToBeSigned := formatDataToBeSigned(device.SignatureCounter, data, lastSignature)
+
+	signature, err := signer.Sign([]byte(dataToBeSigned))
+	if err != nil {
+		return SignedData{}, fmt.Errorf("failed to sign data: %w", err)
+	}
+
+	// Save signature
+	signedData := SignedData{
+		DeviceID:     device.ID,
+		Counter:      device.SignatureCounter,
+		Signature:    base64.StdEncoding.EncodeToString(signature),
+		OriginalData: dataToBeSigned,
+		Algorithm:    device.Algorithm,
+		KeyVersion:   device.KeyVersion,
+		SignedAt:     time.Now(),
+	}
+
+	err = ss.persister.SaveSignature(ctx, deviceID, signedData)
+	if err != nil {
+		return SignedData{}, fmt.Errorf("failed to save signature: %w", err)
+	}
+
+	// Update device signature counter
+	err = ss.deviceSvc.IncrementSignatureCounter(ctx, deviceID)
+	if err != nil {
+		return SignedData{}, fmt.Errorf("failed to increment signature counter: %w", err)
+	}
+
+	return signedData, nil
+}
+
+// idempotentSignature returns the signature created earlier for the idempotency key, or nil if the key is unknown or
+// has expired. It has to run inside the signing transaction.
+func (ss *SignatureService) idempotentSignature(ctx context.Context, deviceID uuid.UUID, key, data string) (*SignedData, error) {
+	// Expired keys are purged first, so they are never replayed and do not pile up
+	err := ss.persister.DeleteIdempotencyKeys(ctx, deviceID, time.Now().Add(-ss.idempotencyRetention))
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+
+	stored, err := ss.persister.GetIdempotencyKey(ctx, deviceID, key)
+	if errors.Is(err, ErrIdempotencyKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve idempotency key: %w", err)
 	}
 
-	return *signedData, nil
+	if stored.PayloadHash != hashPayload(data) {
+		return nil, &IdempotencyKeyReusedError{Key: key}
+	}
+
+	signature, err := ss.persister.GetSignature(ctx, deviceID, stored.Counter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve signature of idempotency key: %w", err)
+	}
+
+	return &signature, nil
 }
 
 func (ss *SignatureService) GetSignatures(ctx context.Context, deviceID uuid.UUID) ([]SignedData, error) {
@@ -124,3 +357,184 @@ func (ss *SignatureService) GetSignatures(ctx context.Context, deviceID uuid.UUI
 
 	return signatures, nil
 }
+
+// GetSignature returns the device signature created with the given counter value.
+func (ss *SignatureService) GetSignature(ctx context.Context, deviceID uuid.UUID, counter uint64) (SignedData, error) {
+	signature, err := ss.persister.GetSignature(ctx, deviceID, counter)
+	if err != nil {
+		return SignedData{}, fmt.Errorf("failed to retrieve signature: %w", err)
+	}
+
+	return signature, nil
+}
+
+// QuerySignatures returns a page of the device signatures matching the query.
+func (ss *SignatureService) QuerySignatures(ctx context.Context, deviceID uuid.UUID, query SignatureQuery) (SignaturePage, error) {
+	page, err := ss.persister.QuerySignatures(ctx, deviceID, query)
+	if err != nil {
+		return SignaturePage{}, fmt.Errorf("failed to retrieve signatures: %w", err)
+	}
+
+	return page, nil
+}
+
+// VerifySignature checks that the base64 encoded signature is valid for the signed data and the device public key.
+// The key which was valid for the signature counter is used, so signatures created before a key rotation are still
+// verified with the key they were created with.
+func (ss *SignatureService) VerifySignature(ctx context.Context, deviceID uuid.UUID, signature, signedData string) (bool, error) {
+	device, err := ss.deviceSvc.GetDevice(ctx, deviceID)
+	if err != nil {
+		return false, err
+	}
+
+	rawSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		// A signature which is not even base64 can not be valid
+		return false, nil
+	}
+
+	counter, _, err := parseDataToBeSigned(signedData)
+	if err != nil {
+		// Neither can a signature of data which was not produced by the service
+		return false, nil
+	}
+
+	key := device.KeyAt(counter)
+
+	verifier, err := ss.verifierCreator.CreateVerifier(key.KeyPair, key.Params)
+	if err != nil {
+		return false, fmt.Errorf("failed to create verifier: %w", err)
+	}
+
+	valid, err := verifier.Verify([]byte(signedData), rawSignature)
+	if err != nil {
+		return false, fmt.Errorf("failed to verify signature: %w", err)
+	}
+
+	return valid, nil
+}
+
+// auditPageSize is the number of signatures AuditChain loads at once, so long chains are not held in memory.
+const auditPageSize = 1000
+
+// AuditChain walks all the signatures of a device in order and checks that the counters are continuous, that every
+// signature links to the previous one (or to Device.ChainBase for the first one) and that every signature was made
+// with, and is valid for, the device key which was valid at its counter. It stops at the first broken signature.
+// Imported devices are checked from the first signature created after the import. The signatures are read page by page.
+func (ss *SignatureService) AuditChain(ctx context.Context, deviceID uuid.UUID) (ChainAudit, error) {
+	device, err := ss.deviceSvc.GetDevice(ctx, deviceID)
+	if err != nil {
+		return ChainAudit{}, err
+	}
+
+	// Verifiers are created once per key version, a device has a few of them at most
+	verifiers := make(map[int]Verifier)
+
+	broken := func(index int, reason string) ChainAudit {
+		return ChainAudit{Valid: false, Checked: index, BrokenIndex: &index, Reason: reason}
+	}
+
+	var (
+		i             int
+		lastSignature = device.ChainBase() // base case
+		query         = SignatureQuery{Limit: auditPageSize}
+	)
+	for {
+		page, err := ss.persister.QuerySignatures(ctx, deviceID, query)
+		if err != nil {
+			return ChainAudit{}, fmt.Errorf("failed to retrieve signatures: %w", err)
+		}
+
+		for _, signature := range page.Signatures {
+			counter, previous, err := parseDataToBeSigned(signature.OriginalData)
+			if err != nil {
+				return broken(i, err.Error()), nil
+			}
+
+			if expected := device.ImportedCounter + uint64(i); counter != expected {
+				return broken(i, fmt.Sprintf("counter is %d, expected %d", counter, expected)), nil
+			}
+
+			if previous != lastSignature {
+				return broken(i, "signed data does not link to the previous signature"), nil
+			}
+
+			rawSignature, err := base64.StdEncoding.DecodeString(signature.Signature)
+			if err != nil {
+				return broken(i, "signature is not base64 encoded"), nil
+			}
+
+			key := device.KeyAt(counter)
+			if signature.KeyVersion != key.Version {
+				return broken(i, fmt.Sprintf(
+					"signature was made with key version %d, but key version %d was valid at counter %d",
+					signature.KeyVersion, key.Version, counter,
+				)), nil
+			}
+
+			verifier, ok := verifiers[key.Version]
+			if !ok {
+				verifier, err = ss.verifierCreator.CreateVerifier(key.KeyPair, key.Params)
+				if err != nil {
+					return ChainAudit{}, fmt.Errorf("failed to create verifier: %w", err)
+				}
+
+				verifiers[key.Version] = verifier
+			}
+
+			valid, err := verifier.Verify([]byte(signature.OriginalData), rawSignature)
+			if err != nil {
+				return ChainAudit{}, fmt.Errorf("failed to verify signature: %w", err)
+			}
+
+			if !valid {
+				return broken(i, "signature is not valid for the device key"), nil
+			}
+
+			lastSignature = signature.Signature
+			i++
+		}
+
+		if page.Next == nil {
+			break
+		}
+		query.After = page.Next
+	}
+
+	if next := device.ImportedCounter + uint64(i); device.SignatureCounter != next {
+		return broken(i, fmt.Sprintf(
+			"device signature counter is %d, but the stored signatures continue with %d", device.SignatureCounter, next,
+		)), nil
+	}
+
+	return ChainAudit{Valid: true, Checked: i}, nil
+}
+
+// hashPayload is used to compare the data sent again with an idempotency key without storing the data twice.
+func hashPayload(data string) string {
+	sum := sha256.Sum256([]byte(data))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// formatDataToBeSigned builds the data which is actually signed: <signature_counter>_<data_to_be_signed>_<last_signature_base64_encoded>
+func formatDataToBeSigned(counter uint64, data, lastSignature string) string {
+	return fmt.Sprintf("%d_%s_%s", counter, data, lastSignature)
+}
+
+// parseDataToBeSigned extracts the counter and the last signature from the signed data. The data itself may contain
+// underscores, but the counter and the base64 encoded signature never do.
+func parseDataToBeSigned(dataToBeSigned string) (uint64, string, error) {
+	first := strings.Index(dataToBeSigned, "_")
+	last := strings.LastIndex(dataToBeSigned, "_")
+	if first == -1 || first == last {
+		return 0, "", errors.New("signed data is malformed")
+	}
+
+	counter, err := strconv.ParseUint(dataToBeSigned[:first], 10, 64)
+	if err != nil {
+		return 0, "", errors.New("signed data has a malformed counter")
+	}
+
+	return counter, dataToBeSigned[last+1:], nil
+}
@@ -2,7 +2,10 @@ package domain
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -41,8 +44,8 @@ type MockSignerCreator struct {
 	mock.Mock
 }
 
-func (m *MockSignerCreator) CreateSigner(kp KeyPair) (Signer, error) {
-	args := m.Called(kp)
+func (m *MockSignerCreator) CreateSigner(deviceID uuid.UUID, key DeviceKey) (Signer, error) {
+	args := m.Called(deviceID, key)
 	signer, ok := args.Get(0).(Signer)
 	if !ok {
 		return nil, args.Error(1)
@@ -75,6 +78,11 @@ func (m *MockSignaturePersister) GetLastSignature(ctx context.Context, deviceID
 	return args.Get(0).(SignedData), args.Error(1)
 }
 
+func (m *MockSignaturePersister) GetSignature(ctx context.Context, deviceID uuid.UUID, counter uint64) (SignedData, error) {
+	args := m.Called(ctx, deviceID, counter)
+	return args.Get(0).(SignedData), args.Error(1)
+}
+
 func (m *MockSignaturePersister) GetSignatures(ctx context.Context, deviceID uuid.UUID) ([]SignedData, error) {
 	args := m.Called(ctx, deviceID)
 	if args.Get(0) == nil {
@@ -83,6 +91,26 @@ func (m *MockSignaturePersister) GetSignatures(ctx context.Context, deviceID uui
 	return args.Get(0).([]SignedData), args.Error(1)
 }
 
+func (m *MockSignaturePersister) QuerySignatures(ctx context.Context, deviceID uuid.UUID, query SignatureQuery) (SignaturePage, error) {
+	args := m.Called(ctx, deviceID, query)
+	return args.Get(0).(SignaturePage), args.Error(1)
+}
+
+func (m *MockSignaturePersister) GetIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key string) (IdempotencyKey, error) {
+	args := m.Called(ctx, deviceID, key)
+	return args.Get(0).(IdempotencyKey), args.Error(1)
+}
+
+func (m *MockSignaturePersister) SaveIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key IdempotencyKey) error {
+	args := m.Called(ctx, deviceID, key)
+	return args.Error(0)
+}
+
+func (m *MockSignaturePersister) DeleteIdempotencyKeys(ctx context.Context, deviceID uuid.UUID, createdBefore time.Time) error {
+	args := m.Called(ctx, deviceID, createdBefore)
+	return args.Error(0)
+}
+
 func TestSignatureService_SignTransaction_Success(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	deviceSvc := new(MockDeviceServer)
@@ -94,22 +122,29 @@ func TestSignatureService_SignTransaction_Success(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 0,
 		KeyPair:          &MockKeyPair{},
+		Algorithm:        AlgorithmECC,
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	signer := new(MockSigner)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(signer, nil)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
 	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(nil)
 	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	signedData, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.NoError(t, err)
 	assert.Equal(t, "c2lnbmVkX2RhdGE=", signedData.Signature)
 	assert.Equal(t, "0_data_MDAwMDAwMDAtMDAwMC0wMDAwLTAwMDAtMDAwMDAwMDAwMDAw", signedData.OriginalData)
+	assert.Equal(t, deviceID, signedData.DeviceID)
+	assert.Equal(t, uint64(0), signedData.Counter)
+	assert.Equal(t, AlgorithmECC, signedData.Algorithm)
+	assert.WithinDuration(t, time.Now(), signedData.SignedAt, time.Second)
+	persister.AssertCalled(t, "SaveSignature", mock.Anything, deviceID, signedData)
 }
 
 func TestSignatureService_SignTransaction_GetDeviceError(t *testing.T) {
@@ -120,10 +155,10 @@ func TestSignatureService_SignTransaction_GetDeviceError(t *testing.T) {
 
 	deviceID := uuid.MustParse("00000000-0000-0000-0000-000000000000")
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(Device{}, assert.AnError)
-	signerCreator.On("CreateSigner", mock.Anything).Return(nil, nil)
+	signerCreator.On("CreateSigner", mock.Anything, mock.Anything).Return(nil, nil)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.Error(t, err)
@@ -140,13 +175,14 @@ func TestSignatureService_SignTransaction_CreateSignerError(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 0,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(nil, assert.AnError)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(nil, assert.AnError)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.Error(t, err)
@@ -163,15 +199,16 @@ func TestSignatureService_SignTransaction_SignError(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 0,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	signer := new(MockSigner)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(signer, nil)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
 	signer.On("Sign", mock.Anything).Return(nil, assert.AnError)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.Error(t, err)
@@ -188,17 +225,18 @@ func TestSignatureService_SignTransaction_RunTransactionError(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 0,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	signer := new(MockSigner)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(signer, nil)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
 	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
 	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(nil)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(assert.AnError)
 	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.Error(t, err)
@@ -215,17 +253,18 @@ func TestSignatureService_SignTransaction_SaveSignatureError(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 0,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	signer := new(MockSigner)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(signer, nil)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
 	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(assert.AnError)
 	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.Error(t, err)
@@ -242,17 +281,18 @@ func TestSignatureService_SignTransaction_IncrementSignatureCounterError(t *test
 		ID:               deviceID,
 		SignatureCounter: 0,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	signer := new(MockSigner)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(signer, nil)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
 	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(nil)
 	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(assert.AnError)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.Error(t, err)
@@ -269,16 +309,17 @@ func TestSignatureService_SignTransaction_GetLastSignatureError(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 1,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	signer := new(MockSigner)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(signer, nil)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
 	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 	persister.On("GetLastSignature", mock.Anything, deviceID).Return(SignedData{}, assert.AnError)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.Error(t, err)
@@ -295,23 +336,58 @@ func TestSignatureService_SignTransaction_GetLastSignatureBaseCase(t *testing.T)
 		ID:               deviceID,
 		SignatureCounter: 1,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	signer := new(MockSigner)
-	signerCreator.On("CreateSigner", device.KeyPair).Return(signer, nil)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
 	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
 	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
 	persister.On("GetLastSignature", mock.Anything, deviceID).Return(SignedData{}, nil)
 	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(nil)
 	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.SignTransaction(context.Background(), deviceID, "data")
 
 	assert.NoError(t, err)
 }
 
+func TestSignatureService_SignTransaction_ImportedDevice(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	signerCreator := new(MockSignerCreator)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.New()
+	device := Device{
+		ID:                deviceID,
+		SignatureCounter:  42,
+		KeyPair:           &MockKeyPair{},
+		Status:            StatusActive,
+		ImportedCounter:   42,
+		ImportedSignature: "bGFzdA==",
+	}
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
+	signer := new(MockSigner)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
+	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
+	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(nil)
+	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(nil)
+
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
+	signedData, err := ss.SignTransaction(context.Background(), deviceID, "data")
+
+	// The first signature after the import links to the imported one
+	assert.NoError(t, err)
+	assert.Equal(t, "42_data_bGFzdA==", signedData.OriginalData)
+	assert.Equal(t, uint64(42), signedData.Counter)
+	persister.AssertNotCalled(t, "GetLastSignature", mock.Anything, mock.Anything)
+}
+
 func TestSignatureService_GetSignatures(t *testing.T) {
 	logger := zap.NewNop().Sugar()
 	deviceSvc := new(MockDeviceServer)
@@ -323,12 +399,13 @@ func TestSignatureService_GetSignatures(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 1,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	persister.On("GetSignatures", mock.Anything, deviceID).Return([]SignedData{{Signature: "signature"}}, nil)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	signatures, err := ss.GetSignatures(context.Background(), deviceID)
 
 	assert.NoError(t, err)
@@ -346,13 +423,560 @@ func TestSignatureService_GetSignatures_GetSignaturesError(t *testing.T) {
 		ID:               deviceID,
 		SignatureCounter: 1,
 		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
 	}
 
 	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
 	persister.On("GetSignatures", mock.Anything, deviceID).Return(nil, assert.AnError)
 
-	ss := NewSignatureService(logger, deviceSvc, signerCreator, persister)
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
 	_, err := ss.GetSignatures(context.Background(), deviceID)
 
 	assert.Error(t, err)
 }
+
+type MockVerifier struct {
+	mock.Mock
+}
+
+func (m *MockVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	args := m.Called(signedData, signature)
+	return args.Bool(0), args.Error(1)
+}
+
+type MockVerifierCreator struct {
+	mock.Mock
+}
+
+func (m *MockVerifierCreator) CreateVerifier(kp KeyPair, params KeyParams) (Verifier, error) {
+	args := m.Called(kp, params)
+	verifier, ok := args.Get(0).(Verifier)
+	if !ok {
+		return nil, args.Error(1)
+	}
+	return verifier, args.Error(1)
+}
+
+func TestSignatureService_VerifySignature(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	verifierCreator := new(MockVerifierCreator)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.MustParse("00000000-0000-0000-0000-000000000000")
+	device := Device{
+		ID:      deviceID,
+		KeyPair: &MockKeyPair{},
+	}
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
+	verifier := new(MockVerifier)
+	verifierCreator.On("CreateVerifier", device.KeyPair, device.KeyParams).Return(verifier, nil)
+	verifier.On("Verify", []byte("0_data_id"), []byte("signed_data")).Return(true, nil)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+	valid, err := ss.VerifySignature(context.Background(), deviceID, "c2lnbmVkX2RhdGE=", "0_data_id")
+
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestSignatureService_VerifySignature_InvalidEncoding(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	verifierCreator := new(MockVerifierCreator)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.MustParse("00000000-0000-0000-0000-000000000000")
+	device := Device{
+		ID:      deviceID,
+		KeyPair: &MockKeyPair{},
+	}
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+	valid, err := ss.VerifySignature(context.Background(), deviceID, "not base64!", "0_data_id")
+
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	verifierCreator.AssertNotCalled(t, "CreateVerifier", mock.Anything, mock.Anything)
+}
+
+func TestSignatureService_VerifySignature_GetDeviceError(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	verifierCreator := new(MockVerifierCreator)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.MustParse("00000000-0000-0000-0000-000000000000")
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(Device{}, assert.AnError)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+	_, err := ss.VerifySignature(context.Background(), deviceID, "c2lnbmVkX2RhdGE=", "0_data_id")
+
+	assert.Error(t, err)
+}
+
+func TestSignatureService_VerifySignature_CreateVerifierError(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	verifierCreator := new(MockVerifierCreator)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.MustParse("00000000-0000-0000-0000-000000000000")
+	device := Device{
+		ID:      deviceID,
+		KeyPair: &MockKeyPair{},
+	}
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
+	verifierCreator.On("CreateVerifier", device.KeyPair, device.KeyParams).Return(nil, assert.AnError)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+	_, err := ss.VerifySignature(context.Background(), deviceID, "c2lnbmVkX2RhdGE=", "0_data_id")
+
+	assert.Error(t, err)
+}
+
+// auditChainFixture returns a device with a valid chain of two signatures and a verifier accepting them.
+func auditChainFixture() (Device, []SignedData) {
+	deviceID := uuid.MustParse("00000000-0000-0000-0000-000000000000")
+	device := Device{
+		ID:               deviceID,
+		SignatureCounter: 2,
+		KeyPair:          &MockKeyPair{},
+		Status:           StatusActive,
+	}
+
+	signatures := []SignedData{
+		{Signature: "Zmlyc3Q=", OriginalData: "0_first_data_MDAwMDAwMDAtMDAwMC0wMDAwLTAwMDAtMDAwMDAwMDAwMDAw"},
+		{Signature: "c2Vjb25k", OriginalData: "1_second_Zmlyc3Q="},
+	}
+
+	return device, signatures
+}
+
+func TestSignatureService_AuditChain_Valid(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	verifierCreator := new(MockVerifierCreator)
+	persister := new(MockSignaturePersister)
+
+	device, signatures := auditChainFixture()
+
+	deviceSvc.On("GetDevice", mock.Anything, device.ID).Return(device, nil)
+	// The chain is read in two pages, the second one continues after the counter of the first
+	next := uint64(0)
+	persister.On("QuerySignatures", mock.Anything, device.ID, SignatureQuery{Limit: auditPageSize}).
+		Return(SignaturePage{Signatures: signatures[:1], Next: &next}, nil)
+	persister.On("QuerySignatures", mock.Anything, device.ID, SignatureQuery{After: &next, Limit: auditPageSize}).
+		Return(SignaturePage{Signatures: signatures[1:]}, nil)
+	verifier := new(MockVerifier)
+	verifierCreator.On("CreateVerifier", device.KeyPair, device.KeyParams).Return(verifier, nil)
+	verifier.On("Verify", mock.Anything, mock.Anything).Return(true, nil)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+	audit, err := ss.AuditChain(context.Background(), device.ID)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ChainAudit{Valid: true, Checked: 2}, audit)
+	verifier.AssertNumberOfCalls(t, "Verify", 2)
+	persister.AssertNumberOfCalls(t, "QuerySignatures", 2)
+}
+
+func TestSignatureService_AuditChain_ImportedDevice(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	verifierCreator := new(MockVerifierCreator)
+	persister := new(MockSignaturePersister)
+
+	device := Device{
+		ID:                uuid.New(),
+		SignatureCounter:  7,
+		KeyPair:           &MockKeyPair{},
+		KeyValidFrom:      5,
+		Status:            StatusActive,
+		ImportedCounter:   5,
+		ImportedSignature: "bGFzdA==",
+	}
+	signatures := []SignedData{
+		{Signature: "Zmlyc3Q=", OriginalData: "5_first_bGFzdA=="},
+		{Signature: "c2Vjb25k", OriginalData: "6_second_Zmlyc3Q="},
+	}
+
+	deviceSvc.On("GetDevice", mock.Anything, device.ID).Return(device, nil)
+	persister.On("QuerySignatures", mock.Anything, device.ID, mock.Anything).
+		Return(SignaturePage{Signatures: signatures}, nil)
+	verifier := new(MockVerifier)
+	verifierCreator.On("CreateVerifier", device.KeyPair, device.KeyParams).Return(verifier, nil)
+	verifier.On("Verify", mock.Anything, mock.Anything).Return(true, nil)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+	audit, err := ss.AuditChain(context.Background(), device.ID)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ChainAudit{Valid: true, Checked: 2}, audit)
+
+	// The chain of the imported device starts with the imported counter
+	signatures[0].OriginalData = "0_first_bGFzdA=="
+	audit, err = ss.AuditChain(context.Background(), device.ID)
+
+	assert.NoError(t, err)
+	assert.False(t, audit.Valid)
+	assert.Equal(t, 0, *audit.BrokenIndex)
+}
+
+func TestSignatureService_AuditChain_Broken(t *testing.T) {
+	tests := []struct {
+		name        string
+		mutate      func(device *Device, signatures []SignedData)
+		validSig    bool
+		brokenIndex int
+	}{
+		{
+			name: "broken link",
+			mutate: func(_ *Device, signatures []SignedData) {
+				signatures[1].OriginalData = "1_second_b3RoZXI="
+			},
+			validSig:    true,
+			brokenIndex: 1,
+		},
+		{
+			name: "counter gap",
+			mutate: func(_ *Device, signatures []SignedData) {
+				signatures[1].OriginalData = "2_second_Zmlyc3Q="
+			},
+			validSig:    true,
+			brokenIndex: 1,
+		},
+		{
+			name: "first signature does not link to device id",
+			mutate: func(_ *Device, signatures []SignedData) {
+				signatures[0].OriginalData = "0_first_Zmlyc3Q="
+			},
+			validSig:    true,
+			brokenIndex: 0,
+		},
+		{
+			name: "malformed signed data",
+			mutate: func(_ *Device, signatures []SignedData) {
+				signatures[0].OriginalData = "garbage"
+			},
+			validSig:    true,
+			brokenIndex: 0,
+		},
+		{
+			name: "signed with another key version",
+			mutate: func(_ *Device, signatures []SignedData) {
+				signatures[1].KeyVersion = 2
+			},
+			validSig:    true,
+			brokenIndex: 1,
+		},
+		{
+			name:        "invalid signature",
+			mutate:      func(*Device, []SignedData) {},
+			validSig:    false,
+			brokenIndex: 0,
+		},
+		{
+			name: "device counter does not match stored signatures",
+			mutate: func(device *Device, _ []SignedData) {
+				device.SignatureCounter = 3
+			},
+			validSig:    true,
+			brokenIndex: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := zap.NewNop().Sugar()
+			deviceSvc := new(MockDeviceServer)
+			verifierCreator := new(MockVerifierCreator)
+			persister := new(MockSignaturePersister)
+
+			device, signatures := auditChainFixture()
+			tt.mutate(&device, signatures)
+
+			deviceSvc.On("GetDevice", mock.Anything, device.ID).Return(device, nil)
+			persister.On("QuerySignatures", mock.Anything, device.ID, mock.Anything).
+				Return(SignaturePage{Signatures: signatures}, nil)
+			verifier := new(MockVerifier)
+			verifierCreator.On("CreateVerifier", device.KeyPair, device.KeyParams).Return(verifier, nil)
+			verifier.On("Verify", mock.Anything, mock.Anything).Return(tt.validSig, nil)
+
+			ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+			audit, err := ss.AuditChain(context.Background(), device.ID)
+
+			assert.NoError(t, err)
+			assert.False(t, audit.Valid)
+			assert.Equal(t, tt.brokenIndex, audit.Checked)
+			if assert.NotNil(t, audit.BrokenIndex) {
+				assert.Equal(t, tt.brokenIndex, *audit.BrokenIndex)
+			}
+			assert.NotEmpty(t, audit.Reason)
+		})
+	}
+}
+
+func TestSignatureService_AuditChain_QuerySignaturesError(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	verifierCreator := new(MockVerifierCreator)
+	persister := new(MockSignaturePersister)
+
+	device, _ := auditChainFixture()
+
+	deviceSvc.On("GetDevice", mock.Anything, device.ID).Return(device, nil)
+	persister.On("QuerySignatures", mock.Anything, device.ID, mock.Anything).Return(SignaturePage{}, assert.AnError)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, verifierCreator, persister, 0)
+	_, err := ss.AuditChain(context.Background(), device.ID)
+
+	assert.Error(t, err)
+}
+
+func TestSignatureService_SignTransaction_InactiveDevice(t *testing.T) {
+	for _, status := range []Status{StatusDeactivated, StatusDecommissioned} {
+		t.Run(status.String(), func(t *testing.T) {
+			logger := zap.NewNop().Sugar()
+			deviceSvc := new(MockDeviceServer)
+			signerCreator := new(MockSignerCreator)
+			persister := new(MockSignaturePersister)
+
+			deviceID := uuid.MustParse("00000000-0000-0000-0000-000000000000")
+			device := Device{
+				ID:      deviceID,
+				KeyPair: &MockKeyPair{},
+				Status:  status,
+			}
+
+			deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
+			persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
+
+			ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, 0)
+			_, err := ss.SignTransaction(context.Background(), deviceID, "data")
+
+			var inactiveErr *DeviceInactiveError
+			assert.ErrorAs(t, err, &inactiveErr)
+			assert.Equal(t, status, inactiveErr.Status)
+			assert.ErrorIs(t, err, ErrDeviceInactive)
+			signerCreator.AssertNotCalled(t, "CreateSigner", mock.Anything, mock.Anything)
+			persister.AssertNotCalled(t, "SaveSignature", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestSignatureService_QuerySignatures(t *testing.T) {
+	persister := new(MockSignaturePersister)
+	ss := NewSignatureService(zap.NewNop().Sugar(), nil, nil, nil, persister, 0)
+
+	ctx := context.Background()
+	deviceID := uuid.New()
+	from := uint64(1)
+	query := SignatureQuery{CounterFrom: &from, Limit: 1}
+	next := uint64(1)
+	page := SignaturePage{Signatures: []SignedData{{Signature: "sig", OriginalData: "1_data_prev"}}, Next: &next}
+
+	persister.On("QuerySignatures", ctx, deviceID, query).Return(page, nil)
+
+	result, err := ss.QuerySignatures(ctx, deviceID, query)
+
+	assert.NoError(t, err)
+	assert.Equal(t, page, result)
+	persister.AssertExpectations(t)
+}
+
+func TestSignatureService_QuerySignatures_PersisterError(t *testing.T) {
+	persister := new(MockSignaturePersister)
+	ss := NewSignatureService(zap.NewNop().Sugar(), nil, nil, nil, persister, 0)
+
+	ctx := context.Background()
+	deviceID := uuid.New()
+
+	persister.On("QuerySignatures", ctx, deviceID, SignatureQuery{}).
+		Return(SignaturePage{}, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID))
+
+	_, err := ss.QuerySignatures(ctx, deviceID, SignatureQuery{})
+
+	assert.ErrorIs(t, err, ErrDeviceNotFound)
+}
+
+func TestSignatureService_GetSignature(t *testing.T) {
+	persister := new(MockSignaturePersister)
+	ss := NewSignatureService(zap.NewNop().Sugar(), nil, nil, nil, persister, 0)
+
+	ctx := context.Background()
+	deviceID := uuid.New()
+	signature := SignedData{DeviceID: deviceID, Counter: 3, Signature: "sig", Algorithm: AlgorithmRSA}
+
+	persister.On("GetSignature", ctx, deviceID, uint64(3)).Return(signature, nil)
+	persister.On("GetSignature", ctx, deviceID, uint64(4)).
+		Return(SignedData{}, fmt.Errorf("%w: counter 4", ErrSignatureNotFound))
+
+	result, err := ss.GetSignature(ctx, deviceID, 3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, signature, result)
+
+	_, err = ss.GetSignature(ctx, deviceID, 4)
+
+	assert.ErrorIs(t, err, ErrSignatureNotFound)
+}
+
+func TestSignatureService_SignTransactionIdempotent_NewKey(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	signerCreator := new(MockSignerCreator)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.New()
+	device := Device{ID: deviceID, KeyPair: &MockKeyPair{}, Algorithm: AlgorithmECC, Status: StatusActive}
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
+	signer := new(MockSigner)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
+	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
+	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("DeleteIdempotencyKeys", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("GetIdempotencyKey", mock.Anything, deviceID, "key").
+		Return(IdempotencyKey{}, fmt.Errorf("%w: key", ErrIdempotencyKeyNotFound))
+	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("SaveIdempotencyKey", mock.Anything, deviceID, mock.Anything).Return(nil)
+	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(nil)
+
+	ss := NewSignatureService(logger, deviceSvc, signerCreator, nil, persister, time.Hour)
+	signedData, replayed, err := ss.SignTransactionIdempotent(context.Background(), deviceID, "data", "key")
+
+	assert.NoError(t, err)
+	assert.False(t, replayed)
+	persister.AssertCalled(t, "SaveIdempotencyKey", mock.Anything, deviceID, IdempotencyKey{
+		Key:         "key",
+		PayloadHash: hashPayload("data"),
+		Counter:     signedData.Counter,
+		CreatedAt:   signedData.SignedAt,
+	})
+	persister.AssertCalled(t, "DeleteIdempotencyKeys", mock.Anything, deviceID, mock.MatchedBy(func(before time.Time) bool {
+		return before.Before(time.Now().Add(-time.Hour + time.Second))
+	}))
+}
+
+func TestSignatureService_SignTransactionIdempotent_Replay(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	deviceSvc := new(MockDeviceServer)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.New()
+	signature := SignedData{DeviceID: deviceID, Counter: 5, Signature: "sig", Algorithm: AlgorithmECC}
+
+	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("DeleteIdempotencyKeys", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("GetIdempotencyKey", mock.Anything, deviceID, "key").
+		Return(IdempotencyKey{Key: "key", PayloadHash: hashPayload("data"), Counter: 5}, nil)
+	persister.On("GetSignature", mock.Anything, deviceID, uint64(5)).Return(signature, nil)
+
+	ss := NewSignatureService(logger, deviceSvc, nil, nil, persister, time.Hour)
+	signedData, replayed, err := ss.SignTransactionIdempotent(context.Background(), deviceID, "data", "key")
+
+	assert.NoError(t, err)
+	assert.True(t, replayed)
+	assert.Equal(t, signature, signedData)
+	persister.AssertNotCalled(t, "SaveSignature", mock.Anything, mock.Anything, mock.Anything)
+	deviceSvc.AssertNotCalled(t, "IncrementSignatureCounter", mock.Anything, mock.Anything)
+}
+
+func TestSignatureService_SignTransactionIdempotent_KeyReused(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.New()
+
+	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("DeleteIdempotencyKeys", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("GetIdempotencyKey", mock.Anything, deviceID, "key").
+		Return(IdempotencyKey{Key: "key", PayloadHash: hashPayload("data"), Counter: 5}, nil)
+
+	ss := NewSignatureService(logger, nil, nil, nil, persister, time.Hour)
+	_, _, err := ss.SignTransactionIdempotent(context.Background(), deviceID, "other data", "key")
+
+	assert.ErrorIs(t, err, ErrConflict)
+
+	var reusedErr *IdempotencyKeyReusedError
+	assert.ErrorAs(t, err, &reusedErr)
+	assert.Equal(t, "key", reusedErr.Key)
+}
+
+func newBatchMocks(deviceID uuid.UUID) (*MockDeviceServer, *MockSignerCreator, *MockSignaturePersister) {
+	deviceSvc := new(MockDeviceServer)
+	signerCreator := new(MockSignerCreator)
+	persister := new(MockSignaturePersister)
+
+	device := Device{ID: deviceID, KeyPair: &MockKeyPair{}, Algorithm: AlgorithmECC, Status: StatusActive}
+
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).Return(device, nil)
+	deviceSvc.On("IncrementSignatureCounter", mock.Anything, deviceID).Return(nil)
+	signer := new(MockSigner)
+	signerCreator.On("CreateSigner", device.ID, device.CurrentKey()).Return(signer, nil)
+	signer.On("Sign", mock.MatchedBy(func(data []byte) bool { return strings.Contains(string(data), "bad") })).
+		Return(nil, assert.AnError)
+	signer.On("Sign", mock.Anything).Return([]byte("signed_data"), nil)
+	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
+	persister.On("SaveSignature", mock.Anything, deviceID, mock.Anything).Return(nil)
+
+	return deviceSvc, signerCreator, persister
+}
+
+func TestSignatureService_SignTransactions_AllOrNothing(t *testing.T) {
+	deviceID := uuid.New()
+	deviceSvc, signerCreator, persister := newBatchMocks(deviceID)
+
+	ss := NewSignatureService(zap.NewNop().Sugar(), deviceSvc, signerCreator, nil, persister, 0)
+
+	results, err := ss.SignTransactions(context.Background(), deviceID, []string{"first", "second"}, BatchAllOrNothing)
+
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.True(t, strings.HasPrefix(results[1].Signature.OriginalData, "0_second_"))
+	persister.AssertNumberOfCalls(t, "SaveSignature", 2)
+
+	_, err = ss.SignTransactions(context.Background(), deviceID, []string{"first", "bad", "third"}, BatchAllOrNothing)
+
+	var itemErr *BatchItemError
+	assert.ErrorAs(t, err, &itemErr)
+	assert.Equal(t, 1, itemErr.Index)
+	assert.ErrorIs(t, err, assert.AnError)
+}
+
+func TestSignatureService_SignTransactions_BestEffort(t *testing.T) {
+	deviceID := uuid.New()
+	deviceSvc, signerCreator, persister := newBatchMocks(deviceID)
+
+	ss := NewSignatureService(zap.NewNop().Sugar(), deviceSvc, signerCreator, nil, persister, 0)
+
+	results, err := ss.SignTransactions(context.Background(), deviceID, []string{"first", "bad", "third"}, BatchBestEffort)
+
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	assert.NotNil(t, results[0].Signature)
+	assert.Nil(t, results[1].Signature)
+	assert.ErrorIs(t, results[1].Err, assert.AnError)
+	assert.NotNil(t, results[2].Signature)
+	persister.AssertNumberOfCalls(t, "SaveSignature", 2)
+}
+
+func TestSignatureService_SignTransactions_InactiveDevice(t *testing.T) {
+	deviceSvc := new(MockDeviceServer)
+	persister := new(MockSignaturePersister)
+
+	deviceID := uuid.New()
+	deviceSvc.On("GetDevice", mock.Anything, deviceID).
+		Return(Device{ID: deviceID, Status: StatusDeactivated}, nil)
+	persister.On("RunTransaction", mock.Anything, deviceID, mock.Anything).Return(nil)
+
+	ss := NewSignatureService(zap.NewNop().Sugar(), deviceSvc, nil, nil, persister, 0)
+
+	_, err := ss.SignTransactions(context.Background(), deviceID, []string{"first"}, BatchBestEffort)
+
+	assert.ErrorIs(t, err, ErrDeviceInactive)
+}
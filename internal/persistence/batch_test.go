@@ -0,0 +1,105 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRunTransaction_Nested(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			device := newTestDevice(t)
+			require.NoError(t, store.CreateDevice(ctx, device))
+
+			errRollback := errors.New("rollback")
+			err := store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+				require.NoError(t, store.SaveSignature(ctx, device.ID, newTestSignature(device, 0, "first", "first")))
+				require.NoError(t, store.IncrementSignatureCounter(ctx, device.ID))
+
+				// A failed nested transaction discards its own writes only
+				err := store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+					require.NoError(t, store.SaveSignature(ctx, device.ID, newTestSignature(device, 1, "lost", "lost")))
+					require.NoError(t, store.IncrementSignatureCounter(ctx, device.ID))
+
+					return errRollback
+				})
+				require.ErrorIs(t, err, errRollback)
+
+				return store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+					err := store.SaveSignature(ctx, device.ID, newTestSignature(device, 1, "second", "second"))
+					if err != nil {
+						return err
+					}
+
+					return store.IncrementSignatureCounter(ctx, device.ID)
+				})
+			})
+			require.NoError(t, err)
+
+			signatures, err := store.GetSignatures(ctx, device.ID)
+			require.NoError(t, err)
+			require.Len(t, signatures, 2)
+			require.Equal(t, "first", signatures[0].Signature)
+			require.Equal(t, "second", signatures[1].Signature)
+
+			got, err := store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), got.SignatureCounter)
+
+			// The writes of a committed nested transaction are discarded with the outer one
+			err = store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+				require.NoError(t, store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+					return store.IncrementSignatureCounter(ctx, device.ID)
+				}))
+
+				return errRollback
+			})
+			require.ErrorIs(t, err, errRollback)
+
+			got, err = store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), got.SignatureCounter)
+		})
+	}
+}
+
+func TestSignTransactions(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := zap.NewNop().Sugar()
+			device := newTestDevice(t)
+			require.NoError(t, store.CreateDevice(ctx, device))
+
+			deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+			signatureSvc := domain.NewSignatureService(
+				logger, deviceSvc, crypto.NewSignerCreator(), crypto.NewVerifierCreator(), store, 0,
+			)
+
+			results, err := signatureSvc.SignTransactions(ctx, device.ID, []string{"a", "b", "c"}, domain.BatchAllOrNothing)
+			require.NoError(t, err)
+			require.Len(t, results, 3)
+
+			for i, result := range results {
+				require.NoError(t, result.Err)
+				require.Equal(t, uint64(i), result.Signature.Counter)
+			}
+
+			results, err = signatureSvc.SignTransactions(ctx, device.ID, []string{"d", "e"}, domain.BatchBestEffort)
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), results[1].Signature.Counter)
+			require.Equal(t, "4_e_"+results[0].Signature.Signature, results[1].Signature.OriginalData)
+
+			audit, err := signatureSvc.AuditChain(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, domain.ChainAudit{Valid: true, Checked: 5}, audit)
+		})
+	}
+}
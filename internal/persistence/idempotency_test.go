@@ -0,0 +1,117 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			device := newTestDevice(t)
+			require.NoError(t, store.CreateDevice(ctx, device))
+
+			_, err := store.GetIdempotencyKey(ctx, device.ID, "first")
+			require.ErrorIs(t, err, domain.ErrIdempotencyKeyNotFound)
+
+			start := time.Now().UTC()
+			first := domain.IdempotencyKey{Key: "first", PayloadHash: "hash-1", Counter: 0, CreatedAt: start}
+			second := domain.IdempotencyKey{Key: "second", PayloadHash: "hash-2", Counter: 1, CreatedAt: start.Add(time.Minute)}
+			require.NoError(t, store.SaveIdempotencyKey(ctx, device.ID, first))
+			require.NoError(t, store.SaveIdempotencyKey(ctx, device.ID, second))
+
+			got, err := store.GetIdempotencyKey(ctx, device.ID, "first")
+			require.NoError(t, err)
+			require.Equal(t, first, got)
+
+			// Saving a key again replaces it
+			first.PayloadHash, first.Counter, first.CreatedAt = "hash-3", 2, start.Add(2*time.Minute)
+			require.NoError(t, store.SaveIdempotencyKey(ctx, device.ID, first))
+
+			got, err = store.GetIdempotencyKey(ctx, device.ID, "first")
+			require.NoError(t, err)
+			require.Equal(t, first, got)
+
+			// Only the keys created before the time are deleted
+			require.NoError(t, store.DeleteIdempotencyKeys(ctx, device.ID, start.Add(90*time.Second)))
+
+			_, err = store.GetIdempotencyKey(ctx, device.ID, "second")
+			require.ErrorIs(t, err, domain.ErrIdempotencyKeyNotFound)
+
+			got, err = store.GetIdempotencyKey(ctx, device.ID, "first")
+			require.NoError(t, err)
+			require.Equal(t, first, got)
+
+			// Writes of a failed transaction are discarded
+			errRollback := errors.New("rollback")
+			err = store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+				require.NoError(t, store.DeleteIdempotencyKeys(ctx, device.ID, start.Add(time.Hour)))
+				require.NoError(t, store.SaveIdempotencyKey(ctx, device.ID, second))
+
+				return errRollback
+			})
+			require.ErrorIs(t, err, errRollback)
+
+			got, err = store.GetIdempotencyKey(ctx, device.ID, "first")
+			require.NoError(t, err)
+			require.Equal(t, first, got)
+
+			_, err = store.GetIdempotencyKey(ctx, device.ID, "second")
+			require.ErrorIs(t, err, domain.ErrIdempotencyKeyNotFound)
+		})
+	}
+}
+
+func TestSignTransactionIdempotent(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := zap.NewNop().Sugar()
+			device := newTestDevice(t)
+			require.NoError(t, store.CreateDevice(ctx, device))
+
+			deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+			signatureSvc := domain.NewSignatureService(
+				logger, deviceSvc, crypto.NewSignerCreator(), crypto.NewVerifierCreator(), store, time.Hour,
+			)
+
+			first, replayed, err := signatureSvc.SignTransactionIdempotent(ctx, device.ID, "data", "key")
+			require.NoError(t, err)
+			require.False(t, replayed)
+
+			// A retry returns the original signature without signing again
+			retried, replayed, err := signatureSvc.SignTransactionIdempotent(ctx, device.ID, "data", "key")
+			require.NoError(t, err)
+			require.True(t, replayed)
+			require.True(t, first.SignedAt.Equal(retried.SignedAt))
+
+			first.SignedAt = retried.SignedAt // stores may return the time in another location
+			require.Equal(t, first, retried)
+
+			_, _, err = signatureSvc.SignTransactionIdempotent(ctx, device.ID, "other data", "key")
+			require.ErrorIs(t, err, domain.ErrConflict)
+
+			got, err := store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), got.SignatureCounter)
+
+			// Once the key expires, it signs the data again
+			expiringSvc := domain.NewSignatureService(
+				logger, deviceSvc, crypto.NewSignerCreator(), crypto.NewVerifierCreator(), store, time.Nanosecond,
+			)
+
+			second, replayed, err := expiringSvc.SignTransactionIdempotent(ctx, device.ID, "data", "key")
+			require.NoError(t, err)
+			require.False(t, replayed)
+			require.Equal(t, uint64(1), second.Counter)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestImportDevice(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := zap.NewNop().Sugar()
+
+			deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+			signatureSvc := domain.NewSignatureService(
+				logger, deviceSvc, crypto.NewSignerCreator(), crypto.NewVerifierCreator(), store, 0,
+			)
+
+			// The device comes from another system, which created three signatures with it
+			exported := newTestDevice(t)
+			_, privateKey, err := crypto.NewMarshaler().Marshal(uuid.Nil, 1, exported.KeyPair)
+			require.NoError(t, err)
+
+			device, err := deviceSvc.ImportDevice(ctx, domain.DeviceImport{
+				Algorithm:        domain.AlgorithmECC,
+				KeyParams:        domain.KeyParams{Hash: domain.HashSHA256},
+				PrivateKey:       privateKey,
+				SignatureCounter: 3,
+				LastSignature:    "bGFzdA==",
+			})
+			require.NoError(t, err)
+
+			stored, err := store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, exported.KeyPair, stored.KeyPair)
+			require.Equal(t, exported.KeyParams, stored.KeyParams)
+			require.Equal(t, uint64(3), stored.SignatureCounter)
+			require.Equal(t, uint64(3), stored.ImportedCounter)
+			require.Equal(t, "bGFzdA==", stored.ImportedSignature)
+
+			// The chain continues from the imported state
+			first, err := signatureSvc.SignTransaction(ctx, device.ID, "a")
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), first.Counter)
+			require.Equal(t, "3_a_bGFzdA==", first.OriginalData)
+
+			second, err := signatureSvc.SignTransaction(ctx, device.ID, "b")
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), second.Counter)
+			require.Equal(t, "4_b_"+first.Signature, second.OriginalData)
+
+			valid, err := signatureSvc.VerifySignature(ctx, device.ID, first.Signature, first.OriginalData)
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			audit, err := signatureSvc.AuditChain(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, domain.ChainAudit{Valid: true, Checked: 2}, audit)
+		})
+	}
+}
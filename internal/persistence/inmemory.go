@@ -1,65 +1,162 @@
 package persistence
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 type KeyPairMarshaler interface {
-	Marshal(pair domain.KeyPair) ([]byte, []byte, error)
-	Unmarshal(algo domain.Algorithm, privateKeyBytes []byte) (domain.KeyPair, error)
+	// Marshal encodes the key pair of the device key with the given version. It returns the public and the private key.
+	Marshal(deviceID uuid.UUID, version int, pair domain.KeyPair) ([]byte, []byte, error)
+	// Unmarshal decodes the private key of the device key with the given version.
+	Unmarshal(deviceID uuid.UUID, version int, algo domain.Algorithm, privateKeyBytes []byte) (domain.KeyPair, error)
 }
 
 type Signature struct {
+	counter      uint64
 	signature    string // base64 encoded signature
 	originalData string // original data used for signing
+	algorithm    string
+	keyVersion   int
 	createdAt    time.Time
 }
 
+func (s Signature) toDomain(deviceID uuid.UUID) domain.SignedData {
+	return domain.SignedData{
+		DeviceID:     deviceID,
+		Counter:      s.counter,
+		Signature:    s.signature,
+		OriginalData: s.originalData,
+		Algorithm:    domain.Algorithm(s.algorithm),
+		KeyVersion:   s.keyVersion,
+		SignedAt:     s.createdAt,
+	}
+}
+
+// IdempotencyKey is a client provided key remembered with the counter of the signature created for it.
+type IdempotencyKey struct {
+	key         string
+	payloadHash string
+	counter     uint64
+	createdAt   time.Time
+}
+
+// RetiredKey is a device key which was replaced by a key rotation.
+type RetiredKey struct {
+	version    int
+	privateKey []byte
+	algorithm  string
+	params     domain.KeyParams
+	validFrom  uint64
+	validUntil uint64
+	retiredAt  time.Time
+}
+
 type Device struct {
 	id               uuid.UUID
 	signatureCounter uint64
 	privateKey       []byte
 	algorithm        string
+	keyParams        domain.KeyParams
+	keyVersion       int
+	keyValidFrom     uint64
+	retiredKeys      []RetiredKey
 	label            *string
+	status           string
+	createdAt        time.Time
+	statusChangedAt  time.Time
+	importedCounter  uint64
+	importedSig      string
 	signatures       []Signature
+	idempotencyKeys  map[string]IdempotencyKey
+	idempotencyOrder []IdempotencyKey // saved keys in creation order, replaced keys are left in place
+}
+
+// deviceEntry holds the committed state of a device.
+type deviceEntry struct {
+	// writer is held for the whole transaction, so there is only one writer of the device at a time. Readers do not
+	// wait for it, they read the committed device.
+	writer sync.Mutex
+
+	// mu guards the committed device, which is replaced when a transaction commits, and the maps it shares with the
+	// staged copy.
+	mu     sync.RWMutex
+	device Device
+}
+
+// inMemoryTx holds a copy of the device which is changed inside RunTransaction. The copy replaces the committed
+// device only when the transaction function succeeds, otherwise it is discarded.
+type inMemoryTx struct {
+	entry  *deviceEntry
+	device Device
 
-	sync.Mutex // We need to lock the device when adding a new signature
+	// undo reverts the writes to the maps of the device, which the copy shares with the committed device
+	undo []func()
+
+	// parent is the transaction the context carried before, which may be one of another device
+	parent *inMemoryTx
 }
 
+type inMemoryTxKey struct{}
+
 // InMemory is an in-memory implementation of the persistence layer.
 type InMemory struct {
-	storage map[uuid.UUID]*Device
+	mu      sync.RWMutex // guards storage, the devices are guarded by their own locks
+	storage map[uuid.UUID]*deviceEntry
 
 	kpMarshaler KeyPairMarshaler
+	keys        *keyCache
 }
 
 // NewInMemory creates a new InMemory persistence layer. I pass context to every function to be able to cancel the
-// operation if needed. This is a good practice, even if we do not use it in this implementation.
-func NewInMemory(kpMarshaler KeyPairMarshaler) *InMemory {
+// operation if needed. This is a good practice, even if we do not use it in this implementation. Up to keyCacheSize
+// decoded key pairs are cached. The forgetters are told when the keys of a device change.
+func NewInMemory(kpMarshaler KeyPairMarshaler, keyCacheSize int, forgetters ...KeyForgetter) *InMemory {
 	return &InMemory{
-		storage:     make(map[uuid.UUID]*Device),
+		storage:     make(map[uuid.UUID]*deviceEntry),
 		kpMarshaler: kpMarshaler,
+		keys:        newKeyCache(kpMarshaler, keyCacheSize, forgetters),
 	}
 }
 
 // CreateDevice creates a new device in the persistence layer.
 func (p *InMemory) CreateDevice(ctx context.Context, device domain.Device) error {
-	_, priv, err := p.kpMarshaler.Marshal(device.KeyPair)
+	_, priv, err := p.kpMarshaler.Marshal(device.ID, device.KeyVersion, device.KeyPair)
 	if err != nil {
 		return fmt.Errorf("could not marshal key pair: %w", err)
 	}
 
-	p.storage[device.ID] = &Device{
-		id:               device.ID,
-		signatureCounter: device.SignatureCounter,
-		privateKey:       priv,
-		algorithm:        device.Algorithm.String(),
-		label:            device.Label,
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.storage[device.ID]; ok {
+		return fmt.Errorf("%w: device %s already exists", domain.ErrConflict, device.ID)
+	}
+
+	p.storage[device.ID] = &deviceEntry{
+		device: Device{
+			id:               device.ID,
+			signatureCounter: device.SignatureCounter,
+			privateKey:       priv,
+			algorithm:        device.Algorithm.String(),
+			keyParams:        device.KeyParams,
+			keyVersion:       device.KeyVersion,
+			keyValidFrom:     device.KeyValidFrom,
+			label:            device.Label,
+			status:           device.Status.String(),
+			createdAt:        device.CreatedAt,
+			statusChangedAt:  device.StatusChangedAt,
+			importedCounter:  device.ImportedCounter,
+			importedSig:      device.ImportedSignature,
+		},
 	}
 
 	return nil
@@ -67,115 +164,552 @@ func (p *InMemory) CreateDevice(ctx context.Context, device domain.Device) error
 
 // IncrementSignatureCounter increments the signature counter for a device in the persistence layer.
 func (p *InMemory) IncrementSignatureCounter(ctx context.Context, id uuid.UUID) error {
-	device, ok := p.storage[id]
-	if !ok {
-		return fmt.Errorf("device not found")
+	return p.update(ctx, id, func(tx *inMemoryTx) error {
+		tx.device.signatureCounter++
+
+		return nil
+	})
+}
+
+// UpdateDeviceStatus sets a new lifecycle status for a device in the persistence layer.
+func (p *InMemory) UpdateDeviceStatus(ctx context.Context, id uuid.UUID, status domain.Status, changedAt time.Time) error {
+	return p.update(ctx, id, func(tx *inMemoryTx) error {
+		tx.device.status = status.String()
+		tx.device.statusChangedAt = changedAt
+
+		return nil
+	})
+}
+
+// RotateDeviceKey replaces the current key of a device and keeps the current one as a retired key.
+func (p *InMemory) RotateDeviceKey(ctx context.Context, id uuid.UUID, rotation domain.KeyRotation) error {
+	_, priv, err := p.kpMarshaler.Marshal(id, rotation.Version, rotation.KeyPair)
+	if err != nil {
+		return fmt.Errorf("could not marshal key pair: %w", err)
 	}
 
-	device.signatureCounter++
+	defer p.keys.forget(id)
 
-	return nil
+	return p.update(ctx, id, func(tx *inMemoryTx) error {
+		device := &tx.device
+		device.retiredKeys = append(device.retiredKeys, RetiredKey{
+			version:    device.keyVersion,
+			privateKey: device.privateKey,
+			algorithm:  device.algorithm,
+			params:     device.keyParams,
+			validFrom:  device.keyValidFrom,
+			validUntil: rotation.ValidFrom,
+			retiredAt:  rotation.RotatedAt,
+		})
+
+		device.privateKey = priv
+		device.algorithm = rotation.Algorithm.String()
+		device.keyParams = rotation.Params
+		device.keyVersion = rotation.Version
+		device.keyValidFrom = rotation.ValidFrom
+
+		return nil
+	})
 }
 
-// GetDevices returns all devices from the persistence layer.
-func (p *InMemory) GetDevices(ctx context.Context) ([]domain.Device, error) {
-	devices := make([]domain.Device, 0, len(p.storage))
-	for _, device := range p.storage {
-		kp, err := p.kpMarshaler.Unmarshal(domain.Algorithm(device.algorithm), device.privateKey)
+// RewriteDeviceKeys replaces the stored private keys of a device, the current and the retired ones, with what
+// rewrite returns for them. The keys must still decode to the same key pairs. It returns the number of changed keys.
+func (p *InMemory) RewriteDeviceKeys(
+	ctx context.Context, id uuid.UUID, rewrite func(deviceID uuid.UUID, version int, privateKey []byte) ([]byte, error),
+) (int, error) {
+	var changed int
+
+	defer p.keys.forget(id)
+
+	err := p.update(ctx, id, func(tx *inMemoryTx) error {
+		changed = 0
+
+		privateKey, err := rewrite(id, tx.device.keyVersion, tx.device.privateKey)
 		if err != nil {
-			return nil, fmt.Errorf("could not unmarshal key pair: %w", err)
+			return fmt.Errorf("could not rewrite key: %w", err)
+		}
+		if !bytes.Equal(privateKey, tx.device.privateKey) {
+			tx.device.privateKey = privateKey
+			changed++
 		}
 
-		devices = append(devices, domain.Device{
-			ID:               device.id,
-			SignatureCounter: device.signatureCounter,
-			KeyPair:          kp,
-			Algorithm:        domain.Algorithm(device.algorithm),
-			Label:            device.label,
+		// The retired keys are shared with the committed device, so they are changed on a copy
+		retiredKeys := slices.Clone(tx.device.retiredKeys)
+		for i, key := range retiredKeys {
+			privateKey, err := rewrite(id, key.version, key.privateKey)
+			if err != nil {
+				return fmt.Errorf("could not rewrite retired key: %w", err)
+			}
+			if !bytes.Equal(privateKey, key.privateKey) {
+				retiredKeys[i].privateKey = privateKey
+				changed++
+			}
+		}
+		tx.device.retiredKeys = retiredKeys
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return changed, nil
+}
+
+// GetDevices returns all devices from the persistence layer, ordered by creation time.
+func (p *InMemory) GetDevices(ctx context.Context) ([]domain.Device, error) {
+	page, err := p.QueryDevices(ctx, domain.DeviceQuery{})
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Devices, nil
+}
+
+// QueryDevices returns a page of the devices matching the query, ordered by creation time, then by ID.
+func (p *InMemory) QueryDevices(ctx context.Context, query domain.DeviceQuery) (domain.DevicePage, error) {
+	p.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(p.storage))
+	for id := range p.storage {
+		ids = append(ids, id)
+	}
+	p.mu.RUnlock()
+
+	stored := make([]Device, 0, len(ids))
+	for _, id := range ids {
+		// The copy shares the slices of the device, which are only appended to, so it can be read after the lock
+		// is released
+		var device Device
+		err := p.view(ctx, id, func(d *Device) error {
+			device = *d
+
+			return nil
 		})
+		if err != nil {
+			return domain.DevicePage{}, err
+		}
+
+		if query.After != nil && !deviceAfter(&device, *query.After) {
+			continue
+		}
+		if query.Algorithm != "" && device.algorithm != query.Algorithm.String() {
+			continue
+		}
+		if query.LabelPrefix != "" && (device.label == nil || !strings.HasPrefix(*device.label, query.LabelPrefix)) {
+			continue
+		}
+
+		stored = append(stored, device)
+	}
+
+	sort.Slice(stored, func(i, j int) bool {
+		return deviceAfter(&stored[j], domain.DeviceCursor{CreatedAt: stored[i].createdAt, ID: stored[i].id})
+	})
+
+	var next *domain.DeviceCursor
+	if query.Limit > 0 && len(stored) > query.Limit {
+		stored = stored[:query.Limit]
+
+		last := stored[len(stored)-1]
+		next = &domain.DeviceCursor{CreatedAt: last.createdAt, ID: last.id}
 	}
 
-	return devices, nil
+	devices := make([]domain.Device, 0, len(stored))
+	for _, device := range stored {
+		d, err := p.toDomain(&device)
+		if err != nil {
+			return domain.DevicePage{}, err
+		}
+
+		devices = append(devices, d)
+	}
+
+	return domain.DevicePage{Devices: devices, Next: next}, nil
+}
+
+// deviceAfter reports whether the device comes after the cursor in the listing order.
+func deviceAfter(device *Device, cursor domain.DeviceCursor) bool {
+	if !device.createdAt.Equal(cursor.CreatedAt) {
+		return device.createdAt.After(cursor.CreatedAt)
+	}
+
+	return device.id.String() > cursor.ID.String()
 }
 
 // GetDevice returns a device from the persistence layer.
 func (p *InMemory) GetDevice(ctx context.Context, id uuid.UUID) (domain.Device, error) {
-	device, ok := p.storage[id]
-	if !ok {
-		return domain.Device{}, fmt.Errorf("device not found")
-	}
+	var device domain.Device
+	err := p.view(ctx, id, func(d *Device) error {
+		var err error
+		device, err = p.toDomain(d)
+
+		return err
+	})
 
-	kp, err := p.kpMarshaler.Unmarshal(domain.Algorithm(device.algorithm), device.privateKey)
+	return device, err
+}
+
+// toDomain converts the stored device to the domain one.
+func (p *InMemory) toDomain(device *Device) (domain.Device, error) {
+	kp, err := p.keys.decode(device.id, device.keyVersion, domain.Algorithm(device.algorithm), device.privateKey)
 	if err != nil {
 		return domain.Device{}, fmt.Errorf("could not unmarshal key pair: %w", err)
 	}
 
+	retiredKeys := make([]domain.RetiredKey, 0, len(device.retiredKeys))
+	for _, key := range device.retiredKeys {
+		retiredKp, err := p.keys.decode(device.id, key.version, domain.Algorithm(key.algorithm), key.privateKey)
+		if err != nil {
+			return domain.Device{}, fmt.Errorf("could not unmarshal retired key pair: %w", err)
+		}
+
+		retiredKeys = append(retiredKeys, domain.RetiredKey{
+			DeviceKey: domain.DeviceKey{
+				Version:   key.version,
+				KeyPair:   retiredKp,
+				Algorithm: domain.Algorithm(key.algorithm),
+				Params:    key.params,
+				ValidFrom: key.validFrom,
+			},
+			ValidUntil: key.validUntil,
+			RetiredAt:  key.retiredAt,
+		})
+	}
+
 	return domain.Device{
 		ID:               device.id,
 		SignatureCounter: device.signatureCounter,
 		KeyPair:          kp,
 		Algorithm:        domain.Algorithm(device.algorithm),
+		KeyParams:        device.keyParams,
+		KeyVersion:       device.keyVersion,
+		KeyValidFrom:     device.keyValidFrom,
+		RetiredKeys:      retiredKeys,
 		Label:            device.label,
+		Status:           domain.Status(device.status),
+		CreatedAt:        device.createdAt,
+		StatusChangedAt:  device.statusChangedAt,
+
+		ImportedCounter:   device.importedCounter,
+		ImportedSignature: device.importedSig,
 	}, nil
 }
 
-// SaveSignature saves a signature for a device in the persistence layer.
+// SaveSignature saves a signature for a device in the persistence layer. The signature is stored under the current
+// value of the device signature counter.
 func (p *InMemory) SaveSignature(ctx context.Context, deviceID uuid.UUID, data domain.SignedData) error {
-	device, ok := p.storage[deviceID]
-	if !ok {
-		return fmt.Errorf("device not found")
-	}
+	return p.update(ctx, deviceID, func(tx *inMemoryTx) error {
+		tx.device.signatures = append(tx.device.signatures, Signature{
+			counter:      tx.device.signatureCounter,
+			signature:    data.Signature,
+			originalData: data.OriginalData,
+			algorithm:    data.Algorithm.String(),
+			keyVersion:   data.KeyVersion,
+			createdAt:    data.SignedAt,
+		})
 
-	device.signatures = append(device.signatures, Signature{
-		signature:    data.Signature,
-		originalData: data.OriginalData,
-		createdAt:    time.Now(),
+		return nil
 	})
-
-	return nil
 }
 
 // GetLastSignature returns the last signature for a device from the persistence layer.
 func (p *InMemory) GetLastSignature(ctx context.Context, deviceID uuid.UUID) (domain.SignedData, error) {
-	device, ok := p.storage[deviceID]
-	if !ok {
-		return domain.SignedData{}, fmt.Errorf("device not found")
-	}
+	var signature domain.SignedData
+	err := p.view(ctx, deviceID, func(device *Device) error {
+		if len(device.signatures) == 0 {
+			return fmt.Errorf("%w: device %s has no signatures", domain.ErrSignatureNotFound, deviceID)
+		}
 
-	if len(device.signatures) == 0 {
-		return domain.SignedData{}, fmt.Errorf("no signatures found")
-	}
+		signature = device.signatures[len(device.signatures)-1].toDomain(deviceID)
 
-	lastSignature := device.signatures[len(device.signatures)-1]
-	return domain.SignedData{
-		OriginalData: lastSignature.originalData,
-		Signature:    lastSignature.signature,
-	}, nil
+		return nil
+	})
+
+	return signature, err
+}
+
+// GetSignature returns the signature created with the given counter value from the persistence layer.
+func (p *InMemory) GetSignature(ctx context.Context, deviceID uuid.UUID, counter uint64) (domain.SignedData, error) {
+	var signature domain.SignedData
+	err := p.view(ctx, deviceID, func(device *Device) error {
+		// Signatures are appended in counter order
+		i := sort.Search(len(device.signatures), func(i int) bool {
+			return device.signatures[i].counter >= counter
+		})
+		if i == len(device.signatures) || device.signatures[i].counter != counter {
+			return fmt.Errorf("%w: device %s, counter %d", domain.ErrSignatureNotFound, deviceID, counter)
+		}
+
+		signature = device.signatures[i].toDomain(deviceID)
+
+		return nil
+	})
+
+	return signature, err
 }
 
 // GetSignatures returns all signatures for a device from the persistence layer.
 func (p *InMemory) GetSignatures(ctx context.Context, deviceID uuid.UUID) ([]domain.SignedData, error) {
-	device, ok := p.storage[deviceID]
+	var signatures []domain.SignedData
+	err := p.view(ctx, deviceID, func(device *Device) error {
+		signatures = make([]domain.SignedData, 0, len(device.signatures))
+		for _, signature := range device.signatures {
+			signatures = append(signatures, signature.toDomain(deviceID))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return signatures, nil
+}
+
+// QuerySignatures returns a page of the device signatures matching the query, ordered by counter.
+func (p *InMemory) QuerySignatures(ctx context.Context, deviceID uuid.UUID, query domain.SignatureQuery) (domain.SignaturePage, error) {
+	var (
+		signatures  = make([]domain.SignedData, 0)
+		lastCounter uint64
+		next        *uint64
+	)
+	err := p.view(ctx, deviceID, func(device *Device) error {
+		for _, signature := range device.signatures {
+			switch {
+			case query.After != nil && signature.counter <= *query.After,
+				query.CounterFrom != nil && signature.counter < *query.CounterFrom,
+				query.CounterTo != nil && signature.counter > *query.CounterTo,
+				!query.CreatedFrom.IsZero() && signature.createdAt.Before(query.CreatedFrom),
+				!query.CreatedTo.IsZero() && !signature.createdAt.Before(query.CreatedTo):
+				continue
+			}
+
+			// There is one more matching signature than fits into the page, so another page follows
+			if query.Limit > 0 && len(signatures) == query.Limit {
+				next = &lastCounter
+
+				break
+			}
+
+			signatures = append(signatures, signature.toDomain(deviceID))
+			lastCounter = signature.counter
+		}
+
+		return nil
+	})
+	if err != nil {
+		return domain.SignaturePage{}, err
+	}
+
+	return domain.SignaturePage{Signatures: signatures, Next: next}, nil
+}
+
+// GetIdempotencyKey returns an idempotency key saved for a device from the persistence layer.
+func (p *InMemory) GetIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key string) (domain.IdempotencyKey, error) {
+	var (
+		stored IdempotencyKey
+		ok     bool
+	)
+	err := p.view(ctx, deviceID, func(device *Device) error {
+		stored, ok = device.idempotencyKeys[key]
+
+		return nil
+	})
+	if err != nil {
+		return domain.IdempotencyKey{}, err
+	}
+
 	if !ok {
-		return nil, fmt.Errorf("device not found")
+		return domain.IdempotencyKey{}, fmt.Errorf("%w: device %s, key %q", domain.ErrIdempotencyKeyNotFound, deviceID, key)
 	}
 
-	signatures := make([]domain.SignedData, 0, len(device.signatures))
-	for _, signature := range device.signatures {
-		signatures = append(signatures, domain.SignedData{
-			OriginalData: signature.originalData,
-			Signature:    signature.signature,
-		})
+	return domain.IdempotencyKey{
+		Key:         stored.key,
+		PayloadHash: stored.payloadHash,
+		Counter:     stored.counter,
+		CreatedAt:   stored.createdAt,
+	}, nil
+}
+
+// SaveIdempotencyKey saves an idempotency key for a device in the persistence layer, replacing the one with the same
+// key.
+func (p *InMemory) SaveIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key domain.IdempotencyKey) error {
+	stored := IdempotencyKey{
+		key:         key.Key,
+		payloadHash: key.PayloadHash,
+		counter:     key.Counter,
+		createdAt:   key.CreatedAt,
 	}
 
-	return signatures, nil
+	return p.update(ctx, deviceID, func(tx *inMemoryTx) error {
+		if tx.device.idempotencyKeys == nil {
+			tx.device.idempotencyKeys = make(map[string]IdempotencyKey)
+		}
+
+		tx.setIdempotencyKey(key.Key, &stored)
+		tx.device.idempotencyOrder = append(tx.device.idempotencyOrder, stored)
+
+		return nil
+	})
+}
+
+// DeleteIdempotencyKeys deletes the idempotency keys of a device created before the given time.
+func (p *InMemory) DeleteIdempotencyKeys(ctx context.Context, deviceID uuid.UUID, createdBefore time.Time) error {
+	return p.update(ctx, deviceID, func(tx *inMemoryTx) error {
+		device := &tx.device
+
+		i := 0
+		for ; i < len(device.idempotencyOrder) && device.idempotencyOrder[i].createdAt.Before(createdBefore); i++ {
+			expired := device.idempotencyOrder[i]
+
+			// Skip the keys which were replaced after this one was saved
+			current, ok := device.idempotencyKeys[expired.key]
+			if ok && current.createdAt.Equal(expired.createdAt) {
+				tx.setIdempotencyKey(expired.key, nil)
+			}
+		}
+
+		device.idempotencyOrder = device.idempotencyOrder[i:]
+
+		return nil
+	})
+}
+
+// setIdempotencyKey sets the key in the device map, or deletes it if stored is nil. The write is reverted if the
+// transaction fails.
+func (tx *inMemoryTx) setIdempotencyKey(key string, stored *IdempotencyKey) {
+	// The map may be shared with the committed device, which is read without holding the writer lock
+	tx.entry.mu.Lock()
+	defer tx.entry.mu.Unlock()
+
+	keys := tx.device.idempotencyKeys
+	previous, existed := keys[key]
+
+	if stored != nil {
+		keys[key] = *stored
+	} else {
+		delete(keys, key)
+	}
+
+	tx.undo = append(tx.undo, func() {
+		tx.entry.mu.Lock()
+		defer tx.entry.mu.Unlock()
+
+		if existed {
+			keys[key] = previous
+		} else {
+			delete(keys, key)
+		}
+	})
 }
 
 // RunTransaction runs a transaction in the persistence layer. In this implementation it will get a mutex for specific
 // device. I wrote this function like this to show how I would implement it with the regular database.
+//
+// Writes made to the device inside fn are staged and become visible to the other callers only if fn succeeds. If fn
+// returns an error, they are discarded and the device is left as it was before the transaction. Called inside another
+// transaction of the same device, the writes are staged on top of the outer transaction instead, and only the own
+// writes are discarded if fn fails. Reads do not wait for transactions, outside of fn they see the committed device.
 func (p *InMemory) RunTransaction(ctx context.Context, deviceID uuid.UUID, fn func(ctx context.Context) error) error {
-	p.storage[deviceID].Lock()
-	defer p.storage[deviceID].Unlock()
+	if outer := txFor(ctx, deviceID); outer != nil {
+		tx, err := p.stage(ctx, outer.entry, outer.device, fn)
+		if err != nil {
+			return err
+		}
+
+		// The outer transaction reverts the nested writes too, if it fails later
+		outer.device = tx.device
+		outer.undo = append(outer.undo, tx.undo...)
+
+		return nil
+	}
+
+	entry, err := p.entry(deviceID)
+	if err != nil {
+		return err
+	}
+
+	entry.writer.Lock()
+	defer entry.writer.Unlock()
+
+	// The committed device is only replaced by the holder of the writer lock, so it can be read without the other one
+	tx, err := p.stage(ctx, entry, entry.device, fn)
+	if err != nil {
+		return err
+	}
+
+	// Commit staged writes
+	entry.mu.Lock()
+	entry.device = tx.device
+	entry.mu.Unlock()
+
+	return nil
+}
+
+// stage runs fn with writes staged on a copy of the device. If fn fails, the writes which could not be staged are
+// reverted and the copy is discarded.
+func (p *InMemory) stage(ctx context.Context, entry *deviceEntry, device Device, fn func(ctx context.Context) error) (*inMemoryTx, error) {
+	parent, _ := ctx.Value(inMemoryTxKey{}).(*inMemoryTx)
+	tx := &inMemoryTx{entry: entry, device: device, parent: parent}
+
+	err := fn(context.WithValue(ctx, inMemoryTxKey{}, tx))
+	if err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// txFor returns the innermost transaction of the device the context carries, or nil if there is none.
+func txFor(ctx context.Context, id uuid.UUID) *inMemoryTx {
+	tx, _ := ctx.Value(inMemoryTxKey{}).(*inMemoryTx)
+	for ; tx != nil; tx = tx.parent {
+		if tx.device.id == id {
+			return tx
+		}
+	}
+
+	return nil
+}
+
+// update runs fn on the staged copy of the device. Outside of RunTransaction, fn runs in a transaction of its own.
+func (p *InMemory) update(ctx context.Context, id uuid.UUID, fn func(tx *inMemoryTx) error) error {
+	return p.RunTransaction(ctx, id, func(ctx context.Context) error {
+		return fn(txFor(ctx, id))
+	})
+}
+
+// view runs fn with the device to read. Inside RunTransaction it is the staged copy of the device, outside of it the
+// committed device, which is locked until fn returns. The device must not be changed or kept after that.
+func (p *InMemory) view(ctx context.Context, id uuid.UUID, fn func(device *Device) error) error {
+	if tx := txFor(ctx, id); tx != nil {
+		return fn(&tx.device)
+	}
+
+	entry, err := p.entry(id)
+	if err != nil {
+		return err
+	}
+
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+
+	return fn(&entry.device)
+}
+
+// entry returns the stored entry of the device.
+func (p *InMemory) entry(id uuid.UUID) (*deviceEntry, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	entry, ok := p.storage[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", domain.ErrDeviceNotFound, id)
+	}
 
-	return fn(ctx)
+	return entry, nil
 }
@@ -0,0 +1,383 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// failingDeviceServer reads devices from the persister, but fails to increment the signature counter, which happens
+// after the signature was saved.
+type failingDeviceServer struct {
+	persister *InMemory
+}
+
+func (f *failingDeviceServer) GetDevice(ctx context.Context, deviceID uuid.UUID) (domain.Device, error) {
+	return f.persister.GetDevice(ctx, deviceID)
+}
+
+func (f *failingDeviceServer) IncrementSignatureCounter(context.Context, uuid.UUID) error {
+	return errors.New("increment failed")
+}
+
+func TestInMemory_RunTransaction_Commit(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+
+	first := newTestSignature(device, 0, "first", "0_a_b")
+
+	err := store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+		err := store.SaveSignature(ctx, device.ID, first)
+		if err != nil {
+			return err
+		}
+
+		err = store.IncrementSignatureCounter(ctx, device.ID)
+		if err != nil {
+			return err
+		}
+
+		// Staged writes are visible inside the transaction
+		staged, err := store.GetDevice(ctx, device.ID)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), staged.SignatureCounter)
+
+		last, err := store.GetLastSignature(ctx, device.ID)
+		require.NoError(t, err)
+		require.Equal(t, "first", last.Signature)
+
+		// ...but not outside of it
+		committed, err := store.GetDevice(context.Background(), device.ID)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), committed.SignatureCounter)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	got, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), got.SignatureCounter)
+
+	signatures, err := store.GetSignatures(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, []domain.SignedData{first}, signatures)
+
+	signature, err := store.GetSignature(ctx, device.ID, 0)
+	require.NoError(t, err)
+	require.Equal(t, first, signature)
+
+	_, err = store.GetSignature(ctx, device.ID, 1)
+	require.ErrorIs(t, err, domain.ErrSignatureNotFound)
+}
+
+func TestInMemory_RunTransaction_Rollback(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+
+	err := store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+		err := store.SaveSignature(ctx, device.ID, domain.SignedData{Signature: "first", OriginalData: "0_a_b"})
+		if err != nil {
+			return err
+		}
+
+		return errors.New("failure between save and increment")
+	})
+	require.Error(t, err)
+
+	got, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), got.SignatureCounter)
+
+	signatures, err := store.GetSignatures(ctx, device.ID)
+	require.NoError(t, err)
+	require.Empty(t, signatures)
+
+	_, err = store.GetLastSignature(ctx, device.ID)
+	require.Error(t, err)
+}
+
+func TestInMemory_RunTransaction_UnknownDevice(t *testing.T) {
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+
+	err := store.RunTransaction(context.Background(), uuid.New(), func(ctx context.Context) error {
+		return nil
+	})
+	require.ErrorIs(t, err, domain.ErrDeviceNotFound)
+
+	_, err = store.GetDevice(context.Background(), uuid.New())
+	require.ErrorIs(t, err, domain.ErrDeviceNotFound)
+}
+
+func TestInMemory_SignTransaction_IncrementFailureKeepsChain(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+
+	deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+	signerCreator := crypto.NewSignerCreator()
+	verifierCreator := crypto.NewVerifierCreator()
+	signatureSvc := domain.NewSignatureService(logger, deviceSvc, signerCreator, verifierCreator, store, 0)
+
+	first, err := signatureSvc.SignTransaction(ctx, device.ID, "first")
+	require.NoError(t, err)
+
+	failingDeviceSvc := &failingDeviceServer{persister: store}
+	failingSvc := domain.NewSignatureService(logger, failingDeviceSvc, signerCreator, verifierCreator, store, 0)
+
+	_, err = failingSvc.SignTransaction(ctx, device.ID, "second")
+	require.Error(t, err)
+
+	got, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), got.SignatureCounter)
+
+	signatures, err := store.GetSignatures(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, []domain.SignedData{first}, signatures)
+
+	// The chain continues from the last committed signature
+	second, err := signatureSvc.SignTransaction(ctx, device.ID, "second")
+	require.NoError(t, err)
+	require.Equal(t, "1_second_"+first.Signature, second.OriginalData)
+
+	audit, err := signatureSvc.AuditChain(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.ChainAudit{Valid: true, Checked: 2}, audit)
+}
+
+func TestInMemory_RotateDeviceKey(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+
+	deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+	signatureSvc := domain.NewSignatureService(
+		logger, deviceSvc, crypto.NewSignerCreator(), crypto.NewVerifierCreator(), store, 0,
+	)
+
+	first, err := signatureSvc.SignTransaction(ctx, device.ID, "first")
+	require.NoError(t, err)
+
+	rotated, err := deviceSvc.RotateKey(
+		ctx, device.ID, domain.AlgorithmRSA, domain.KeyParams{Padding: domain.PaddingPSS, Hash: domain.HashSHA512},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 2, rotated.KeyVersion)
+
+	second, err := signatureSvc.SignTransaction(ctx, device.ID, "second")
+	require.NoError(t, err)
+	require.Equal(t, "1_second_"+first.Signature, second.OriginalData)
+
+	got, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.AlgorithmRSA, got.Algorithm)
+	require.Equal(t, domain.KeyParams{
+		RSABits: 2048, Padding: domain.PaddingPSS, SaltLength: 64, Hash: domain.HashSHA512,
+	}, got.KeyParams)
+	require.Equal(t, 2, got.KeyVersion)
+	require.Equal(t, uint64(1), got.KeyValidFrom)
+	require.Len(t, got.RetiredKeys, 1)
+	require.Equal(t, device.KeyPair, got.RetiredKeys[0].KeyPair)
+	require.Equal(t, device.KeyParams, got.RetiredKeys[0].Params)
+	require.Equal(t, uint64(1), got.RetiredKeys[0].ValidUntil)
+
+	valid, err := signatureSvc.VerifySignature(ctx, device.ID, first.Signature, first.OriginalData)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	audit, err := signatureSvc.AuditChain(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.ChainAudit{Valid: true, Checked: 2}, audit)
+}
+
+func TestInMemory_CreateDevice_Duplicate(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+	require.ErrorIs(t, store.CreateDevice(ctx, device), domain.ErrConflict)
+}
+
+func TestInMemory_RunTransaction_OtherDevice(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+	first, second := newTestDevice(t), newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, first))
+	require.NoError(t, store.CreateDevice(ctx, second))
+
+	done := make(chan error)
+	go func() {
+		done <- store.RunTransaction(ctx, first.ID, func(ctx context.Context) error {
+			require.NoError(t, store.IncrementSignatureCounter(ctx, first.ID))
+
+			// The transaction of the first device is still used inside the one of the second device
+			return store.RunTransaction(ctx, second.ID, func(ctx context.Context) error {
+				staged, err := store.GetDevice(ctx, first.ID)
+				require.NoError(t, err)
+				require.Equal(t, uint64(1), staged.SignatureCounter)
+
+				err = store.IncrementSignatureCounter(ctx, first.ID)
+				if err != nil {
+					return err
+				}
+
+				return store.IncrementSignatureCounter(ctx, second.ID)
+			})
+		})
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested transactions of different devices deadlocked")
+	}
+
+	got, err := store.GetDevice(ctx, first.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), got.SignatureCounter)
+
+	got, err = store.GetDevice(ctx, second.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), got.SignatureCounter)
+}
+
+// TestInMemory_Concurrent creates, signs with and lists devices from many goroutines at once. Run with -race, it
+// fails on unguarded access to the store.
+func TestInMemory_Concurrent(t *testing.T) {
+	const (
+		devices     = 4
+		signers     = 8
+		signatures  = 20
+		creators    = 2
+		created     = 10
+		signedTotal = signers * signatures
+	)
+
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	store := NewInMemory(crypto.NewMarshaler(), testKeyCacheSize)
+
+	deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+	signatureSvc := domain.NewSignatureService(
+		logger, deviceSvc, crypto.NewSignerCreator(), crypto.NewVerifierCreator(), store, time.Hour,
+	)
+
+	ids := make([]uuid.UUID, 0, devices)
+	for range devices {
+		device := newTestDevice(t)
+		require.NoError(t, store.CreateDevice(ctx, device))
+
+		ids = append(ids, device.ID)
+	}
+
+	var writers, readers sync.WaitGroup
+	for signer := range signers {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+
+			for i := range signatures {
+				id := ids[(signer+i)%devices]
+				data := fmt.Sprintf("signer %d, transaction %d", signer, i)
+
+				var err error
+				if i%2 == 0 {
+					_, err = signatureSvc.SignTransaction(ctx, id, data)
+				} else {
+					_, _, err = signatureSvc.SignTransactionIdempotent(ctx, id, data, data)
+				}
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	for range creators {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+
+			label := "created"
+			for range created {
+				_, err := deviceSvc.CreateDevice(ctx, &label, domain.AlgorithmECC, domain.KeyParams{
+					Curve: domain.CurveP256,
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	for reader := range devices {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			id := ids[reader]
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				_, err := store.QueryDevices(ctx, domain.DeviceQuery{Limit: 5, Algorithm: domain.AlgorithmECC})
+				assert.NoError(t, err)
+
+				_, err = store.QuerySignatures(ctx, id, domain.SignatureQuery{Limit: 5})
+				assert.NoError(t, err)
+
+				_, err = store.GetIdempotencyKey(ctx, id, "signer 0, transaction 1")
+				if !errors.Is(err, domain.ErrIdempotencyKeyNotFound) {
+					assert.NoError(t, err)
+				}
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	all, err := store.GetDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, devices+creators*created)
+
+	total := 0
+	for _, id := range ids {
+		device, err := store.GetDevice(ctx, id)
+		require.NoError(t, err)
+
+		audit, err := signatureSvc.AuditChain(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, domain.ChainAudit{Valid: true, Checked: int(device.SignatureCounter)}, audit)
+
+		total += int(device.SignatureCounter)
+	}
+	require.Equal(t, signedTotal, total)
+}
@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/gren236/fiskaly-go-challenge/pkg/cache"
+)
+
+// KeyForgetter drops what it keeps for the keys of a device, like the signers created for them. The persisters tell it
+// when the keys of a device were changed.
+type KeyForgetter interface {
+	Forget(deviceID uuid.UUID)
+}
+
+// keyID identifies a key of a device.
+type keyID struct {
+	deviceID uuid.UUID
+	version  int
+}
+
+type decodedKey struct {
+	privateKey []byte
+	keyPair    domain.KeyPair
+}
+
+// keyCache decodes the private keys of devices and keeps the decoded key pairs by device ID and key version, so a key
+// is not parsed again for every read of its device. A cached key pair is only used while the stored key it was decoded
+// from stays the same, a rotation which was rolled back can not leave a wrong one behind.
+type keyCache struct {
+	marshaler  KeyPairMarshaler
+	decoded    *cache.LRU[keyID, decodedKey]
+	forgetters []KeyForgetter
+}
+
+func newKeyCache(marshaler KeyPairMarshaler, size int, forgetters []KeyForgetter) *keyCache {
+	return &keyCache{
+		marshaler:  marshaler,
+		decoded:    cache.NewLRU[keyID, decodedKey](size),
+		forgetters: forgetters,
+	}
+}
+
+// decode returns the key pair of the device key with the given version, decoded from the stored private key.
+func (c *keyCache) decode(
+	deviceID uuid.UUID, version int, algorithm domain.Algorithm, privateKey []byte,
+) (domain.KeyPair, error) {
+	id := keyID{deviceID: deviceID, version: version}
+
+	cached, ok := c.decoded.Get(id)
+	if ok && bytes.Equal(cached.privateKey, privateKey) {
+		return cached.keyPair, nil
+	}
+
+	kp, err := c.marshaler.Unmarshal(deviceID, version, algorithm, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.decoded.Add(id, decodedKey{privateKey: privateKey, keyPair: kp})
+
+	return kp, nil
+}
+
+// forget drops the key pairs of the device, after its keys were changed. The forgetters drop what they keep for them.
+func (c *keyCache) forget(deviceID uuid.UUID) {
+	c.decoded.RemoveFunc(func(id keyID) bool {
+		return id.deviceID == deviceID
+	})
+
+	for _, forgetter := range c.forgetters {
+		forgetter.Forget(deviceID)
+	}
+}
@@ -0,0 +1,289 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// countingMarshaler counts how often a private key is decoded.
+type countingMarshaler struct {
+	*crypto.Marshaler
+
+	unmarshaled int
+}
+
+func (m *countingMarshaler) Unmarshal(
+	deviceID uuid.UUID, version int, algo domain.Algorithm, privateKeyBytes []byte,
+) (domain.KeyPair, error) {
+	m.unmarshaled++
+
+	return m.Marshaler.Unmarshal(deviceID, version, algo, privateKeyBytes)
+}
+
+func TestKeyCache(t *testing.T) {
+	marshaler := &countingMarshaler{Marshaler: crypto.NewMarshaler()}
+	keys := newKeyCache(marshaler, 2, nil)
+	deviceID := uuid.New()
+
+	_, first, err := marshaler.Marshal(deviceID, 1, newTestDevice(t).KeyPair)
+	require.NoError(t, err)
+
+	_, second, err := marshaler.Marshal(deviceID, 1, newTestDevice(t).KeyPair)
+	require.NoError(t, err)
+
+	kp, err := keys.decode(deviceID, 1, domain.AlgorithmECC, first)
+	require.NoError(t, err)
+
+	cached, err := keys.decode(deviceID, 1, domain.AlgorithmECC, first)
+	require.NoError(t, err)
+	require.Same(t, kp, cached)
+	require.Equal(t, 1, marshaler.unmarshaled)
+
+	// Another key stored under the same version, like after a rolled back rotation, is decoded again
+	replaced, err := keys.decode(deviceID, 1, domain.AlgorithmECC, second)
+	require.NoError(t, err)
+	require.NotEqual(t, kp, replaced)
+	require.Equal(t, 2, marshaler.unmarshaled)
+
+	_, err = keys.decode(deviceID, 2, domain.AlgorithmECC, first)
+	require.NoError(t, err)
+
+	keys.forget(deviceID)
+	require.Zero(t, keys.decoded.Len())
+
+	_, err = keys.decode(deviceID, 1, domain.AlgorithmECC, second)
+	require.NoError(t, err)
+	require.Equal(t, 4, marshaler.unmarshaled)
+
+	_, err = keys.decode(deviceID, 3, domain.AlgorithmECC, []byte("not a key"))
+	require.Error(t, err)
+	require.Equal(t, 1, keys.decoded.Len())
+}
+
+func TestKeyCache_Stores(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			device := newTestDevice(t)
+			require.NoError(t, store.CreateDevice(ctx, device))
+
+			first, err := store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+
+			second, err := store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+			require.Same(t, first.KeyPair, second.KeyPair)
+
+			// After a rotation the new key is used, the retired one still decodes to the same key
+			kp, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmECC, device.KeyParams)
+			require.NoError(t, err)
+
+			err = store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+				return store.RotateDeviceKey(ctx, device.ID, domain.KeyRotation{
+					KeyPair:   kp,
+					Algorithm: domain.AlgorithmECC,
+					Params:    device.KeyParams,
+					Version:   2,
+					RotatedAt: time.Now(),
+				})
+			})
+			require.NoError(t, err)
+
+			rotated, err := store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, kp, rotated.KeyPair)
+			require.Equal(t, device.KeyPair, rotated.RetiredKeys[0].KeyPair)
+		})
+	}
+}
+
+// recordingForgetter records the devices it was told to forget.
+type recordingForgetter struct {
+	forgotten []uuid.UUID
+}
+
+func (f *recordingForgetter) Forget(deviceID uuid.UUID) {
+	f.forgotten = append(f.forgotten, deviceID)
+}
+
+func TestKeyCache_Forgetters(t *testing.T) {
+	forgetter := &recordingForgetter{}
+	stores := map[string]rewritingStore{
+		"inmemory": NewInMemory(crypto.NewMarshaler(), testKeyCacheSize, forgetter),
+	}
+
+	sqlite, err := NewSQLite(
+		context.Background(), filepath.Join(t.TempDir(), "test.db"), crypto.NewMarshaler(), testKeyCacheSize, forgetter,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, sqlite.Close())
+	})
+	stores["sqlite"] = sqlite
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			forgetter.forgotten = nil
+
+			device := newTestDevice(t)
+			require.NoError(t, store.CreateDevice(ctx, device))
+			require.Empty(t, forgetter.forgotten)
+
+			kp, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmECC, device.KeyParams)
+			require.NoError(t, err)
+
+			err = store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+				return store.RotateDeviceKey(ctx, device.ID, domain.KeyRotation{
+					KeyPair:   kp,
+					Algorithm: domain.AlgorithmECC,
+					Params:    device.KeyParams,
+					Version:   2,
+					RotatedAt: time.Now(),
+				})
+			})
+			require.NoError(t, err)
+			require.Equal(t, []uuid.UUID{device.ID}, forgetter.forgotten)
+
+			_, err = store.RewriteDeviceKeys(ctx, device.ID, func(_ uuid.UUID, _ int, privateKey []byte) ([]byte, error) {
+				return privateKey, nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []uuid.UUID{device.ID, device.ID}, forgetter.forgotten)
+		})
+	}
+}
+
+// switchingMarshaler lets a test change the marshaler of a store, like a restart with other key-encryption keys.
+type switchingMarshaler struct {
+	KeyPairMarshaler
+}
+
+// rewritingStore is a store whose private keys can be rewritten.
+type rewritingStore interface {
+	queryStore
+	RewriteDeviceKeys(
+		ctx context.Context, id uuid.UUID, rewrite func(deviceID uuid.UUID, version int, privateKey []byte) ([]byte, error),
+	) (int, error)
+}
+
+func newTestEnvelope(t *testing.T, keks ...crypto.KEK) *crypto.EnvelopeMarshaler {
+	m, err := crypto.NewEnvelopeMarshaler(crypto.NewMarshaler(), keks)
+	require.NoError(t, err)
+
+	return m
+}
+
+func TestRewriteDeviceKeys(t *testing.T) {
+	keks := make([]crypto.KEK, 2)
+	for i := range keks {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+
+		keks[i], err = crypto.NewKEK(key)
+		require.NoError(t, err)
+	}
+
+	stores := map[string]func(m KeyPairMarshaler) rewritingStore{
+		"inmemory": func(m KeyPairMarshaler) rewritingStore {
+			return NewInMemory(m, 0)
+		},
+		"sqlite": func(m KeyPairMarshaler) rewritingStore {
+			store, err := NewSQLite(context.Background(), filepath.Join(t.TempDir(), "test.db"), m, 0)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, store.Close())
+			})
+
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			marshaler := &switchingMarshaler{KeyPairMarshaler: newTestEnvelope(t, keks[0])}
+			store := newStore(marshaler)
+
+			device := newTestDevice(t)
+			require.NoError(t, store.CreateDevice(ctx, device))
+
+			kp, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmECC, device.KeyParams)
+			require.NoError(t, err)
+
+			err = store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+				return store.RotateDeviceKey(ctx, device.ID, domain.KeyRotation{
+					KeyPair:   kp,
+					Algorithm: domain.AlgorithmECC,
+					Params:    device.KeyParams,
+					Version:   2,
+					RotatedAt: time.Now(),
+				})
+			})
+			require.NoError(t, err)
+
+			// The current and the retired key are moved to the new KEK, a second run changes nothing
+			rotation := newTestEnvelope(t, keks[1], keks[0])
+			marshaler.KeyPairMarshaler = rotation
+
+			changed, err := store.RewriteDeviceKeys(ctx, device.ID, rotation.Rewrap)
+			require.NoError(t, err)
+			require.Equal(t, 2, changed)
+
+			changed, err = store.RewriteDeviceKeys(ctx, device.ID, rotation.Rewrap)
+			require.NoError(t, err)
+			require.Zero(t, changed)
+
+			// The old KEK is not needed anymore
+			marshaler.KeyPairMarshaler = newTestEnvelope(t, keks[1])
+
+			rewritten, err := store.GetDevice(ctx, device.ID)
+			require.NoError(t, err)
+			require.Equal(t, kp, rewritten.KeyPair)
+			require.Equal(t, device.KeyPair, rewritten.RetiredKeys[0].KeyPair)
+
+			_, err = store.RewriteDeviceKeys(ctx, uuid.New(), rotation.Rewrap)
+			require.Error(t, err)
+		})
+	}
+}
+
+// BenchmarkSignTransaction compares signing with and without the caches of decoded key pairs and signers.
+func BenchmarkSignTransaction(b *testing.B) {
+	for _, algorithm := range crypto.Algorithms() {
+		for _, cacheSize := range []int{0, 1024} {
+			b.Run(fmt.Sprintf("%s/cache=%d", algorithm, cacheSize), func(b *testing.B) {
+				ctx := context.Background()
+				logger := zap.NewNop().Sugar()
+				signerCreator := crypto.NewCachingSignerCreator(crypto.NewSignerCreator(), cacheSize)
+				store := NewInMemory(crypto.NewMarshaler(), cacheSize, signerCreator)
+
+				deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+				signatureSvc := domain.NewSignatureService(
+					logger, deviceSvc, signerCreator, crypto.NewVerifierCreator(), store, 0,
+				)
+
+				device, err := deviceSvc.CreateDevice(ctx, nil, algorithm, domain.KeyParams{})
+				require.NoError(b, err)
+
+				b.ResetTimer()
+				for range b.N {
+					_, err := signatureSvc.SignTransaction(ctx, device.ID, "data")
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
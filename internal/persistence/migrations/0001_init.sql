@@ -0,0 +1,19 @@
+CREATE TABLE devices
+(
+    id                TEXT PRIMARY KEY,
+    signature_counter INTEGER NOT NULL DEFAULT 0,
+    private_key       BLOB    NOT NULL,
+    algorithm         TEXT    NOT NULL,
+    label             TEXT
+);
+
+CREATE TABLE signatures
+(
+    device_id     TEXT      NOT NULL REFERENCES devices (id),
+    counter       INTEGER   NOT NULL,
+    signature     TEXT      NOT NULL,
+    original_data TEXT      NOT NULL,
+    created_at    TIMESTAMP NOT NULL,
+
+    PRIMARY KEY (device_id, counter)
+);
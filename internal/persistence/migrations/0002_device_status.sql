@@ -0,0 +1,9 @@
+ALTER TABLE devices ADD COLUMN status TEXT NOT NULL DEFAULT 'ACTIVE';
+ALTER TABLE devices ADD COLUMN created_at TIMESTAMP;
+ALTER TABLE devices ADD COLUMN status_changed_at TIMESTAMP;
+
+-- The existing devices get the current time in the UTC format the driver writes, "2006-01-02 15:04:05.999999999-07:00"
+-- with the trailing zeros of the fraction trimmed, so they sort with the devices created later
+UPDATE devices
+SET created_at        = rtrim(rtrim(strftime('%Y-%m-%d %H:%M:%f', 'now'), '0'), '.') || '+00:00',
+    status_changed_at = rtrim(rtrim(strftime('%Y-%m-%d %H:%M:%f', 'now'), '0'), '.') || '+00:00';
@@ -0,0 +1,15 @@
+ALTER TABLE devices ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE devices ADD COLUMN key_valid_from INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE retired_keys
+(
+    device_id   TEXT      NOT NULL REFERENCES devices (id),
+    version     INTEGER   NOT NULL,
+    private_key BLOB      NOT NULL,
+    algorithm   TEXT      NOT NULL,
+    valid_from  INTEGER   NOT NULL,
+    valid_until INTEGER   NOT NULL,
+    retired_at  TIMESTAMP NOT NULL,
+
+    PRIMARY KEY (device_id, version)
+);
@@ -0,0 +1 @@
+CREATE INDEX devices_created_at ON devices (created_at, id);
@@ -0,0 +1,11 @@
+ALTER TABLE signatures ADD COLUMN algorithm TEXT NOT NULL DEFAULT '';
+
+-- Existing signatures were created with the key which was valid for their counter
+UPDATE signatures
+SET algorithm = COALESCE(
+        (SELECT r.algorithm
+         FROM retired_keys r
+         WHERE r.device_id = signatures.device_id
+           AND signatures.counter >= r.valid_from
+           AND signatures.counter < r.valid_until),
+        (SELECT d.algorithm FROM devices d WHERE d.id = signatures.device_id));
@@ -0,0 +1,13 @@
+CREATE TABLE idempotency_keys
+(
+    device_id       TEXT      NOT NULL REFERENCES devices (id),
+    idempotency_key TEXT      NOT NULL,
+    payload_hash    TEXT      NOT NULL,
+    counter         INTEGER   NOT NULL,
+    created_at      TIMESTAMP NOT NULL,
+
+    PRIMARY KEY (device_id, idempotency_key)
+);
+
+-- Expired keys are deleted by creation time
+CREATE INDEX idempotency_keys_created_at ON idempotency_keys (device_id, created_at);
@@ -0,0 +1,14 @@
+ALTER TABLE devices ADD COLUMN key_rsa_bits INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE devices ADD COLUMN key_curve TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN key_hash TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE retired_keys ADD COLUMN rsa_bits INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE retired_keys ADD COLUMN curve TEXT NOT NULL DEFAULT '';
+ALTER TABLE retired_keys ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+
+-- Existing keys were generated as 512 bit RSA or P-384 ECC keys, and all of them were used with SHA-256
+UPDATE devices SET key_rsa_bits = 512, key_hash = 'SHA-256' WHERE algorithm = 'RSA';
+UPDATE devices SET key_curve = 'P-384', key_hash = 'SHA-256' WHERE algorithm = 'ECC';
+
+UPDATE retired_keys SET rsa_bits = 512, hash = 'SHA-256' WHERE algorithm = 'RSA';
+UPDATE retired_keys SET curve = 'P-384', hash = 'SHA-256' WHERE algorithm = 'ECC';
@@ -0,0 +1,9 @@
+ALTER TABLE devices ADD COLUMN key_padding TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN key_salt_length INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE retired_keys ADD COLUMN padding TEXT NOT NULL DEFAULT '';
+ALTER TABLE retired_keys ADD COLUMN salt_length INTEGER NOT NULL DEFAULT 0;
+
+-- Existing RSA keys were all used with PKCS #1 v1.5 padding
+UPDATE devices SET key_padding = 'PKCS1v15' WHERE algorithm = 'RSA';
+UPDATE retired_keys SET padding = 'PKCS1v15' WHERE algorithm = 'RSA';
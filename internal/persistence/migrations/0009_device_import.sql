@@ -0,0 +1,3 @@
+-- Imported devices continue the signature chain of the system they come from
+ALTER TABLE devices ADD COLUMN imported_counter INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE devices ADD COLUMN imported_signature TEXT NOT NULL DEFAULT '';
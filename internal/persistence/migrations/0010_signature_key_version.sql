@@ -0,0 +1,11 @@
+ALTER TABLE signatures ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1;
+
+-- Existing signatures were created with the key which was valid for their counter
+UPDATE signatures
+SET key_version = COALESCE(
+        (SELECT r.version
+         FROM retired_keys r
+         WHERE r.device_id = signatures.device_id
+           AND signatures.counter >= r.valid_from
+           AND signatures.counter < r.valid_until),
+        (SELECT d.key_version FROM devices d WHERE d.id = signatures.device_id));
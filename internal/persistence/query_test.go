@@ -0,0 +1,147 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+type queryStore interface {
+	domain.DevicePersister
+	domain.SignaturePersister
+}
+
+func queryStores(t *testing.T) map[string]queryStore {
+	return map[string]queryStore{
+		"inmemory": NewInMemory(crypto.NewMarshaler(), testKeyCacheSize),
+		"sqlite":   newTestSQLite(t),
+	}
+}
+
+func TestQueryDevices(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			start := time.Now()
+
+			labels := []string{"till-1", "till-2", "kiosk", "till-3"}
+			created := make([]domain.Device, 0, len(labels))
+			for i, label := range labels {
+				device := newTestDevice(t)
+				device.Label = &label
+				device.CreatedAt = start.Add(time.Duration(i) * time.Second)
+				if i == 3 {
+					params := domain.KeyParams{RSABits: 2048, Padding: domain.PaddingPKCS1v15, Hash: domain.HashSHA256}
+					kp, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmRSA, params)
+					require.NoError(t, err)
+
+					device.KeyPair, device.Algorithm, device.KeyParams = kp, domain.AlgorithmRSA, params
+				}
+
+				require.NoError(t, store.CreateDevice(ctx, device))
+				created = append(created, device)
+			}
+
+			// Pages follow the creation order
+			page, err := store.QueryDevices(ctx, domain.DeviceQuery{Limit: 3})
+			require.NoError(t, err)
+			require.Len(t, page.Devices, 3)
+			require.Equal(t, created[0].ID, page.Devices[0].ID)
+			require.Equal(t, created[2].ID, page.Devices[2].ID)
+			require.NotNil(t, page.Next)
+
+			page, err = store.QueryDevices(ctx, domain.DeviceQuery{Limit: 3, After: page.Next})
+			require.NoError(t, err)
+			require.Len(t, page.Devices, 1)
+			require.Equal(t, created[3].ID, page.Devices[0].ID)
+			require.Nil(t, page.Next)
+
+			// Filters
+			page, err = store.QueryDevices(ctx, domain.DeviceQuery{LabelPrefix: "till"})
+			require.NoError(t, err)
+			require.Len(t, page.Devices, 3)
+
+			page, err = store.QueryDevices(ctx, domain.DeviceQuery{LabelPrefix: "TILL"})
+			require.NoError(t, err)
+			require.Empty(t, page.Devices)
+
+			page, err = store.QueryDevices(ctx, domain.DeviceQuery{LabelPrefix: "till", Algorithm: domain.AlgorithmECC})
+			require.NoError(t, err)
+			require.Len(t, page.Devices, 2)
+
+			devices, err := store.GetDevices(ctx)
+			require.NoError(t, err)
+			require.Len(t, devices, 4)
+			for i, device := range devices {
+				require.Equal(t, created[i].ID, device.ID)
+			}
+		})
+	}
+}
+
+func TestQuerySignatures(t *testing.T) {
+	for name, store := range queryStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			device := newTestDevice(t)
+
+			require.NoError(t, store.CreateDevice(ctx, device))
+
+			before := time.Now()
+			for i := 0; i < 5; i++ {
+				err := store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+					signature := newTestSignature(device, uint64(i), string(rune('a'+i)), "")
+
+					err := store.SaveSignature(ctx, device.ID, signature)
+					if err != nil {
+						return err
+					}
+
+					return store.IncrementSignatureCounter(ctx, device.ID)
+				})
+				require.NoError(t, err)
+			}
+			after := time.Now()
+
+			signatures := func(page domain.SignaturePage) string {
+				var res string
+				for _, signature := range page.Signatures {
+					res += signature.Signature
+				}
+
+				return res
+			}
+
+			page, err := store.QuerySignatures(ctx, device.ID, domain.SignatureQuery{Limit: 2})
+			require.NoError(t, err)
+			require.Equal(t, "ab", signatures(page))
+			require.Equal(t, uint64(1), *page.Next)
+
+			page, err = store.QuerySignatures(ctx, device.ID, domain.SignatureQuery{Limit: 2, After: page.Next})
+			require.NoError(t, err)
+			require.Equal(t, "cd", signatures(page))
+
+			page, err = store.QuerySignatures(ctx, device.ID, domain.SignatureQuery{Limit: 2, After: page.Next})
+			require.NoError(t, err)
+			require.Equal(t, "e", signatures(page))
+			require.Nil(t, page.Next)
+
+			from, to := uint64(1), uint64(3)
+			page, err = store.QuerySignatures(ctx, device.ID, domain.SignatureQuery{CounterFrom: &from, CounterTo: &to})
+			require.NoError(t, err)
+			require.Equal(t, "bcd", signatures(page))
+
+			page, err = store.QuerySignatures(ctx, device.ID, domain.SignatureQuery{CreatedFrom: before, CreatedTo: after})
+			require.NoError(t, err)
+			require.Equal(t, "abcde", signatures(page))
+
+			page, err = store.QuerySignatures(ctx, device.ID, domain.SignatureQuery{CreatedFrom: after})
+			require.NoError(t, err)
+			require.Empty(t, page.Signatures)
+		})
+	}
+}
@@ -0,0 +1,843 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"net/url"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite" // registers the "sqlite" database/sql driver
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// querier is implemented by both *sql.DB and *sql.Tx, so the same queries can run inside and outside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type sqliteTxKey struct{}
+
+// SQLite is a persistence layer backed by an SQLite database file.
+type SQLite struct {
+	db *sql.DB
+
+	kpMarshaler KeyPairMarshaler
+	keys        *keyCache
+}
+
+// NewSQLite opens (or creates) the database at the given path and applies all pending schema migrations. Up to
+// keyCacheSize decoded key pairs are cached. The forgetters are told when the keys of a device change.
+func NewSQLite(
+	ctx context.Context, path string, kpMarshaler KeyPairMarshaler, keyCacheSize int, forgetters ...KeyForgetter,
+) (*SQLite, error) {
+	// Transactions are started with an immediate lock, so concurrent signers wait for each other on BEGIN instead of
+	// failing on lock upgrade in the middle of the transaction. Times are written in the SQLite format, which sorts
+	// correctly as long as all times are in UTC.
+	dsn := fmt.Sprintf("file:%s?%s", path, url.Values{
+		"_pragma":      []string{"busy_timeout(5000)", "journal_mode(WAL)", "foreign_keys(1)"},
+		"_txlock":      []string{"immediate"},
+		"_time_format": []string{"sqlite"},
+	}.Encode())
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %w", err)
+	}
+
+	err = Migrate(ctx, db)
+	if err != nil {
+		db.Close() // nolint:errcheck
+
+		return nil, fmt.Errorf("could not migrate database: %w", err)
+	}
+
+	return &SQLite{
+		db:          db,
+		kpMarshaler: kpMarshaler,
+		keys:        newKeyCache(kpMarshaler, keyCacheSize, forgetters),
+	}, nil
+}
+
+// Close closes the underlying database.
+func (p *SQLite) Close() error {
+	return p.db.Close()
+}
+
+// conn returns the transaction started by RunTransaction if there is one in the context, or the database otherwise.
+func (p *SQLite) conn(ctx context.Context) querier {
+	if tx, ok := ctx.Value(sqliteTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+
+	return p.db
+}
+
+// CreateDevice creates a new device in the persistence layer.
+func (p *SQLite) CreateDevice(ctx context.Context, device domain.Device) error {
+	_, priv, err := p.kpMarshaler.Marshal(device.ID, device.KeyVersion, device.KeyPair)
+	if err != nil {
+		return fmt.Errorf("could not marshal key pair: %w", err)
+	}
+
+	_, err = p.conn(ctx).ExecContext(ctx,
+		"INSERT INTO devices ("+deviceColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		device.ID.String(), device.SignatureCounter, priv, device.Algorithm.String(), device.KeyParams.RSABits,
+		device.KeyParams.Padding.String(), device.KeyParams.SaltLength, device.KeyParams.Curve.String(),
+		device.KeyParams.Hash.String(), device.KeyVersion, device.KeyValidFrom, device.Label, device.Status.String(),
+		device.CreatedAt.UTC(), device.StatusChangedAt.UTC(), device.ImportedCounter, device.ImportedSignature,
+	)
+	if err != nil {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+			return fmt.Errorf("%w: device %s already exists", domain.ErrConflict, device.ID)
+		}
+
+		return fmt.Errorf("could not insert device: %w", err)
+	}
+
+	return nil
+}
+
+// IncrementSignatureCounter increments the signature counter for a device in the persistence layer.
+func (p *SQLite) IncrementSignatureCounter(ctx context.Context, id uuid.UUID) error {
+	res, err := p.conn(ctx).ExecContext(ctx,
+		"UPDATE devices SET signature_counter = signature_counter + 1 WHERE id = ?", id.String(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not update device: %w", err)
+	}
+
+	return checkAffected(res)
+}
+
+// UpdateDeviceStatus sets a new lifecycle status for a device in the persistence layer.
+func (p *SQLite) UpdateDeviceStatus(ctx context.Context, id uuid.UUID, status domain.Status, changedAt time.Time) error {
+	res, err := p.conn(ctx).ExecContext(ctx,
+		"UPDATE devices SET status = ?, status_changed_at = ? WHERE id = ?", status.String(), changedAt.UTC(), id.String(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not update device: %w", err)
+	}
+
+	return checkAffected(res)
+}
+
+// GetDevices returns all devices from the persistence layer, ordered by creation time.
+func (p *SQLite) GetDevices(ctx context.Context) ([]domain.Device, error) {
+	page, err := p.QueryDevices(ctx, domain.DeviceQuery{})
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Devices, nil
+}
+
+// QueryDevices returns a page of the devices matching the query, ordered by creation time, then by ID.
+func (p *SQLite) QueryDevices(ctx context.Context, query domain.DeviceQuery) (domain.DevicePage, error) {
+	var (
+		conditions = []string{"1 = 1"}
+		args       []any
+	)
+
+	if query.After != nil {
+		after := query.After.CreatedAt.UTC()
+		conditions = append(conditions, "(created_at > ? OR (created_at = ? AND id > ?))")
+		args = append(args, after, after, query.After.ID.String())
+	}
+	if query.Algorithm != "" {
+		conditions = append(conditions, "algorithm = ?")
+		args = append(args, query.Algorithm.String())
+	}
+	if query.LabelPrefix != "" {
+		// LIKE is case-insensitive in SQLite, so the prefix is compared directly
+		conditions = append(conditions, "substr(label, 1, length(?)) = ?")
+		args = append(args, query.LabelPrefix, query.LabelPrefix)
+	}
+
+	q := "SELECT " + deviceColumns + " FROM devices WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY created_at, id"
+
+	// One more device than requested is fetched to know if there is a next page
+	if query.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := p.conn(ctx).QueryContext(ctx, q, args...)
+	if err != nil {
+		return domain.DevicePage{}, fmt.Errorf("could not query devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := make([]domain.Device, 0)
+	for rows.Next() {
+		device, err := p.scanDevice(rows)
+		if err != nil {
+			return domain.DevicePage{}, err
+		}
+
+		devices = append(devices, device)
+	}
+
+	if err = rows.Err(); err != nil {
+		return domain.DevicePage{}, fmt.Errorf("could not query devices: %w", err)
+	}
+
+	// Retired keys are loaded after the rows are closed, a transaction can not run two queries at once
+	rows.Close()
+
+	var next *domain.DeviceCursor
+	if query.Limit > 0 && len(devices) > query.Limit {
+		devices = devices[:query.Limit]
+
+		last := devices[len(devices)-1]
+		next = &domain.DeviceCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	for i := range devices {
+		devices[i].RetiredKeys, err = p.getRetiredKeys(ctx, devices[i].ID)
+		if err != nil {
+			return domain.DevicePage{}, err
+		}
+	}
+
+	return domain.DevicePage{Devices: devices, Next: next}, nil
+}
+
+// GetDevice returns a device from the persistence layer.
+func (p *SQLite) GetDevice(ctx context.Context, id uuid.UUID) (domain.Device, error) {
+	row := p.conn(ctx).QueryRowContext(ctx,
+		"SELECT "+deviceColumns+" FROM devices WHERE id = ?", id.String(),
+	)
+
+	device, err := p.scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Device{}, fmt.Errorf("%w: %s", domain.ErrDeviceNotFound, id)
+	}
+	if err != nil {
+		return domain.Device{}, err
+	}
+
+	device.RetiredKeys, err = p.getRetiredKeys(ctx, id)
+	if err != nil {
+		return domain.Device{}, err
+	}
+
+	return device, nil
+}
+
+// RotateDeviceKey replaces the current key of a device and keeps the current one as a retired key.
+func (p *SQLite) RotateDeviceKey(ctx context.Context, id uuid.UUID, rotation domain.KeyRotation) error {
+	_, priv, err := p.kpMarshaler.Marshal(id, rotation.Version, rotation.KeyPair)
+	if err != nil {
+		return fmt.Errorf("could not marshal key pair: %w", err)
+	}
+
+	defer p.keys.forget(id)
+
+	return p.inTransaction(ctx, id, func(ctx context.Context) error {
+		_, err := p.conn(ctx).ExecContext(ctx,
+			`INSERT INTO retired_keys (device_id, version, private_key, algorithm, rsa_bits, padding, salt_length, curve,
+                          hash, valid_from, valid_until, retired_at)
+SELECT id, key_version, private_key, algorithm, key_rsa_bits, key_padding, key_salt_length, key_curve, key_hash,
+       key_valid_from, ?, ?
+FROM devices WHERE id = ?`,
+			rotation.ValidFrom, rotation.RotatedAt.UTC(), id.String(),
+		)
+		if err != nil {
+			return fmt.Errorf("could not retire key: %w", err)
+		}
+
+		res, err := p.conn(ctx).ExecContext(ctx,
+			`UPDATE devices
+SET private_key = ?, algorithm = ?, key_rsa_bits = ?, key_padding = ?, key_salt_length = ?, key_curve = ?,
+    key_hash = ?, key_version = ?, key_valid_from = ?
+WHERE id = ?`,
+			priv, rotation.Algorithm.String(), rotation.Params.RSABits, rotation.Params.Padding.String(),
+			rotation.Params.SaltLength, rotation.Params.Curve.String(), rotation.Params.Hash.String(), rotation.Version,
+			rotation.ValidFrom, id.String(),
+		)
+		if err != nil {
+			return fmt.Errorf("could not update device: %w", err)
+		}
+
+		return checkAffected(res)
+	})
+}
+
+// RewriteDeviceKeys replaces the stored private keys of a device, the current and the retired ones, with what
+// rewrite returns for them. The keys must still decode to the same key pairs. It returns the number of changed keys.
+func (p *SQLite) RewriteDeviceKeys(
+	ctx context.Context, id uuid.UUID, rewrite func(deviceID uuid.UUID, version int, privateKey []byte) ([]byte, error),
+) (int, error) {
+	var changed int
+
+	defer p.keys.forget(id)
+
+	err := p.inTransaction(ctx, id, func(ctx context.Context) error {
+		changed = 0
+
+		var (
+			privateKey []byte
+			version    int
+		)
+		err := p.conn(ctx).QueryRowContext(ctx,
+			"SELECT private_key, key_version FROM devices WHERE id = ?", id.String(),
+		).Scan(&privateKey, &version)
+		if err != nil {
+			return fmt.Errorf("could not query device key: %w", err)
+		}
+
+		rewritten, err := rewrite(id, version, privateKey)
+		if err != nil {
+			return fmt.Errorf("could not rewrite key: %w", err)
+		}
+		if !bytes.Equal(rewritten, privateKey) {
+			_, err = p.conn(ctx).ExecContext(ctx,
+				"UPDATE devices SET private_key = ? WHERE id = ?", rewritten, id.String(),
+			)
+			if err != nil {
+				return fmt.Errorf("could not update device key: %w", err)
+			}
+
+			changed++
+		}
+
+		retiredKeys, err := p.getRetiredPrivateKeys(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		for version, privateKey := range retiredKeys {
+			rewritten, err := rewrite(id, version, privateKey)
+			if err != nil {
+				return fmt.Errorf("could not rewrite retired key: %w", err)
+			}
+			if bytes.Equal(rewritten, privateKey) {
+				continue
+			}
+
+			_, err = p.conn(ctx).ExecContext(ctx,
+				"UPDATE retired_keys SET private_key = ? WHERE device_id = ? AND version = ?",
+				rewritten, id.String(), version,
+			)
+			if err != nil {
+				return fmt.Errorf("could not update retired key: %w", err)
+			}
+
+			changed++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return changed, nil
+}
+
+// getRetiredPrivateKeys returns the stored private keys of the retired device keys by version.
+func (p *SQLite) getRetiredPrivateKeys(ctx context.Context, deviceID uuid.UUID) (map[int][]byte, error) {
+	rows, err := p.conn(ctx).QueryContext(ctx,
+		"SELECT version, private_key FROM retired_keys WHERE device_id = ?", deviceID.String(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not query retired keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make(map[int][]byte)
+	for rows.Next() {
+		var (
+			version    int
+			privateKey []byte
+		)
+
+		err = rows.Scan(&version, &privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan retired key: %w", err)
+		}
+
+		keys[version] = privateKey
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not query retired keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (p *SQLite) getRetiredKeys(ctx context.Context, deviceID uuid.UUID) ([]domain.RetiredKey, error) {
+	rows, err := p.conn(ctx).QueryContext(ctx,
+		`SELECT version, private_key, algorithm, rsa_bits, padding, salt_length, curve, hash, valid_from, valid_until,
+       retired_at
+FROM retired_keys WHERE device_id = ? ORDER BY version`,
+		deviceID.String(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not query retired keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make([]domain.RetiredKey, 0)
+	for rows.Next() {
+		var (
+			key        domain.RetiredKey
+			privateKey []byte
+			algorithm  string
+			padding    string
+			curve      string
+			hash       string
+		)
+
+		err = rows.Scan(
+			&key.Version, &privateKey, &algorithm, &key.Params.RSABits, &padding, &key.Params.SaltLength, &curve, &hash,
+			&key.ValidFrom, &key.ValidUntil, &key.RetiredAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan retired key: %w", err)
+		}
+
+		key.Algorithm = domain.Algorithm(algorithm)
+		key.Params.Padding = domain.Padding(padding)
+		key.Params.Curve = domain.Curve(curve)
+		key.Params.Hash = domain.Hash(hash)
+		key.RetiredAt = key.RetiredAt.UTC()
+
+		key.KeyPair, err = p.keys.decode(deviceID, key.Version, key.Algorithm, privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal retired key pair: %w", err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not query retired keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// SaveSignature saves a signature for a device in the persistence layer. The signature is stored under the current
+// value of the device signature counter.
+func (p *SQLite) SaveSignature(ctx context.Context, deviceID uuid.UUID, data domain.SignedData) error {
+	res, err := p.conn(ctx).ExecContext(ctx,
+		`INSERT INTO signatures (device_id, counter, signature, original_data, algorithm, key_version, created_at)
+SELECT id, signature_counter, ?, ?, ?, ?, ? FROM devices WHERE id = ?`,
+		data.Signature, data.OriginalData, data.Algorithm.String(), data.KeyVersion, data.SignedAt.UTC(),
+		deviceID.String(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not insert signature: %w", err)
+	}
+
+	return checkAffected(res)
+}
+
+// GetLastSignature returns the last signature for a device from the persistence layer.
+func (p *SQLite) GetLastSignature(ctx context.Context, deviceID uuid.UUID) (domain.SignedData, error) {
+	row := p.conn(ctx).QueryRowContext(ctx,
+		"SELECT "+signatureColumns+" FROM signatures WHERE device_id = ? ORDER BY counter DESC LIMIT 1",
+		deviceID.String(),
+	)
+
+	data, err := scanSignature(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.SignedData{}, fmt.Errorf("%w: device %s has no signatures", domain.ErrSignatureNotFound, deviceID)
+	}
+
+	return data, err
+}
+
+// GetSignature returns the signature created with the given counter value from the persistence layer.
+func (p *SQLite) GetSignature(ctx context.Context, deviceID uuid.UUID, counter uint64) (domain.SignedData, error) {
+	err := p.checkDeviceExists(ctx, deviceID)
+	if err != nil {
+		return domain.SignedData{}, err
+	}
+
+	row := p.conn(ctx).QueryRowContext(ctx,
+		"SELECT "+signatureColumns+" FROM signatures WHERE device_id = ? AND counter = ?",
+		deviceID.String(), counter,
+	)
+
+	data, err := scanSignature(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.SignedData{}, fmt.Errorf("%w: device %s, counter %d", domain.ErrSignatureNotFound, deviceID, counter)
+	}
+
+	return data, err
+}
+
+// GetSignatures returns all signatures for a device from the persistence layer.
+func (p *SQLite) GetSignatures(ctx context.Context, deviceID uuid.UUID) ([]domain.SignedData, error) {
+	page, err := p.QuerySignatures(ctx, deviceID, domain.SignatureQuery{})
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Signatures, nil
+}
+
+// QuerySignatures returns a page of the device signatures matching the query, ordered by counter.
+func (p *SQLite) QuerySignatures(ctx context.Context, deviceID uuid.UUID, query domain.SignatureQuery) (domain.SignaturePage, error) {
+	err := p.checkDeviceExists(ctx, deviceID)
+	if err != nil {
+		return domain.SignaturePage{}, err
+	}
+
+	var (
+		conditions = []string{"device_id = ?"}
+		args       = []any{deviceID.String()}
+	)
+
+	if query.After != nil {
+		conditions = append(conditions, "counter > ?")
+		args = append(args, *query.After)
+	}
+	if query.CounterFrom != nil {
+		conditions = append(conditions, "counter >= ?")
+		args = append(args, *query.CounterFrom)
+	}
+	if query.CounterTo != nil {
+		conditions = append(conditions, "counter <= ?")
+		args = append(args, *query.CounterTo)
+	}
+	if !query.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, query.CreatedFrom.UTC())
+	}
+	if !query.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, query.CreatedTo.UTC())
+	}
+
+	q := "SELECT " + signatureColumns + " FROM signatures WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY counter"
+
+	// One more signature than requested is fetched to know if there is a next page
+	if query.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, query.Limit+1)
+	}
+
+	rows, err := p.conn(ctx).QueryContext(ctx, q, args...)
+	if err != nil {
+		return domain.SignaturePage{}, fmt.Errorf("could not query signatures: %w", err)
+	}
+	defer rows.Close()
+
+	signatures := make([]domain.SignedData, 0)
+	for rows.Next() {
+		data, err := scanSignature(rows)
+		if err != nil {
+			return domain.SignaturePage{}, err
+		}
+
+		signatures = append(signatures, data)
+	}
+
+	if err = rows.Err(); err != nil {
+		return domain.SignaturePage{}, fmt.Errorf("could not query signatures: %w", err)
+	}
+
+	var next *uint64
+	if query.Limit > 0 && len(signatures) > query.Limit {
+		signatures = signatures[:query.Limit]
+		next = &signatures[query.Limit-1].Counter
+	}
+
+	return domain.SignaturePage{Signatures: signatures, Next: next}, nil
+}
+
+// GetIdempotencyKey returns an idempotency key saved for a device from the persistence layer.
+func (p *SQLite) GetIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key string) (domain.IdempotencyKey, error) {
+	stored := domain.IdempotencyKey{Key: key}
+
+	err := p.conn(ctx).QueryRowContext(ctx,
+		"SELECT payload_hash, counter, created_at FROM idempotency_keys WHERE device_id = ? AND idempotency_key = ?",
+		deviceID.String(), key,
+	).Scan(&stored.PayloadHash, &stored.Counter, &stored.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.IdempotencyKey{}, fmt.Errorf("%w: device %s, key %q", domain.ErrIdempotencyKeyNotFound, deviceID, key)
+	}
+	if err != nil {
+		return domain.IdempotencyKey{}, fmt.Errorf("could not query idempotency key: %w", err)
+	}
+
+	stored.CreatedAt = stored.CreatedAt.UTC()
+
+	return stored, nil
+}
+
+// SaveIdempotencyKey saves an idempotency key for a device in the persistence layer, replacing the one with the same
+// key.
+func (p *SQLite) SaveIdempotencyKey(ctx context.Context, deviceID uuid.UUID, key domain.IdempotencyKey) error {
+	_, err := p.conn(ctx).ExecContext(ctx,
+		`INSERT INTO idempotency_keys (device_id, idempotency_key, payload_hash, counter, created_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (device_id, idempotency_key) DO UPDATE SET payload_hash = excluded.payload_hash,
+                                                       counter      = excluded.counter,
+                                                       created_at   = excluded.created_at`,
+		deviceID.String(), key.Key, key.PayloadHash, key.Counter, key.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not save idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteIdempotencyKeys deletes the idempotency keys of a device created before the given time.
+func (p *SQLite) DeleteIdempotencyKeys(ctx context.Context, deviceID uuid.UUID, createdBefore time.Time) error {
+	_, err := p.conn(ctx).ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE device_id = ? AND created_at < ?",
+		deviceID.String(), createdBefore.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not delete idempotency keys: %w", err)
+	}
+
+	return nil
+}
+
+// RunTransaction runs fn inside a database transaction. Before calling fn it updates the device row, which makes
+// the transaction take the write lock right away (SQLite does not have row locks, the whole database is locked for
+// writing until the transaction ends). The transaction is committed if fn succeeds and rolled back otherwise.
+//
+// Called inside another transaction, it runs fn within a savepoint of that transaction instead. If fn fails, only its
+// own writes are rolled back and the outer transaction can go on.
+func (p *SQLite) RunTransaction(ctx context.Context, deviceID uuid.UUID, fn func(ctx context.Context) error) error {
+	if tx, ok := ctx.Value(sqliteTxKey{}).(*sql.Tx); ok {
+		return p.runSavepoint(ctx, tx, deviceID, fn)
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	err = lockDevice(ctx, tx, deviceID)
+	if err != nil {
+		return err
+	}
+
+	err = fn(context.WithValue(ctx, sqliteTxKey{}, tx))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// runSavepoint runs fn within a savepoint of the transaction, which is released if fn succeeds and rolled back to
+// otherwise.
+func (p *SQLite) runSavepoint(ctx context.Context, tx *sql.Tx, deviceID uuid.UUID, fn func(ctx context.Context) error) error {
+	// Savepoints may share the name, ROLLBACK TO and RELEASE refer to the innermost one, which is this one
+	const name = "nested"
+
+	_, err := tx.ExecContext(ctx, "SAVEPOINT "+name)
+	if err != nil {
+		return fmt.Errorf("could not create savepoint: %w", err)
+	}
+
+	err = lockDevice(ctx, tx, deviceID)
+	if err == nil {
+		err = fn(ctx)
+	}
+	if err != nil {
+		// Rolling back to a savepoint keeps it open, so it is released afterwards as well
+		_, rollbackErr := tx.ExecContext(ctx, "ROLLBACK TO "+name)
+		if rollbackErr == nil {
+			_, rollbackErr = tx.ExecContext(ctx, "RELEASE "+name)
+		}
+		if rollbackErr != nil {
+			return fmt.Errorf("could not roll back savepoint: %w (rolled back because of: %w)", rollbackErr, err)
+		}
+
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "RELEASE "+name)
+	if err != nil {
+		return fmt.Errorf("could not release savepoint: %w", err)
+	}
+
+	return nil
+}
+
+// lockDevice updates the device row, so the transaction holds the write lock. It returns ErrDeviceNotFound if there
+// is no device with the given ID.
+func lockDevice(ctx context.Context, q querier, deviceID uuid.UUID) error {
+	res, err := q.ExecContext(ctx,
+		"UPDATE devices SET signature_counter = signature_counter WHERE id = ?", deviceID.String(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not lock device: %w", err)
+	}
+
+	return checkAffected(res)
+}
+
+// checkDeviceExists returns ErrDeviceNotFound if there is no device with the given ID.
+func (p *SQLite) checkDeviceExists(ctx context.Context, id uuid.UUID) error {
+	var exists bool
+	err := p.conn(ctx).QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM devices WHERE id = ?)", id.String()).
+		Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("could not query device: %w", err)
+	}
+
+	if !exists {
+		return fmt.Errorf("%w: %s", domain.ErrDeviceNotFound, id)
+	}
+
+	return nil
+}
+
+// inTransaction runs fn in the transaction from the context, or in a new one if there is none, for the statements
+// which must be applied together.
+func (p *SQLite) inTransaction(ctx context.Context, deviceID uuid.UUID, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(sqliteTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+
+	return p.RunTransaction(ctx, deviceID, fn)
+}
+
+// deviceColumns are the columns scanDevice expects, in order.
+const deviceColumns = "id, signature_counter, private_key, algorithm, key_rsa_bits, key_padding, key_salt_length, " +
+	"key_curve, key_hash, key_version, key_valid_from, label, status, created_at, status_changed_at, imported_counter, " +
+	"imported_signature"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func (p *SQLite) scanDevice(row scanner) (domain.Device, error) {
+	var (
+		id              string
+		counter         uint64
+		privateKey      []byte
+		algorithm       string
+		rsaBits         int
+		padding         string
+		saltLength      int
+		curve           string
+		hash            string
+		keyVersion      int
+		validFrom       uint64
+		label           sql.NullString
+		status          string
+		createdAt       sql.NullTime
+		changedAt       sql.NullTime
+		importedCounter uint64
+		importedSig     string
+	)
+
+	err := row.Scan(
+		&id, &counter, &privateKey, &algorithm, &rsaBits, &padding, &saltLength, &curve, &hash, &keyVersion, &validFrom,
+		&label, &status, &createdAt, &changedAt, &importedCounter, &importedSig,
+	)
+	if err != nil {
+		return domain.Device{}, fmt.Errorf("could not scan device: %w", err)
+	}
+
+	parsedID, err := uuid.Parse(id)
+	if err != nil {
+		return domain.Device{}, fmt.Errorf("could not parse device id: %w", err)
+	}
+
+	kp, err := p.keys.decode(parsedID, keyVersion, domain.Algorithm(algorithm), privateKey)
+	if err != nil {
+		return domain.Device{}, fmt.Errorf("could not unmarshal key pair: %w", err)
+	}
+
+	keyParams := domain.KeyParams{
+		RSABits:    rsaBits,
+		Padding:    domain.Padding(padding),
+		SaltLength: saltLength,
+		Curve:      domain.Curve(curve),
+		Hash:       domain.Hash(hash),
+	}
+
+	device := domain.Device{
+		ID:               parsedID,
+		SignatureCounter: counter,
+		KeyPair:          kp,
+		Algorithm:        domain.Algorithm(algorithm),
+		KeyParams:        keyParams,
+		KeyVersion:       keyVersion,
+		KeyValidFrom:     validFrom,
+		Status:           domain.Status(status),
+		CreatedAt:        createdAt.Time.UTC(),
+		StatusChangedAt:  changedAt.Time.UTC(),
+
+		ImportedCounter:   importedCounter,
+		ImportedSignature: importedSig,
+	}
+
+	if label.Valid {
+		device.Label = &label.String
+	}
+
+	return device, nil
+}
+
+// signatureColumns are the columns scanSignature expects, in order.
+const signatureColumns = "device_id, counter, signature, original_data, algorithm, key_version, created_at"
+
+func scanSignature(row scanner) (domain.SignedData, error) {
+	var (
+		deviceID  string
+		data      domain.SignedData
+		algorithm string
+	)
+
+	err := row.Scan(
+		&deviceID, &data.Counter, &data.Signature, &data.OriginalData, &algorithm, &data.KeyVersion, &data.SignedAt,
+	)
+	if err != nil {
+		return domain.SignedData{}, fmt.Errorf("could not scan signature: %w", err)
+	}
+
+	data.DeviceID, err = uuid.Parse(deviceID)
+	if err != nil {
+		return domain.SignedData{}, fmt.Errorf("could not parse device id: %w", err)
+	}
+
+	data.Algorithm = domain.Algorithm(algorithm)
+	data.SignedAt = data.SignedAt.UTC()
+
+	return data, nil
+}
+
+func checkAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not get affected rows: %w", err)
+	}
+
+	if affected == 0 {
+		return domain.ErrDeviceNotFound
+	}
+
+	return nil
+}
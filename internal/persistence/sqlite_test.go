@@ -0,0 +1,300 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gren236/fiskaly-go-challenge/internal/crypto"
+	"github.com/gren236/fiskaly-go-challenge/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testKeyCacheSize is small enough for the tests to evict decoded key pairs from the cache.
+const testKeyCacheSize = 8
+
+func newTestSQLite(t *testing.T) *SQLite {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLite(context.Background(), path, crypto.NewMarshaler(), testKeyCacheSize)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	return store
+}
+
+func newTestDevice(t *testing.T) domain.Device {
+	t.Helper()
+
+	params := domain.KeyParams{Curve: domain.CurveP256, Hash: domain.HashSHA256}
+	kp, err := crypto.NewGenerator().GenerateKeyPair(domain.AlgorithmECC, params)
+	require.NoError(t, err)
+
+	label := "test"
+	now := time.Now()
+
+	return domain.Device{
+		ID:              uuid.New(),
+		KeyPair:         kp,
+		Algorithm:       domain.AlgorithmECC,
+		KeyParams:       params,
+		KeyVersion:      1,
+		Label:           &label,
+		Status:          domain.StatusActive,
+		CreatedAt:       now,
+		StatusChangedAt: now,
+	}
+}
+
+func newTestSignature(device domain.Device, counter uint64, signature, originalData string) domain.SignedData {
+	return domain.SignedData{
+		DeviceID:     device.ID,
+		Counter:      counter,
+		Signature:    signature,
+		OriginalData: originalData,
+		Algorithm:    device.Algorithm,
+		SignedAt:     time.Now().UTC(),
+	}
+}
+
+func TestSQLite_Device(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLite(t)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+	require.NoError(t, store.IncrementSignatureCounter(ctx, device.ID))
+
+	got, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, device.ID, got.ID)
+	require.Equal(t, uint64(1), got.SignatureCounter)
+	require.Equal(t, device.Algorithm, got.Algorithm)
+	require.Equal(t, device.Label, got.Label)
+	require.Equal(t, device.KeyPair, got.KeyPair)
+	require.Equal(t, domain.StatusActive, got.Status)
+	require.WithinDuration(t, device.CreatedAt, got.CreatedAt, 0)
+
+	devices, err := store.GetDevices(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+
+	_, err = store.GetDevice(ctx, uuid.New())
+	require.ErrorIs(t, err, domain.ErrDeviceNotFound)
+	require.ErrorIs(t, store.IncrementSignatureCounter(ctx, uuid.New()), domain.ErrDeviceNotFound)
+
+	_, err = store.GetSignatures(ctx, uuid.New())
+	require.ErrorIs(t, err, domain.ErrDeviceNotFound)
+}
+
+func TestSQLite_CreateDevice_Duplicate(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLite(t)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+	require.ErrorIs(t, store.CreateDevice(ctx, device), domain.ErrConflict)
+}
+
+func TestSQLite_UpdateDeviceStatus(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLite(t)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+
+	changedAt := time.Now().Add(time.Minute)
+	require.NoError(t, store.UpdateDeviceStatus(ctx, device.ID, domain.StatusDeactivated, changedAt))
+
+	got, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.StatusDeactivated, got.Status)
+	require.WithinDuration(t, changedAt, got.StatusChangedAt, 0)
+
+	err = store.UpdateDeviceStatus(ctx, uuid.New(), domain.StatusDeactivated, changedAt)
+	require.ErrorIs(t, err, domain.ErrDeviceNotFound)
+}
+
+func TestSQLite_Migrate_Idempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	for i := 0; i < 2; i++ {
+		store, err := NewSQLite(context.Background(), path, crypto.NewMarshaler(), testKeyCacheSize)
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+	}
+}
+
+func TestSQLite_Migrate_DeviceTimes(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// A device created before the devices had creation times
+	db, err := sql.Open("sqlite", "file:"+path)
+	require.NoError(t, err)
+
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+
+	_, err = db.ExecContext(ctx, "CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP)")
+	require.NoError(t, err)
+	require.NoError(t, applyMigration(ctx, db, migrations[0]))
+
+	old := newTestDevice(t)
+	_, private, err := crypto.NewMarshaler().Marshal(old.ID, 1, old.KeyPair)
+	require.NoError(t, err)
+
+	_, err = db.ExecContext(ctx, "INSERT INTO devices (id, private_key, algorithm) VALUES (?, ?, ?)",
+		old.ID.String(), private, old.Algorithm.String(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store, err := NewSQLite(ctx, path, crypto.NewMarshaler(), testKeyCacheSize)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, store.Close())
+	})
+
+	migrated, err := store.GetDevice(ctx, old.ID)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), migrated.CreatedAt, time.Minute)
+
+	// The backfilled time is stored like the times written by the store, devices created at the same time are
+	// ordered by ID and paged through once
+	created := newTestDevice(t)
+	created.ID = uuid.Nil
+	created.CreatedAt = migrated.CreatedAt
+	require.NoError(t, store.CreateDevice(ctx, created))
+
+	var listed []uuid.UUID
+	query := domain.DeviceQuery{Limit: 1}
+	for {
+		page, err := store.QueryDevices(ctx, query)
+		require.NoError(t, err)
+
+		for _, device := range page.Devices {
+			listed = append(listed, device.ID)
+		}
+
+		if page.Next == nil {
+			break
+		}
+		query.After = page.Next
+	}
+	require.Equal(t, []uuid.UUID{created.ID, old.ID}, listed)
+}
+
+func TestSQLite_RunTransaction(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLite(t)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+
+	first := newTestSignature(device, 0, "first", "0_a_b")
+
+	err := store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+		err := store.SaveSignature(ctx, device.ID, first)
+		if err != nil {
+			return err
+		}
+
+		return store.IncrementSignatureCounter(ctx, device.ID)
+	})
+	require.NoError(t, err)
+
+	err = store.RunTransaction(ctx, device.ID, func(ctx context.Context) error {
+		err := store.SaveSignature(ctx, device.ID, newTestSignature(device, 1, "second", "1_a_first"))
+		if err != nil {
+			return err
+		}
+
+		return errors.New("failure")
+	})
+	require.Error(t, err)
+
+	last, err := store.GetLastSignature(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, first, last)
+
+	signatures, err := store.GetSignatures(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, []domain.SignedData{first}, signatures)
+
+	got, err := store.GetSignature(ctx, device.ID, 0)
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+
+	_, err = store.GetSignature(ctx, device.ID, 1)
+	require.ErrorIs(t, err, domain.ErrSignatureNotFound)
+
+	_, err = store.GetSignature(ctx, uuid.New(), 0)
+	require.ErrorIs(t, err, domain.ErrDeviceNotFound)
+
+	err = store.RunTransaction(ctx, uuid.New(), func(ctx context.Context) error { return nil })
+	require.ErrorIs(t, err, domain.ErrDeviceNotFound)
+}
+
+func TestSQLite_RotateDeviceKey(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	store := newTestSQLite(t)
+	device := newTestDevice(t)
+
+	require.NoError(t, store.CreateDevice(ctx, device))
+
+	deviceSvc := domain.NewDeviceService(logger, store, crypto.NewGenerator(), domain.KeyPolicy{})
+	signatureSvc := domain.NewSignatureService(
+		logger, deviceSvc, crypto.NewSignerCreator(), crypto.NewVerifierCreator(), store, 0,
+	)
+
+	first, err := signatureSvc.SignTransaction(ctx, device.ID, "first")
+	require.NoError(t, err)
+
+	rotated, err := deviceSvc.RotateKey(
+		ctx, device.ID, domain.AlgorithmRSA, domain.KeyParams{Padding: domain.PaddingPSS, Hash: domain.HashSHA512},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 2, rotated.KeyVersion)
+
+	second, err := signatureSvc.SignTransaction(ctx, device.ID, "second")
+	require.NoError(t, err)
+	require.Equal(t, "1_second_"+first.Signature, second.OriginalData)
+
+	// Every signature remembers the key version it was created with
+	signatures, err := store.GetSignatures(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, signatures[0].KeyVersion)
+	require.Equal(t, 2, signatures[1].KeyVersion)
+
+	got, err := store.GetDevice(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.AlgorithmRSA, got.Algorithm)
+	require.Equal(t, domain.KeyParams{
+		RSABits: 2048, Padding: domain.PaddingPSS, SaltLength: 64, Hash: domain.HashSHA512,
+	}, got.KeyParams)
+	require.Equal(t, 2, got.KeyVersion)
+	require.Equal(t, uint64(1), got.KeyValidFrom)
+	require.Len(t, got.RetiredKeys, 1)
+	require.Equal(t, device.KeyPair, got.RetiredKeys[0].KeyPair)
+	require.Equal(t, device.KeyParams, got.RetiredKeys[0].Params)
+	require.Equal(t, uint64(1), got.RetiredKeys[0].ValidUntil)
+
+	valid, err := signatureSvc.VerifySignature(ctx, device.ID, first.Signature, first.OriginalData)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	audit, err := signatureSvc.AuditChain(ctx, device.ID)
+	require.NoError(t, err)
+	require.Equal(t, domain.ChainAudit{Valid: true, Checked: 2}, audit)
+}
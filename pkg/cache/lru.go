@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU holds up to a fixed number of values and evicts the least recently used one to make room for a new one. It is
+// safe for concurrent use. An LRU of size 0 holds nothing, so caching can be turned off without changing the callers.
+type LRU[K comparable, V any] struct {
+	mu      sync.Mutex
+	size    int
+	entries map[K]*list.Element
+	order   *list.List // most recently used first
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func NewLRU[K comparable, V any](size int) *LRU[K, V] {
+	return &LRU[K, V]{
+		size:    max(size, 0),
+		entries: make(map[K]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the value cached for the key and marks it as the most recently used one.
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return element.Value.(*entry[K, V]).value, true
+}
+
+// Add caches the value for the key, replacing the one cached before. If the cache is full, the least recently used
+// value is evicted.
+func (c *LRU[K, V]) Add(key K, value V) {
+	if c.size == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	if c.order.Len() == c.size {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+}
+
+// Remove evicts the value cached for the key, if there is one.
+func (c *LRU[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// RemoveFunc evicts the values of all keys for which del returns true.
+func (c *LRU[K, V]) RemoveFunc(del func(key K) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if del(key) {
+			c.remove(element)
+		}
+	}
+}
+
+// Len returns the number of cached values.
+func (c *LRU[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *LRU[K, V]) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*entry[K, V]).key)
+}
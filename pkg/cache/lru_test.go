@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestLRU_Evict(t *testing.T) {
+	c := NewLRU[string, int](2)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+
+	// Reading "a" makes "b" the least recently used value
+	value, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, value)
+
+	c.Add("c", 3)
+	require.Equal(t, 2, c.Len())
+
+	_, ok = c.Get("b")
+	require.False(t, ok)
+
+	value, ok = c.Get("c")
+	require.True(t, ok)
+	require.Equal(t, 3, value)
+
+	// Replacing a value does not evict another one
+	c.Add("a", 10)
+	require.Equal(t, 2, c.Len())
+
+	value, ok = c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 10, value)
+}
+
+func TestLRU_Remove(t *testing.T) {
+	c := NewLRU[int, string](10)
+	for i := range 6 {
+		c.Add(i, fmt.Sprint(i))
+	}
+
+	c.Remove(0)
+	c.Remove(100)
+	c.RemoveFunc(func(key int) bool {
+		return key%2 == 1
+	})
+
+	require.Equal(t, 2, c.Len())
+
+	for key, want := range map[int]bool{0: false, 1: false, 2: true, 3: false, 4: true, 5: false} {
+		_, ok := c.Get(key)
+		require.Equal(t, want, ok, "key %d", key)
+	}
+}
+
+func TestLRU_Disabled(t *testing.T) {
+	c := NewLRU[string, int](0)
+
+	c.Add("a", 1)
+
+	_, ok := c.Get("a")
+	require.False(t, ok)
+	require.Zero(t, c.Len())
+}
+
+func TestLRU_Concurrent(t *testing.T) {
+	c := NewLRU[int, int](16)
+
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range 1000 {
+				key := (worker + i) % 32
+				if value, ok := c.Get(key); ok && value != key {
+					t.Errorf("got %d for key %d", value, key)
+				}
+
+				c.Add(key, key)
+				if i%100 == 0 {
+					c.Remove(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.LessOrEqual(t, c.Len(), 16)
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const TagKey = "env"
@@ -64,35 +66,70 @@ func (e *Env) fillStruct(value reflect.Value) error {
 			return fmt.Errorf("unexported field type: %s", valueFieldType.Type)
 		}
 
-		switch valueField.Kind() {
-		case reflect.Struct:
+		if valueField.Kind() == reflect.Struct {
 			err := e.fillStruct(valueField)
 			if err != nil {
 				return err
 			}
+
+			continue
+		}
+
+		// Keep the default value of the field if the variable is not set
+		raw := e.source(valueFieldType.Tag.Get(TagKey))
+		if raw == "" {
+			continue
+		}
+
+		// Durations are int64 underneath, they are parsed in the time.ParseDuration format instead
+		if valueField.Type() == reflect.TypeOf(time.Duration(0)) {
+			v, err := time.ParseDuration(raw)
+			if err != nil {
+				return err
+			}
+
+			valueField.SetInt(int64(v))
+
+			continue
+		}
+
+		switch valueField.Kind() {
 		case reflect.String:
-			valueField.SetString(e.source(valueFieldType.Tag.Get(TagKey)))
+			valueField.SetString(raw)
 		case reflect.Bool:
-			v, err := strconv.ParseBool(e.source(valueFieldType.Tag.Get(TagKey)))
+			v, err := strconv.ParseBool(raw)
 			if err != nil {
 				return err
 			}
 
 			valueField.SetBool(v)
 		case reflect.Int:
-			v, err := strconv.ParseInt(e.source(valueFieldType.Tag.Get(TagKey)), 10, 64)
+			v, err := strconv.ParseInt(raw, 10, 64)
 			if err != nil {
 				return err
 			}
 
 			valueField.SetInt(v)
 		case reflect.Float32, reflect.Float64:
-			v, err := strconv.ParseFloat(e.source(valueFieldType.Tag.Get(TagKey)), 64)
+			v, err := strconv.ParseFloat(raw, 64)
 			if err != nil {
 				return err
 			}
 
 			valueField.SetFloat(v)
+		case reflect.Slice:
+			// Lists of strings are comma separated
+			if valueField.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("unsupported type %s for field %s", valueField.Type(), valueFieldType.Type)
+			}
+
+			values := strings.Split(raw, ",")
+			slice := reflect.MakeSlice(valueField.Type(), len(values), len(values))
+			for i, v := range values {
+				slice.Index(i).SetString(strings.TrimSpace(v))
+			}
+
+			valueField.Set(slice)
 		default:
 			return fmt.Errorf("unsupported type %s for field %s", valueField.Kind(), valueFieldType.Type)
 		}
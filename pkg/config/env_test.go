@@ -3,10 +3,13 @@ package config
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 type bar struct {
-	Baz float64 `env:"BAR_BAZ"`
+	Baz  float64       `env:"BAR_BAZ"`
+	Qux  time.Duration `env:"BAR_QUX"`
+	Quux []string      `env:"BAR_QUUX"`
 }
 
 type test struct {
@@ -51,6 +54,10 @@ func TestEnv_Set(t *testing.T) {
 						return "42"
 					case "BAR_BAZ":
 						return "1.5"
+					case "BAR_QUX":
+						return "1h30m"
+					case "BAR_QUUX":
+						return "a, b"
 					default:
 						return ""
 					}
@@ -63,11 +70,55 @@ func TestEnv_Set(t *testing.T) {
 				Hello: "Lorem",
 				World: 42,
 				Bar: bar{
-					Baz: 1.5,
+					Baz:  1.5,
+					Qux:  90 * time.Minute,
+					Quux: []string{"a", "b"},
 				},
 			},
 			wantErr: false,
 		},
+		{
+			name: "unset values keep defaults",
+			fields: fields{
+				source: func(s string) string {
+					switch s {
+					case "HELLO":
+						return "Lorem"
+					default:
+						return ""
+					}
+				},
+			},
+			args: args{
+				conf: &test{World: 8080, Bar: bar{Baz: 0.5}},
+			},
+			wantConf: &test{
+				Hello: "Lorem",
+				World: 8080,
+				Bar: bar{
+					Baz: 0.5,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duration is malformed",
+			fields: fields{
+				source: func(s string) string {
+					switch s {
+					case "BAR_QUX":
+						return "90"
+					default:
+						return ""
+					}
+				},
+			},
+			args: args{
+				conf: &test{},
+			},
+			wantConf: nil,
+			wantErr:  true,
+		},
 		{
 			name: "struct has unsupported field types",
 			fields: fields{